@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie     = "gsd_session"       // holds the token of the login session
+	sessionLifetime   = 30 * 24 * time.Hour // how long a login lasts
+	minPasswordLength = 8
+	userIDKey         = "user_id" // of the logged-in user, in the gin context
+)
+
+// hashPassword hashes a password with bcrypt for storing it.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// dummyPasswordHash is checked against when a login names a user that
+// doesn't exist, so it takes as long as a wrong password and doesn't give
+// away which usernames exist.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// newSessionToken returns a random token for a login session along with
+// the hash it is stored under.
+func newSessionToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashSessionToken(token), nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// setSessionCookie sets the cookie holding the token of a login session, or
+// clears it if token is empty. It is kept from scripts and, unless the
+// server allows insecure cookies, only sent over HTTPS.
+func (s *Server) setSessionCookie(c *gin.Context, token string) {
+	maxAge := int(sessionLifetime / time.Second)
+	if token == "" {
+		maxAge = -1
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !s.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// Login checks a username and password and starts a login session.
+func (s *Server) Login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.store.GetUserByUsername(req.Username)
+	if errors.Is(err, ErrNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(req.Password))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	token, tokenHash, err := newSessionToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	session := LoginSession{
+		TokenHash: tokenHash,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(sessionLifetime).UTC().Format(time.RFC3339),
+	}
+	if err := s.store.CreateLoginSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.setSessionCookie(c, token)
+	c.JSON(http.StatusOK, user)
+}
+
+// Logout ends the login session of the request, if any.
+func (s *Server) Logout(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil && token != "" {
+		if err := s.store.DeleteLoginSession(hashSessionToken(token)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	s.setSessionCookie(c, "")
+	c.Status(http.StatusNoContent)
+}
+
+// CurrentUser returns the logged-in user.
+func (s *Server) CurrentUser(c *gin.Context) {
+	user, err := s.store.GetUser(c.GetString(userIDKey))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// RequireLogin rejects requests without a valid login session, and records
+// the logged-in user of the others.
+func (s *Server) RequireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(sessionCookie)
+		if err != nil || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		session, err := s.store.GetLoginSession(hashSessionToken(token))
+		if errors.Is(err, ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(userIDKey, session.UserID)
+		c.Next()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// runCommand runs a command given on the command line instead of the
+// server. The only one is "user add <username>", which reads the password
+// from in.
+func runCommand(store Store, args []string, in io.Reader) error {
+	if len(args) == 3 && args[0] == "user" && args[1] == "add" {
+		return addUser(store, args[2], in)
+	}
+	return fmt.Errorf("unknown command %q, expected: user add <username>", strings.Join(args, " "))
+}
+
+// addUser creates an account, prompting for its password.
+func addUser(store Store, username string, in io.Reader) error {
+	username = strings.TrimSpace(username)
+	if username == "" || strings.ContainsAny(username, " \t\r\n") {
+		return errors.New("usernames can't be empty or contain spaces")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := readPassword(in)
+	if err != nil {
+		return fmt.Errorf("reading password: %w", err)
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("passwords need at least %d characters", minPasswordLength)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user := User{Username: username, PasswordHash: hash}
+	if err := store.CreateUser(&user); errors.Is(err, ErrConflict) {
+		return fmt.Errorf("user %s already exists", username)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added user %s\n", username)
+	return nil
+}
+
+// readPassword reads a line holding a password. Typing it on a terminal
+// doesn't echo it; other input, like a pipe, is read as it is.
+func readPassword(in io.Reader) (string, error) {
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && password != "") {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
@@ -2,60 +2,152 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
-var db *sql.DB
+// Dialect captures the differences between the SQL databases gsd can run on.
+type Dialect struct {
+	Name       string // value of the --db-driver flag
+	Driver     string // database/sql driver name
+	Migrations string // directory in migrationFiles holding this dialect's migrations
 
-func InitDB(dbPath string) {
-	var err error
+	// numberedParams is set for databases that expect $1, $2, ...
+	// placeholders instead of ?.
+	numberedParams bool
+	// isolation is the isolation level of transactions. SQLite transactions
+	// are serializable anyway, since they take the write lock up front.
+	isolation sql.IsolationLevel
+	// tableExists counts the tables with the name given as its parameter.
+	tableExists string
+}
 
-	// Ensure the directory exists
-	if dir := filepath.Dir(dbPath); dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatal(err)
+var (
+	SQLite = Dialect{Name: "sqlite", Driver: "sqlite3", Migrations: "migrations/sqlite",
+		tableExists: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"}
+	Postgres = Dialect{Name: "postgres", Driver: "postgres", Migrations: "migrations/postgres", numberedParams: true,
+		isolation:   sql.LevelSerializable,
+		tableExists: "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"}
+)
+
+func DialectByName(name string) (Dialect, error) {
+	for _, d := range []Dialect{SQLite, Postgres} {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Dialect{}, fmt.Errorf("unknown database driver %q (expected sqlite or postgres)", name)
+}
+
+// Rebind rewrites the ? placeholders in query into the dialect's own
+// placeholder syntax. Queries must not contain literal question marks.
+func (d Dialect) Rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Retryable reports whether err is a transaction failing because of a
+// concurrent one, which may succeed if it's run again.
+func (d Dialect) Retryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure and deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
+
+// InitDB opens the database described by dataSource (a file path for SQLite,
+// a connection string for Postgres) and applies any pending schema
+// migrations. With dryRun set, pending migrations are reported but not
+// applied, and nothing is created or written.
+func InitDB(dialect Dialect, dataSource string, dryRun bool) *sql.DB {
+	if dialect == SQLite && dryRun {
+		// Open the database read-only. One that doesn't exist yet has no
+		// migrations applied, just like an empty one.
+		file, _, _ := strings.Cut(dataSource, "?")
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			dataSource = ":memory:"
+		} else {
+			separator := "?"
+			if strings.Contains(dataSource, "?") {
+				separator = "&"
+			}
+			dataSource = "file:" + dataSource + separator + "mode=ro"
+		}
+	} else if dialect == SQLite {
+		// Ensure the directory exists
+		if dir := filepath.Dir(dataSource); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
-	db, err = sql.Open("sqlite3", dbPath)
+	db, err := sql.Open(dialect.Driver, dataSource)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := db.Ping(); err != nil {
+		log.Fatal(err)
+	}
 
-	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS inbox (
-		id TEXT PRIMARY KEY,
-		description TEXT NOT NULL,
-		url TEXT,
-		created_at DATETIME NOT NULL,
-		state TEXT CHECK(state IS NULL OR state IN ('deleted'))
-	);
-	CREATE TABLE IF NOT EXISTS projects (
-		id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		position REAL NOT NULL UNIQUE,
-		created_at DATETIME NOT NULL,
-		deadline TEXT
-	);
-	CREATE TABLE IF NOT EXISTS next_actions (
-		id TEXT PRIMARY KEY,
-		action TEXT NOT NULL,
-		project_id TEXT,
-		url TEXT,
-		size TEXT CHECK(size IS NULL OR size IN ('small', 'medium', 'big')),
-		energy TEXT CHECK(energy IS NULL OR energy IN ('high', 'low')),
-		created_at DATETIME NOT NULL,
-		completed_at DATETIME,
-		position REAL NOT NULL UNIQUE,
-		FOREIGN KEY(project_id) REFERENCES projects(id)
-	);
-	`
-	_, err = db.Exec(sqlStmt)
+	migrations, err := loadMigrations(migrationFiles, dialect.Migrations)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := Migrate(db, dialect, migrations, dryRun); err != nil {
+		log.Fatal(err)
+	}
+	if dryRun {
+		return db
+	}
+
+	if dialect == SQLite {
+		// SQLite leaves foreign keys unchecked unless every connection asks
+		// for them. Migrations that rebuild tables can't run with them on,
+		// so they're only switched on for the connections used afterwards.
+		// Transactions take the write lock when they begin rather than when
+		// they first write, so two of them can't both read and then
+		// deadlock trying to write; the second one waits for the first.
+		db.Close()
+		separator := "?"
+		if strings.Contains(dataSource, "?") {
+			separator = "&"
+		}
+		options := "_foreign_keys=on&_txlock=immediate&_busy_timeout=5000"
+		if db, err = sql.Open(dialect.Driver, dataSource+separator+options); err != nil {
+			log.Fatal(err)
+		}
+		if err := db.Ping(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return db
 }
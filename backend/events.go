@@ -0,0 +1,154 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventVersion is the version of the Event envelope. It changes whenever a
+// field is removed or changes meaning, so clients can tell events they
+// don't understand.
+const EventVersion = 1
+
+// Entities that events are about
+const (
+	EntityProject    = "project"
+	EntityNextAction = "next_action"
+	EntityContext    = "context"
+	EntityWaitingFor = "waiting_for"
+	EntitySomeday    = "someday"
+	EntityReference  = "reference"
+	EntityInbox      = "inbox"
+)
+
+// Changes that events report. Records taken out of the trash are reported
+// as created again, records moved to the trash as deleted.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// Event reports a committed change to an entity, e.g. a project.updated
+// event for a renamed project. Events are kept in an event log for a while,
+// so clients that lose their connection can catch up.
+type Event struct {
+	Sequence  int64  `json:"seq"` // orders all events, from 1
+	Version   int    `json:"version"`
+	Type      string `json:"type"` // entity and change, e.g. "project.updated"
+	Entity    string `json:"entity"`
+	EntityID  string `json:"entity_id"`
+	Revision  int64  `json:"revision"` // counts the changes of the entity, from 1
+	Timestamp string `json:"timestamp"`
+	Data      any    `json:"data"` // the entity after the change, null when deleted
+
+	// Scopes are the projects and contexts the entity belonged to before
+	// or after the change, like "project:<id>" and "context:@phone". Both
+	// count, so clients following a project hear about an action leaving
+	// it.
+	Scopes []string `json:"-"`
+}
+
+func newEvent(entity string, change string, id string, revision int64, data any) Event {
+	if change == EventDeleted {
+		data = nil
+	}
+	return Event{
+		Version:   EventVersion,
+		Type:      entity + "." + change,
+		Entity:    entity,
+		EntityID:  id,
+		Revision:  revision,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Data:      data,
+	}
+}
+
+func projectScope(id string) string   { return "project:" + id }
+func contextScope(name string) string { return "context:" + name }
+
+// entityScopes returns the scopes of an entity as data has it, which is
+// nil for deleted entities.
+func entityScopes(data any) []string {
+	var scopes []string
+	switch data := data.(type) {
+	case Project:
+		scopes = append(scopes, projectScope(data.ID))
+	case NextAction:
+		if data.ProjectID != "" {
+			scopes = append(scopes, projectScope(data.ProjectID))
+		}
+		for _, name := range data.Contexts {
+			scopes = append(scopes, contextScope(name))
+		}
+	case WaitingFor:
+		if data.ProjectID != "" {
+			scopes = append(scopes, projectScope(data.ProjectID))
+		}
+	}
+	return scopes
+}
+
+// eventScopes returns the scopes of an event about an entity that had the
+// scopes before and has the ones after.
+func eventScopes(before, after []string) []string {
+	scopes := slices.Concat(before, after)
+	slices.Sort(scopes)
+	return slices.Compact(scopes)
+}
+
+// entityOfTrashType returns the entity of records of a trash record type.
+func entityOfTrashType(recordType string) string {
+	if recordType == TrashInboxItem {
+		return EntityInbox
+	}
+	return recordType
+}
+
+// inboxChange returns the change of an inbox item going from one state to
+// another. Deleted inbox items stay in the inbox table, in the trash.
+func inboxChange(from string, to string) string {
+	switch {
+	case from != InboxDeleted && to == InboxDeleted:
+		return EventDeleted
+	case from == InboxDeleted && to != InboxDeleted:
+		return EventCreated
+	}
+	return EventUpdated
+}
+
+// EventBus hands the events of committed changes to its subscribers. Stores
+// publish the events of a change together once it is committed, so a change
+// that fails publishes nothing. Revisions tell the order of the events about
+// one entity.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers []func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe calls fn with every event published from now on. Subscribers
+// get one event at a time and should return quickly.
+func (b *EventBus) Subscribe(fn func(Event)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Publish delivers events to the subscribers. A nil bus drops them.
+func (b *EventBus) Publish(events []Event) {
+	if b == nil || len(events) == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, event := range events {
+		for _, fn := range b.subscribers {
+			fn(event)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestEventOrder writes from many goroutines at once. Readers of the event
+// log and subscribers must see the events in the order of their numbers,
+// with none missing in between, even while later ones are still committing.
+func TestEventOrder(t *testing.T) {
+	const writers, writes = 8, 25
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			events := NewEventBus()
+			var mutex sync.Mutex
+			published := []int64{}
+			events.Subscribe(func(event Event) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				published = append(published, event.Sequence)
+			})
+			store := kind.new(t, events)
+
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < writes; j++ {
+						if err := store.CreateInboxItem(&InboxItem{Description: "Item"}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			var last int64
+			for finished := false; !finished || last < writers*writes; {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+				logged, _, err := store.EventsSince(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, event := range logged {
+					if event.Sequence != last+1 {
+						t.Fatalf("read event %d after %d", event.Sequence, last)
+					}
+					last = event.Sequence
+				}
+				if finished && last < writers*writes {
+					t.Fatalf("the log ends at event %d of %d", last, writers*writes)
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for i, seq := range published {
+				if seq != int64(i+1) {
+					t.Fatalf("event %d was published as number %d", seq, i+1)
+				}
+			}
+		})
+	}
+}
+
+// writeInBackground creates n inbox items, a little apart so clients can
+// disconnect while they arrive, and returns a channel closed when done.
+func writeInBackground(t *testing.T, store Store, n int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			if err := store.CreateInboxItem(&InboxItem{Description: "Item " + strconv.Itoa(i)}); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return done
+}
+
+// checkResumed checks that a client that got the events up to last before
+// it disconnected got the rest after reconnecting, each once and in order.
+// Events repeated right after the replay are skipped, as clients do.
+func checkResumed(t *testing.T, last int64, resumed []int64, final int64) {
+	t.Helper()
+	next := last + 1
+	for _, seq := range resumed {
+		if seq < next {
+			continue
+		}
+		if seq != next {
+			t.Fatalf("got event %d after reconnecting after %d, want %d", seq, last, next)
+		}
+		next++
+	}
+	if next != final+1 {
+		t.Fatalf("got events up to %d after reconnecting, want up to %d", next-1, final)
+	}
+}
+
+// TestWebSocketResume disconnects a websocket client while events arrive
+// and reconnects it with the last event it got.
+func TestWebSocketResume(t *testing.T) {
+	const n = 60
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			events := NewEventBus()
+			store := kind.new(t, events)
+			srv := newTestServer(t, store, events)
+			url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+
+			// read returns the sequence numbers of the events a connection
+			// gets, until it has until or the connection goes quiet
+			read := func(conn *websocket.Conn, until int64) []int64 {
+				seqs := []int64{}
+				for len(seqs) == 0 || seqs[len(seqs)-1] < until {
+					conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+					var message struct {
+						Seq int64 `json:"seq"`
+					}
+					if err := conn.ReadJSON(&message); err != nil {
+						t.Fatalf("after events %v: %v", seqs, err)
+					}
+					seqs = append(seqs, message.Seq)
+				}
+				return seqs
+			}
+
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := writeInBackground(t, store, n)
+			got := read(conn, 10)
+			conn.Close()
+			<-done
+
+			_, final, err := store.EventsSince(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := got[len(got)-1]
+			conn, _, err = websocket.DefaultDialer.Dial(url+"?since="+strconv.FormatInt(last, 10), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkResumed(t, last, read(conn, final), final)
+		})
+	}
+}
+
+// TestSSEResume does the same for an SSE client, which reconnects with the
+// Last-Event-ID header.
+func TestSSEResume(t *testing.T) {
+	const n = 60
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			events := NewEventBus()
+			store := kind.new(t, events)
+			srv := newTestServer(t, store, events)
+
+			// stream returns the IDs of the events a request gets, until
+			// it has until, and then disconnects
+			stream := func(lastEventID string, until int64) []int64 {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lastEventID != "" {
+					req.Header.Set("Last-Event-ID", lastEventID)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+
+				ids := []int64{}
+				scanner := bufio.NewScanner(resp.Body)
+				for scanner.Scan() {
+					value, ok := strings.CutPrefix(scanner.Text(), "id: ")
+					if !ok {
+						continue
+					}
+					id, err := strconv.ParseInt(value, 10, 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ids = append(ids, id); id >= until {
+						return ids
+					}
+				}
+				t.Fatalf("stream ended after events %v: %v", ids, scanner.Err())
+				return nil
+			}
+
+			done := writeInBackground(t, store, n)
+			got := stream("", 10)
+			<-done
+
+			_, final, err := store.EventsSince(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := got[len(got)-1]
+			checkResumed(t, last, stream(strconv.FormatInt(last, 10), final), final)
+		})
+	}
+}
@@ -1,93 +1,58 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
-type Project struct {
-	ID        string  `json:"id"`
-	Name      string  `json:"name"`
-	Position  float64 `json:"position"`
-	CreatedAt string  `json:"created_at"`
-	Deadline  string  `json:"deadline,omitempty"`
-}
-
-// Request body for position update
-type UpdatePositionRequest struct {
-	Position float64 `json:"position"`
-}
-
 type UpdateProjectRequest struct {
-	Position float64 `json:"position,omitempty"`
 	Deadline *string `json:"deadline"`
-}
-
-type NextAction struct {
-	ID          string  `json:"id"`
-	Action      string  `json:"action"`
-	ProjectID   string  `json:"project_id,omitempty"`
-	URL         string  `json:"url,omitempty"`
-	Size        string  `json:"size,omitempty"`
-	Energy      string  `json:"energy,omitempty"`
-	CreatedAt   string  `json:"created_at"`
-	CompletedAt string  `json:"completed_at,omitempty"`
-	Position    float64 `json:"position"`
+	Status   *string `json:"status"`
 }
 
 type UpdateNextActionRequest struct {
-	Action      string  `json:"action,omitempty"`
-	ProjectID   string  `json:"project_id,omitempty"`
-	URL         string  `json:"url,omitempty"`
-	Size        string  `json:"size,omitempty"`
-	Energy      string  `json:"energy,omitempty"`
-	CompletedAt string  `json:"completed_at,omitempty"`
-	Position    float64 `json:"position,omitempty"`
-}
-
-type InboxItem struct {
-	ID          string `json:"id"`
-	Description string `json:"description"`
+	Action      string `json:"action,omitempty"`
+	ProjectID   string `json:"project_id,omitempty"`
 	URL         string `json:"url,omitempty"`
-	CreatedAt   string `json:"created_at"`
+	Size        string `json:"size,omitempty"`
+	Energy      string `json:"energy,omitempty"`
+	CompletedAt string `json:"completed_at,omitempty"`
 }
 
-type UpdateInboxItemRequest struct {
-	Description string `json:"description,omitempty"`
-	URL         string `json:"url,omitempty"`
-	CreatedAt   string `json:"created_at"`
-}
+// GetProjects lists active projects. The status query parameter selects
+// other statuses instead, as a comma separated list or "all".
+func (s *Server) GetProjects(c *gin.Context) {
+	filter := ProjectFilter{Statuses: []string{ProjectActive}}
+	if status := c.Query("status"); status == "all" {
+		filter.Statuses = nil
+	} else if status != "" {
+		filter.Statuses = strings.Split(status, ",")
+		for _, status := range filter.Statuses {
+			if !validProjectStatus(status) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project status: " + status})
+				return
+			}
+		}
+	}
 
-func GetProjects(c *gin.Context) {
-	rows, err := db.Query("SELECT id, name, position, deadline FROM projects ORDER BY position")
+	projects, err := s.store.ListProjects(filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-	var projects []Project
-	for rows.Next() {
-		var project Project
-		if err := rows.Scan(&project.ID, &project.Name, &project.Position, &project.Deadline); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		projects = append(projects, project)
-	}
-
-	if len(projects) == 0 {
-		projects = []Project{}
-	}
 
 	c.JSON(http.StatusOK, projects)
 }
 
-func CreateProject(c *gin.Context) {
+func (s *Server) CreateProject(c *gin.Context) {
 	var project Project
 	if err := c.ShouldBindJSON(&project); err != nil {
 		log.Println("Error decoding request body:", err)
@@ -95,32 +60,19 @@ func CreateProject(c *gin.Context) {
 		return
 	}
 
-	if project.ID == "" {
-		project.ID = uuid.New().String()
-	}
-
-	// Set creation time
-	project.CreatedAt = time.Now().UTC().Format(time.RFC3339)
-
-	log.Println("Inserting project into database with ID:", project.ID, "and Name:", project.Name)
-
-	// Get max position
-	var maxPosition sql.NullFloat64
-	err := db.QueryRow("SELECT MAX(position) FROM projects").Scan(&maxPosition)
-	if err != nil {
-		log.Println("Error getting max position:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := validateNewProject(project); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if !maxPosition.Valid {
-		project.Position = 1.0
-	} else {
-		project.Position = maxPosition.Float64 + 1.0
-	}
+	log.Println("Inserting project into database with ID:", project.ID, "and Name:", project.Name)
 
-	_, err = db.Exec("INSERT INTO projects (id, name, position, deadline, created_at) VALUES (?, ?, ?, ?, ?)",
-		project.ID, project.Name, project.Position, project.Deadline, project.CreatedAt)
+	err := s.journaled(c, "create project", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateProject(&project); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashProject, ID: project.ID}}, nil
+	})
 	if err != nil {
 		log.Println("Error inserting into database:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -130,7 +82,16 @@ func CreateProject(c *gin.Context) {
 	c.JSON(http.StatusOK, project)
 }
 
-func UpdateProject(c *gin.Context) {
+// validateNewProject checks a project about to be created. Projects can't be
+// created as already finished.
+func validateNewProject(project Project) error {
+	if project.Status != "" && project.Status != ProjectActive && project.Status != ProjectOnHold && project.Status != ProjectSomeday {
+		return errors.New("New projects must be active, on_hold or someday")
+	}
+	return nil
+}
+
+func (s *Server) UpdateProject(c *gin.Context) {
 	projectID := c.Param("id")
 
 	var req UpdateProjectRequest
@@ -140,191 +101,269 @@ func UpdateProject(c *gin.Context) {
 		return
 	}
 
-	query := "UPDATE projects SET"
-	var params []interface{}
-	var setFields []string
-
-	// Check if position was included
-	if req.Position != 0 {
-		setFields = append(setFields, " position = ?")
-		params = append(params, req.Position)
-	}
-
-	// Check if deadline was explicitly included (even if null)
+	var update ProjectUpdate
+	// Check if deadline was explicitly included
 	if req.Deadline != nil {
-		setFields = append(setFields, " deadline = ?")
-		params = append(params, req.Deadline)
+		update.Deadline = req.Deadline
+	}
+	if req.Status != nil {
+		if !validProjectStatus(*req.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project status: " + *req.Status})
+			return
+		}
+		update.Status = req.Status
 	}
 
-	if len(setFields) == 0 {
+	if update == (ProjectUpdate{}) {
 		log.Println("No fields to update in request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
 	}
 
-	// Combine all set fields and add WHERE clause
-	for i := 0; i < len(setFields)-1; i++ {
-		query += setFields[i] + ","
+	var project Project
+	err := s.journaled(c, "update project", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashProject, projectID)
+		if err != nil {
+			return nil, err
+		}
+		project, err = tx.UpdateProject(projectID, update)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("No project found with ID: %s", projectID)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
 	}
-	query += setFields[len(setFields)-1] + " WHERE id = ?"
-	params = append(params, projectID)
-
-	log.Printf("Executing query: %s with params: %v", query, params)
-	result, err := db.Exec(query, params...)
-	if err != nil {
-		log.Printf("Error executing query: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if errors.Is(err, ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Project can't move to status " + *req.Status})
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
-
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
+		log.Printf("Error updating project: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if rowsAffected == 0 {
-		log.Printf("No project found with ID: %s", projectID)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+	c.JSON(http.StatusOK, project)
+}
+
+// MoveProject places a project before or after another one, as described
+// by Move. Other projects may be renumbered on the way, so clients should
+// reload the list after moving.
+func (s *Server) MoveProject(c *gin.Context) {
+	projectID := c.Param("id")
+
+	var move Move
+	if err := c.ShouldBindJSON(&move); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	var project Project
-	err = db.QueryRow("SELECT id, name, position, deadline FROM projects WHERE id = ?", projectID).
-		Scan(&project.ID, &project.Name, &project.Position, &project.Deadline)
+	err := s.journaled(c, "move project", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashProject, projectID)
+		if err != nil {
+			return nil, err
+		}
+		project, err = tx.MoveProject(projectID, move)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		log.Printf("Error fetching updated project: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated project"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, project)
 }
 
-func DeleteProject(c *gin.Context) {
+// DeleteProject moves a project to the trash. The actions query parameter
+// says what happens to its next actions and waiting-for items: "orphan"
+// (the default) keeps them without a project, "delete" moves them to the
+// trash too and move_to=<id> hands them over to another project.
+func (s *Server) DeleteProject(c *gin.Context) {
 	projectID := c.Param("id")
 
-	result, err := db.Exec("DELETE FROM projects WHERE id = ?", projectID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	deletion := ProjectDeletion{
+		Actions: c.DefaultQuery("actions", ProjectActionsOrphan),
+		MoveTo:  c.Query("move_to"),
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if deletion.MoveTo != "" {
+		if _, ok := c.GetQuery("actions"); ok && deletion.Actions != ProjectActionsMove {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "move_to can't be combined with actions=" + deletion.Actions})
+			return
+		}
+		deletion.Actions = ProjectActionsMove
+	}
+	switch deletion.Actions {
+	case ProjectActionsOrphan, ProjectActionsDelete:
+	case ProjectActionsMove:
+		if deletion.MoveTo == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "move_to is required with actions=move"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "actions must be orphan, delete or move"})
 		return
 	}
 
-	if rowsAffected == 0 {
+	err := s.journaled(c, "delete project", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeProjectChange(tx, projectID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteProject(projectID, deletion)
+	})
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.Status(http.StatusOK)
 }
 
-func GetNextActions(c *gin.Context) {
-	rows, err := db.Query("SELECT id, action, project_id, url, size, energy, created_at, completed_at, position FROM next_actions ORDER BY position")
+func (s *Server) GetNextActions(c *gin.Context) {
+	filter := NextActionFilter{
+		Context:         normalizeContextName(c.Query("context")),
+		IncludeDeferred: c.Query("include_deferred") == "true",
+	}
+
+	actions, err := s.store.ListNextActions(filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var actions []NextAction
-	for rows.Next() {
-		var action NextAction
-		var size, energy, projectID, url, completedAt sql.NullString
 
-		if err := rows.Scan(&action.ID, &action.Action, &projectID, &url, &size,
-			&energy, &action.CreatedAt, &completedAt, &action.Position); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	c.JSON(http.StatusOK, actions)
+}
 
-		// Only set the fields if they are not NULL
-		if size.Valid {
-			action.Size = size.String
-		}
-		if energy.Valid {
-			action.Energy = energy.String
-		}
-		if projectID.Valid {
-			action.ProjectID = projectID.String
-		}
-		if url.Valid {
-			action.URL = url.String
-		}
-		if completedAt.Valid {
-			action.CompletedAt = completedAt.String
-		}
+// GetProjectNextActions lists the next actions of a project in their order
+// within the project. It takes the same query parameters as GetNextActions.
+func (s *Server) GetProjectNextActions(c *gin.Context) {
+	projectID := c.Param("id")
+	if _, err := s.store.GetProject(projectID); errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-		actions = append(actions, action)
+	filter := NextActionFilter{
+		Context:         normalizeContextName(c.Query("context")),
+		ProjectID:       projectID,
+		IncludeDeferred: c.Query("include_deferred") == "true",
 	}
 
-	if len(actions) == 0 {
-		actions = []NextAction{}
+	actions, err := s.store.ListNextActions(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+
 	c.JSON(http.StatusOK, actions)
 }
 
-func CreateNextAction(c *gin.Context) {
+func (s *Server) CreateNextAction(c *gin.Context) {
 	var action NextAction
 	if err := c.ShouldBindJSON(&action); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if action.ID == "" {
-		action.ID = uuid.New().String()
+	if err := s.prepareNextAction(&action); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Get max position
-	var maxPosition sql.NullFloat64
-	err := db.QueryRow("SELECT MAX(position) FROM next_actions").Scan(&maxPosition)
+	err := s.journaled(c, "create next action", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateNextAction(&action); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashNextAction, ID: action.ID}}, nil
+	})
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if !maxPosition.Valid {
-		action.Position = 1.0
-	} else {
-		action.Position = maxPosition.Float64 + 1.0
-	}
 
-	// Set creation time
-	action.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	c.JSON(http.StatusOK, action)
+}
 
-	// Handle NULL values
-	var sizeParam, energyParam interface{}
-	if action.Size == "" {
-		sizeParam = nil
-	} else {
-		sizeParam = action.Size
+// prepareNextAction normalizes the defer date and recurrence of a next
+// action about to be created.
+func (s *Server) prepareNextAction(action *NextAction) error {
+	var err error
+	if action.DeferUntil, err = parseDeferUntil(action.DeferUntil, s.location); err != nil {
+		return err
 	}
-	if action.Energy == "" {
-		energyParam = nil
-	} else {
-		energyParam = action.Energy
-	}
-
-	_, err = db.Exec(`
-		INSERT INTO next_actions (id, action, project_id, url, size, energy, created_at, completed_at, position) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		action.ID, action.Action, action.ProjectID, action.URL, sizeParam,
-		energyParam, action.CreatedAt, nil, action.Position)
+	action.Recurrence, action.RecurrenceStart, action.OccursAt, err = scheduleRecurrence(action.Recurrence, action.RecurrenceStart, s.location)
+	return err
+}
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// optionalString returns a pointer to the string stored under key in a
+// decoded JSON object, or nil if the key is absent. An explicit null is
+// returned as an empty string.
+func optionalString(rawJson map[string]interface{}, key string) (*string, error) {
+	value, exists := rawJson[key]
+	if !exists {
+		return nil, nil
 	}
+	switch v := value.(type) {
+	case nil:
+		empty := ""
+		return &empty, nil
+	case string:
+		return &v, nil
+	default:
+		return nil, fmt.Errorf("%s must be a string or null", key)
+	}
+}
 
-	c.JSON(http.StatusOK, action)
+// stringList converts a decoded JSON array of strings. null is treated as an
+// empty list.
+func stringList(value interface{}) ([]string, error) {
+	if value == nil {
+		return []string{}, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("not a list")
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		list = append(list, str)
+	}
+	return list, nil
 }
 
-func UpdateNextAction(c *gin.Context) {
+func (s *Server) UpdateNextAction(c *gin.Context) {
 	actionID := c.Param("id")
 
 	// Get the raw JSON to check which fields were actually included in the request
@@ -334,196 +373,1059 @@ func UpdateNextAction(c *gin.Context) {
 		return
 	}
 
-	query := "UPDATE next_actions SET"
-	var params []interface{}
-	var setFields []string
-
 	// Only update fields that were explicitly included in the request
-	if _, exists := rawJson["action"]; exists {
-		setFields = append(setFields, " action = ?")
-		params = append(params, rawJson["action"])
+	var update NextActionUpdate
+	var err error
+	for key, field := range map[string]**string{
+		"action":       &update.Action,
+		"project_id":   &update.ProjectID,
+		"url":          &update.URL,
+		"size":         &update.Size,
+		"energy":       &update.Energy,
+		"completed_at": &update.CompletedAt,
+		"defer_until":  &update.DeferUntil,
+	} {
+		if *field, err = optionalString(rawJson, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
-	if _, exists := rawJson["project_id"]; exists {
-		setFields = append(setFields, " project_id = ?")
-		params = append(params, rawJson["project_id"])
+	if update.DeferUntil != nil {
+		if *update.DeferUntil, err = parseDeferUntil(*update.DeferUntil, s.location); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
-	if _, exists := rawJson["url"]; exists {
-		setFields = append(setFields, " url = ?")
-		params = append(params, rawJson["url"])
+	// Changing the recurrence restarts it; the start can only be given
+	// together with the rule.
+	recurrence, err := optionalString(rawJson, "recurrence")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if _, exists := rawJson["size"]; exists {
-		setFields = append(setFields, " size = ?")
-		params = append(params, rawJson["size"])
+	recurrenceStart, err := optionalString(rawJson, "recurrence_start")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if _, exists := rawJson["energy"]; exists {
-		setFields = append(setFields, " energy = ?")
-		params = append(params, rawJson["energy"])
+	if recurrenceStart != nil && recurrence == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recurrence_start requires recurrence"})
+		return
 	}
-	if _, exists := rawJson["completed_at"]; exists {
-		setFields = append(setFields, " completed_at = ?")
-		// If completed_at is explicitly null, we want to remove the completion
-		if rawJson["completed_at"] == nil {
-			params = append(params, nil)
-		} else {
-			params = append(params, rawJson["completed_at"])
+	if recurrence != nil {
+		var start, occursAt string
+		if recurrenceStart != nil {
+			start = *recurrenceStart
+		}
+		*recurrence, start, occursAt, err = scheduleRecurrence(*recurrence, start, s.location)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
+		update.Recurrence, update.RecurrenceStart, update.OccursAt = recurrence, &start, &occursAt
 	}
-	if _, exists := rawJson["position"]; exists {
-		setFields = append(setFields, " position = ?")
-		params = append(params, rawJson["position"])
+	if value, exists := rawJson["contexts"]; exists {
+		contexts, err := stringList(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "contexts must be a list of strings"})
+			return
+		}
+		update.Contexts = &contexts
 	}
 
-	if len(setFields) == 0 {
+	if update == (NextActionUpdate{}) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
 	}
 
-	// Combine all set fields and add WHERE clause
-	for i := 0; i < len(setFields)-1; i++ {
-		query += setFields[i] + ","
-	}
-	query += setFields[len(setFields)-1] + " WHERE id = ?"
-	params = append(params, actionID)
+	var action NextAction
+	err = s.journaled(c, "update next action", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashNextAction, actionID)
+		if err != nil {
+			return nil, err
+		}
+		before, err := tx.GetNextAction(actionID)
+		if err != nil {
+			return nil, err
+		}
+		if action, err = tx.UpdateNextAction(actionID, update); err != nil {
+			return nil, err
+		}
 
-	result, err := db.Exec(query, params...)
+		// Completing a recurring action schedules its next occurrence, as
+		// part of the same change so undoing the completion removes it
+		if before.CompletedAt != "" || action.CompletedAt == "" {
+			return changes, nil
+		}
+		next, ok, err := nextOccurrence(action, time.Now(), s.location)
+		if err != nil || !ok {
+			return changes, err
+		}
+		if err := tx.CreateNextAction(&next); err != nil {
+			return nil, err
+		}
+		return append(changes, RecordChange{Type: TrashNextAction, ID: next.ID}), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	c.JSON(http.StatusOK, action)
+}
+
+// MoveNextAction places an action before or after another one, like
+// MoveProject.
+func (s *Server) MoveNextAction(c *gin.Context) {
+	actionID := c.Param("id")
+
+	var move Move
+	if err := c.ShouldBindJSON(&move); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var action NextAction
+	err := s.journaled(c, "move next action", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashNextAction, actionID)
+		if err != nil {
+			return nil, err
+		}
+		action, err = tx.MoveNextAction(actionID, move)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found"})
+
+	c.JSON(http.StatusOK, action)
+}
+
+// MoveProjectNextAction places an action before or after another action of
+// the same project in the project's own order, like MoveProject.
+func (s *Server) MoveProjectNextAction(c *gin.Context) {
+	projectID, actionID := c.Param("id"), c.Param("action_id")
+
+	var move Move
+	if err := c.ShouldBindJSON(&move); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Fetch the updated action data
 	var action NextAction
-	var size, energy, projectID, url, completedAt sql.NullString
-	err = db.QueryRow(`
-        SELECT id, action, project_id, url, size, energy, created_at, completed_at, position 
-        FROM next_actions WHERE id = ?`, actionID).
-		Scan(&action.ID, &action.Action, &projectID, &url, &size,
-			&energy, &action.CreatedAt, &completedAt, &action.Position)
+	err := s.journaled(c, "move next action in project", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashNextAction, actionID)
+		if err != nil {
+			return nil, err
+		}
+		action, err = tx.MoveProjectNextAction(projectID, actionID, move)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found in the project"})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated action"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Set the nullable fields if they are valid
-	if size.Valid {
-		action.Size = size.String
+	c.JSON(http.StatusOK, action)
+}
+
+// PreviewRecurrence lists the next occurrences of a recurrence rule, e.g.
+// /recurrence/preview?rule=FREQ=WEEKLY;BYDAY=MO&start=2024-01-01&count=5.
+// Occurrences are listed from now on, or from the start if that is later.
+func (s *Server) PreviewRecurrence(c *gin.Context) {
+	rule, err := ParseRule(c.Query("rule"), s.location)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule: " + err.Error()})
+		return
 	}
-	if energy.Valid {
-		action.Energy = energy.String
+	start, err := parseRecurrenceStart(c.Query("start"), s.location)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if projectID.Valid {
-		action.ProjectID = projectID.String
+	count := 5
+	if value := c.Query("count"); value != "" {
+		if count, err = strconv.Atoi(value); err != nil || count < 1 || count > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and 100"})
+			return
+		}
 	}
-	if url.Valid {
-		action.URL = url.String
+
+	after := time.Now()
+	if start.After(after) {
+		after = start.Add(-time.Nanosecond)
 	}
-	if completedAt.Valid {
-		action.CompletedAt = completedAt.String
+	occurrences := []string{}
+	for _, t := range rule.Occurrences(start, after, count) {
+		occurrences = append(occurrences, t.UTC().Format(time.RFC3339))
 	}
 
-	c.JSON(http.StatusOK, action)
+	c.JSON(http.StatusOK, gin.H{"rule": rule.String(), "occurrences": occurrences})
 }
 
-func DeleteNextAction(c *gin.Context) {
+func (s *Server) DeleteNextAction(c *gin.Context) {
 	actionID := c.Param("id")
-	result, err := db.Exec("DELETE FROM next_actions WHERE id = ?", actionID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+	err := s.journaled(c, "delete next action", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashNextAction, actionID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteNextAction(actionID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found"})
 		return
 	}
-
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Next action not found"})
-		return
-	}
 
 	c.Status(http.StatusOK)
 }
 
-func GetInboxItems(c *gin.Context) {
-	rows, err := db.Query("SELECT id, description, url, created_at FROM inbox WHERE state IS NULL")
+func (s *Server) GetContexts(c *gin.Context) {
+	contexts, err := s.store.ListContexts()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var items []InboxItem
-	for rows.Next() {
-		var item InboxItem
-		if err := rows.Scan(&item.ID, &item.Description, &item.URL, &item.CreatedAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		items = append(items, item)
-	}
 
-	if len(items) == 0 {
-		items = []InboxItem{}
-	}
+	c.JSON(http.StatusOK, contexts)
+}
 
-	c.JSON(http.StatusOK, items)
+type ContextRequest struct {
+	Name string `json:"name" binding:"required"`
 }
 
-func CreateInboxItem(c *gin.Context) {
-	var item InboxItem
-	if err := c.ShouldBindJSON(&item); err != nil {
+func (s *Server) CreateContext(c *gin.Context) {
+	var req ContextRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if item.ID == "" {
-		item.ID = uuid.New().String()
+	if normalizeContextName(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context name is required"})
+		return
 	}
 
-	// Set creation time
-	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
-
-	_, err := db.Exec("INSERT INTO inbox (id, description, url, created_at) VALUES (?, ?, ?, ?)", item.ID, item.Description, item.URL, item.CreatedAt)
+	context := Context{Name: req.Name}
+	err := s.recorded(c, "create context", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateContext(&context); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: HistoryContext, ID: context.ID}}, nil
+	})
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Context already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	manager.BroadcastUpdate(map[string]any{
-		"type": "inbox_item_created",
-		"data": item,
-	})
-
-	c.JSON(http.StatusOK, item)
+	c.JSON(http.StatusOK, context)
 }
 
-func DeleteInboxItem(c *gin.Context) {
-	itemID := c.Param("id")
+func (s *Server) UpdateContext(c *gin.Context) {
+	contextID := c.Param("id")
 
-	result, err := db.Exec("UPDATE inbox SET state = 'deleted' WHERE id = ?", itemID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var req ContextRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if normalizeContextName(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context name is required"})
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	var context Context
+	err := s.recorded(c, "rename context", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeContextChange(tx, contextID)
+		if err != nil {
+			return nil, err
+		}
+		context, err = tx.RenameContext(contextID, req.Name)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Context already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox item not found"})
+
+	c.JSON(http.StatusOK, context)
+}
+
+func (s *Server) DeleteContext(c *gin.Context) {
+	contextID := c.Param("id")
+
+	err := s.recorded(c, "delete context", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeContextChange(tx, contextID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteContext(contextID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// validDate reports whether s is empty or a YYYY-MM-DD date.
+func validDate(s string) bool {
+	if s == "" {
+		return true
+	}
+	_, err := time.Parse(time.DateOnly, s)
+	return err == nil
+}
+
+// validateWaitingFor checks the fields clients set when creating a
+// waiting-for item.
+func validateWaitingFor(item WaitingFor) error {
+	if item.DelegatedTo == "" {
+		return errors.New("delegated_to is required")
+	}
+	if !validDate(item.DelegatedAt) || !validDate(item.FollowUpAt) {
+		return errors.New("dates must be formatted as YYYY-MM-DD")
+	}
+	return nil
+}
+
+func (s *Server) GetWaitingFor(c *gin.Context) {
+	filter := WaitingForFilter{
+		IncludeResolved: c.Query("include_resolved") == "true",
+	}
+	if c.Query("follow_up_due") == "true" {
+		filter.FollowUpDue = time.Now().In(s.location).Format(time.DateOnly)
+	}
+
+	items, err := s.store.ListWaitingFor(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) CreateWaitingFor(c *gin.Context) {
+	var item WaitingFor
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if item.What == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "what is required"})
+		return
+	}
+	if err := validateWaitingFor(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.journaled(c, "create waiting-for item", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateWaitingFor(&item); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashWaitingFor, ID: item.ID}}, nil
+	})
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) UpdateWaitingFor(c *gin.Context) {
+	itemID := c.Param("id")
+
+	// Get the raw JSON to check which fields were actually included in the request
+	var rawJson map[string]interface{}
+	if err := c.ShouldBindJSON(&rawJson); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Only update fields that were explicitly included in the request
+	var update WaitingForUpdate
+	var err error
+	for key, field := range map[string]**string{
+		"what":         &update.What,
+		"delegated_to": &update.DelegatedTo,
+		"delegated_at": &update.DelegatedAt,
+		"follow_up_at": &update.FollowUpAt,
+		"project_id":   &update.ProjectID,
+		"resolved_at":  &update.ResolvedAt,
+	} {
+		if *field, err = optionalString(rawJson, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if update == (WaitingForUpdate{}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+	if (update.What != nil && *update.What == "") || (update.DelegatedTo != nil && *update.DelegatedTo == "") ||
+		(update.DelegatedAt != nil && *update.DelegatedAt == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "what, delegated_to and delegated_at can't be empty"})
+		return
+	}
+	if (update.DelegatedAt != nil && !validDate(*update.DelegatedAt)) || (update.FollowUpAt != nil && !validDate(*update.FollowUpAt)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dates must be formatted as YYYY-MM-DD"})
+		return
+	}
+
+	var item WaitingFor
+	err = s.journaled(c, "update waiting-for item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashWaitingFor, itemID)
+		if err != nil {
+			return nil, err
+		}
+		item, err = tx.UpdateWaitingFor(itemID, update)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waiting-for item not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) DeleteWaitingFor(c *gin.Context) {
+	itemID := c.Param("id")
+
+	err := s.journaled(c, "delete waiting-for item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashWaitingFor, itemID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteWaitingFor(itemID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waiting-for item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) GetSomeday(c *gin.Context) {
+	items, err := s.store.ListSomeday()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) CreateSomeday(c *gin.Context) {
+	var item SomedayItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if item.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+		return
+	}
+
+	err := s.journaled(c, "create someday item", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateSomeday(&item); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashSomeday, ID: item.ID}}, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) UpdateSomeday(c *gin.Context) {
+	itemID := c.Param("id")
+
+	// Get the raw JSON to check which fields were actually included in the request
+	var rawJson map[string]interface{}
+	if err := c.ShouldBindJSON(&rawJson); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Only update fields that were explicitly included in the request
+	var update SomedayUpdate
+	var err error
+	for key, field := range map[string]**string{
+		"title": &update.Title,
+		"notes": &update.Notes,
+		"url":   &update.URL,
+	} {
+		if *field, err = optionalString(rawJson, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if update == (SomedayUpdate{}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+	if update.Title != nil && *update.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title can't be empty"})
+		return
+	}
+
+	var item SomedayItem
+	err = s.journaled(c, "update someday item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashSomeday, itemID)
+		if err != nil {
+			return nil, err
+		}
+		item, err = tx.UpdateSomeday(itemID, update)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Someday item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) DeleteSomeday(c *gin.Context) {
+	itemID := c.Param("id")
+
+	err := s.journaled(c, "delete someday item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashSomeday, itemID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteSomeday(itemID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Someday item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// PromoteSomeday turns a someday item into an active project.
+func (s *Server) PromoteSomeday(c *gin.Context) {
+	itemID := c.Param("id")
+
+	var project Project
+	err := s.journaled(c, "promote someday item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashSomeday, itemID)
+		if err != nil {
+			return nil, err
+		}
+		if project, err = tx.PromoteSomeday(itemID); err != nil {
+			return nil, err
+		}
+		return append(changes, RecordChange{Type: TrashProject, ID: project.ID}), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Someday item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, project)
+}
+
+// GetInboxItems lists the items in the inbox. The state query parameter
+// selects other states instead, as a comma separated list or "all", so
+// processed and deleted items can be looked up.
+func (s *Server) GetInboxItems(c *gin.Context) {
+	filter := InboxFilter{
+		IncludeDeferred: c.Query("include_deferred") == "true",
+	}
+	if state := c.Query("state"); state == "all" {
+		filter.States = []string{InboxOpen, InboxDeferred, InboxProcessed, InboxDeleted}
+	} else if state != "" {
+		filter.States = strings.Split(state, ",")
+		for _, state := range filter.States {
+			if !validInboxState(state) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid inbox state: " + state})
+				return
+			}
+		}
+	}
+
+	items, err := s.store.ListInboxItems(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) CreateInboxItem(c *gin.Context) {
+	var item InboxItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var err error
+	if item.DeferUntil, err = parseDeferUntil(item.DeferUntil, s.location); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = s.journaled(c, "create inbox item", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateInboxItem(&item); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashInboxItem, ID: item.ID}}, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) UpdateInboxItem(c *gin.Context) {
+	itemID := c.Param("id")
+
+	// Get the raw JSON to check which fields were actually included in the request
+	var rawJson map[string]interface{}
+	if err := c.ShouldBindJSON(&rawJson); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Only update fields that were explicitly included in the request
+	var update InboxItemUpdate
+	var err error
+	for key, field := range map[string]**string{
+		"description": &update.Description,
+		"url":         &update.URL,
+		"state":       &update.State,
+		"defer_until": &update.DeferUntil,
+	} {
+		if *field, err = optionalString(rawJson, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if update.Description != nil && *update.Description == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "description can't be empty"})
+		return
+	}
+	if update.State != nil && !validInboxState(*update.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid inbox state: " + *update.State})
+		return
+	}
+	// Processing creates records, which POST /inbox/:id/process takes care of
+	if update.State != nil && *update.State == InboxProcessed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use POST /api/inbox/:id/process to process inbox items"})
+		return
+	}
+	if update.DeferUntil != nil {
+		if *update.DeferUntil, err = parseDeferUntil(*update.DeferUntil, s.location); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if update == (InboxItemUpdate{}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	s.updateInboxItem(c, itemID, update)
+}
+
+// updateInboxItem applies update, responds with the updated item and tells
+// clients about it.
+func (s *Server) updateInboxItem(c *gin.Context, itemID string, update InboxItemUpdate) {
+	var item InboxItem
+	err := s.journaled(c, "update inbox item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashInboxItem, itemID)
+		if err != nil {
+			return nil, err
+		}
+		item, err = tx.UpdateInboxItem(itemID, update)
+		return changes, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox item not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) DeleteInboxItem(c *gin.Context) {
+	itemID := c.Param("id")
+
+	err := s.journaled(c, "delete inbox item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashInboxItem, itemID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteInboxItem(itemID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox item not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+type DeferRequest struct {
+	Until string `json:"until"`
+}
+
+// DeferInboxItem hides an inbox item until a later date. An empty until
+// brings it back right away.
+func (s *Server) DeferInboxItem(c *gin.Context) {
+	itemID := c.Param("id")
+
+	var req DeferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until, err := parseDeferUntil(req.Until, s.location)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.updateInboxItem(c, itemID, InboxItemUpdate{DeferUntil: &until})
+}
+
+// ConvertInboxItemToWaitingFor turns an inbox item into a waiting-for item
+// delegated to someone and removes it from the inbox.
+func (s *Server) ConvertInboxItemToWaitingFor(c *gin.Context) {
+	itemID := c.Param("id")
+
+	var item WaitingFor
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWaitingFor(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := s.journaled(c, "process inbox item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashInboxItem, itemID)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.ProcessInboxItem(itemID, InboxProcessing{WaitingFor: &item}); err != nil {
+			return nil, err
+		}
+		return append(changes, RecordChange{Type: TrashWaitingFor, ID: item.ID}), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox item not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// ProcessInboxRequest says what to turn an inbox item into. Data holds the
+// fields of the new record; empty titles default to the item's description.
+type ProcessInboxRequest struct {
+	Type string          `json:"type" binding:"required"` // next_action, project, waiting_for, someday or reference
+	Data json.RawMessage `json:"data"`
+}
+
+// ProcessInboxItem turns an inbox item into another kind of record and takes
+// it out of the inbox in one step, so a failure can't leave both behind.
+func (s *Server) ProcessInboxItem(c *gin.Context) {
+	itemID := c.Param("id")
+
+	var req ProcessInboxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data := req.Data
+	if len(data) == 0 || string(data) == "null" {
+		data = json.RawMessage("{}")
+	}
+
+	var processing InboxProcessing
+	var record any
+	var recordID *string // filled in once the record is created
+	var err error
+	switch req.Type {
+	case "next_action":
+		processing.NextAction = &NextAction{}
+		if err = json.Unmarshal(data, processing.NextAction); err == nil {
+			err = s.prepareNextAction(processing.NextAction)
+		}
+		record, recordID = processing.NextAction, &processing.NextAction.ID
+	case "project":
+		processing.Project = &Project{}
+		if err = json.Unmarshal(data, processing.Project); err == nil {
+			err = validateNewProject(*processing.Project)
+		}
+		record, recordID = processing.Project, &processing.Project.ID
+	case "waiting_for":
+		processing.WaitingFor = &WaitingFor{}
+		if err = json.Unmarshal(data, processing.WaitingFor); err == nil {
+			err = validateWaitingFor(*processing.WaitingFor)
+		}
+		record, recordID = processing.WaitingFor, &processing.WaitingFor.ID
+	case "someday":
+		processing.Someday = &SomedayItem{}
+		err = json.Unmarshal(data, processing.Someday)
+		record, recordID = processing.Someday, &processing.Someday.ID
+	case "reference":
+		processing.Reference = &ReferenceItem{}
+		err = json.Unmarshal(data, processing.Reference)
+		record, recordID = processing.Reference, &processing.Reference.ID
+	default:
+		err = errors.New("type must be next_action, project, waiting_for, someday or reference")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = s.journaled(c, "process inbox item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashInboxItem, itemID)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.ProcessInboxItem(itemID, processing); err != nil {
+			return nil, err
+		}
+		return append(changes, RecordChange{Type: req.Type, ID: *recordID}), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox item not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrInvalidReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"inbox_item_id": itemID,
+		"type":          req.Type,
+		"data":          record,
+	})
+}
+
+func (s *Server) GetReference(c *gin.Context) {
+	items, err := s.store.ListReference()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) CreateReference(c *gin.Context) {
+	var item ReferenceItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if item.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+		return
+	}
+
+	err := s.journaled(c, "create reference item", func(tx Store) ([]RecordChange, error) {
+		if err := tx.CreateReference(&item); err != nil {
+			return nil, err
+		}
+		return []RecordChange{{Type: TrashReference, ID: item.ID}}, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) DeleteReference(c *gin.Context) {
+	itemID := c.Param("id")
+
+	err := s.journaled(c, "delete reference item", func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, TrashReference, itemID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.DeleteReference(itemID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reference item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) GetTrash(c *gin.Context) {
+	items, err := s.store.ListTrash()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) RestoreTrash(c *gin.Context) {
+	recordType := c.Param("type")
+	recordID := c.Param("id")
+	if !validTrashType(recordType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown record type: " + recordType})
+		return
+	}
+
+	err := s.journaled(c, "restore "+recordType, func(tx Store) ([]RecordChange, error) {
+		changes, err := beforeChange(tx, recordType, recordID)
+		if err != nil {
+			return nil, err
+		}
+		return changes, tx.RestoreTrash(recordType, recordID)
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found in the trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
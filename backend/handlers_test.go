@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// step is a request made in a handler test, the status it should get and,
+// if want isn't empty, a string its response should contain.
+type step struct {
+	method string
+	path   string
+	body   any
+	status int
+	want   string
+}
+
+// runSteps makes the requests of steps in order against a server on a
+// fresh memory store, and returns the store.
+func runSteps(t *testing.T, steps []step) *MemoryStore {
+	t.Helper()
+	store := NewMemoryStore(nil)
+	srv := newTestServer(t, store, nil)
+	for i, s := range steps {
+		status, data := request(t, srv, s.method, s.path, "session", s.body)
+		if status != s.status {
+			t.Fatalf("step %d, %s %s: got %d %s, want %d", i, s.method, s.path, status, data, s.status)
+		}
+		if !strings.Contains(string(data), s.want) {
+			t.Fatalf("step %d, %s %s: got %s, want it to contain %s", i, s.method, s.path, data, s.want)
+		}
+	}
+	return store
+}
+
+// TestProjectHandlers creates, finishes, deletes and restores a project,
+// with the errors invalid requests get.
+func TestProjectHandlers(t *testing.T) {
+	runSteps(t, []step{
+		{http.MethodPost, "/api/projects", map[string]any{"id": "p", "name": "Paint the fence"}, http.StatusOK, `"status":"active"`},
+		{http.MethodPost, "/api/projects", map[string]any{"id": "q", "name": "Done", "status": "completed"}, http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/projects", "not an object", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/projects", nil, http.StatusOK, `"name":"Paint the fence"`},
+		{http.MethodPatch, "/api/projects/p", map[string]any{"status": "completed"}, http.StatusOK, `"completed_at":`},
+		{http.MethodPatch, "/api/projects/p", map[string]any{"status": "on_hold"}, http.StatusConflict, ""},
+		{http.MethodPatch, "/api/projects/missing", map[string]any{"deadline": "2030-01-01"}, http.StatusNotFound, ""},
+		{http.MethodDelete, "/api/projects/p?actions=burn", nil, http.StatusBadRequest, ""},
+		{http.MethodDelete, "/api/projects/p", nil, http.StatusOK, ""},
+		{http.MethodDelete, "/api/projects/p", nil, http.StatusNotFound, ""},
+		{http.MethodGet, "/api/trash", nil, http.StatusOK, `"id":"p"`},
+		{http.MethodPost, "/api/trash/project/p/restore", nil, http.StatusOK, ""},
+		{http.MethodGet, "/api/projects", nil, http.StatusOK, "[]"},
+		{http.MethodGet, "/api/projects?status=completed", nil, http.StatusOK, `"id":"p"`},
+		{http.MethodGet, "/api/projects?status=finished", nil, http.StatusBadRequest, ""},
+	})
+}
+
+// TestNextActionHandlers goes through the life of a next action up to
+// undoing its deletion.
+func TestNextActionHandlers(t *testing.T) {
+	store := runSteps(t, []step{
+		{http.MethodPost, "/api/next-actions", map[string]any{"id": "a", "action": "Call", "project_id": "missing"}, http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/projects", map[string]any{"id": "p", "name": "Plumbing"}, http.StatusOK, ""},
+		{http.MethodPost, "/api/next-actions", map[string]any{"id": "a", "action": "Call the plumber", "project_id": "p", "contexts": []string{"phone"}}, http.StatusOK, `"contexts":["@phone"]`},
+		{http.MethodGet, "/api/next-actions?context=phone", nil, http.StatusOK, `"id":"a"`},
+		{http.MethodGet, "/api/projects/p/next-actions", nil, http.StatusOK, `"id":"a"`},
+		{http.MethodPatch, "/api/next-actions/a", map[string]any{"energy": "low"}, http.StatusOK, `"energy":"low"`},
+		{http.MethodPatch, "/api/next-actions/a", map[string]any{"energy": 3}, http.StatusBadRequest, ""},
+		{http.MethodPatch, "/api/next-actions/missing", map[string]any{"energy": "low"}, http.StatusNotFound, ""},
+		{http.MethodGet, "/api/next-actions/a/history", nil, http.StatusOK, `"operation":"update next action"`},
+		{http.MethodDelete, "/api/next-actions/a", nil, http.StatusOK, ""},
+		{http.MethodGet, "/api/next-actions", nil, http.StatusOK, "[]"},
+		{http.MethodPost, "/api/undo", nil, http.StatusOK, ""},
+	})
+	if _, err := store.GetNextAction("a"); err != nil {
+		t.Errorf("undoing the deletion didn't bring the action back: %v", err)
+	}
+}
+
+// TestContextHandlers checks the errors of creating and deleting contexts.
+func TestContextHandlers(t *testing.T) {
+	runSteps(t, []step{
+		{http.MethodPost, "/api/contexts", map[string]any{"name": "phone"}, http.StatusOK, `"name":"@phone"`},
+		{http.MethodPost, "/api/contexts", map[string]any{"name": "@phone"}, http.StatusConflict, ""},
+		{http.MethodPost, "/api/contexts", map[string]any{}, http.StatusBadRequest, ""},
+		{http.MethodDelete, "/api/contexts/missing", nil, http.StatusNotFound, ""},
+	})
+}
+
+// TestInboxHandlers processes an inbox item into a next action, once.
+func TestInboxHandlers(t *testing.T) {
+	store := NewMemoryStore(nil)
+	srv := newTestServer(t, store, nil)
+	status, data := request(t, srv, http.MethodPost, "/api/inbox", "", map[string]any{"description": "Renew passport"})
+	if status != http.StatusOK {
+		t.Fatalf("create: %d %s", status, data)
+	}
+	var item InboxItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		t.Fatal(err)
+	}
+
+	process := map[string]any{"type": "next_action", "data": map[string]any{"id": "renew"}}
+	if status, data := request(t, srv, http.MethodPost, "/api/inbox/"+item.ID+"/process", "", process); status != http.StatusOK {
+		t.Fatalf("process: %d %s", status, data)
+	}
+	action, err := store.GetNextAction("renew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Action != "Renew passport" || action.InboxItemID != item.ID {
+		t.Errorf("action made from the item: got %+v", action)
+	}
+	if status, data := request(t, srv, http.MethodPost, "/api/inbox/"+item.ID+"/process", "", process); status != http.StatusConflict {
+		t.Errorf("processing twice: got %d %s, want %d", status, data, http.StatusConflict)
+	}
+	if status, data := request(t, srv, http.MethodPost, "/api/inbox/"+item.ID+"/process", "", map[string]any{"type": "poem"}); status != http.StatusBadRequest {
+		t.Errorf("processing into an unknown type: got %d %s, want %d", status, data, http.StatusBadRequest)
+	}
+	if status, data := request(t, srv, http.MethodGet, "/api/inbox", "", nil); status != http.StatusOK || string(data) != "[]" {
+		t.Errorf("inbox after processing: got %d %s, want it empty", status, data)
+	}
+}
+
+// TestFollowUpDue lists the waiting-for items due by today in the server's
+// time zone, which may be a different day than the machine's.
+func TestFollowUpDue(t *testing.T) {
+	for _, zone := range []string{"Etc/GMT-14", "Etc/GMT+12"} {
+		t.Run(zone, func(t *testing.T) {
+			location, err := time.LoadLocation(zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := NewMemoryStore(nil)
+			server := NewServer(store, NewClientManager(store, &OriginPolicy{}))
+			server.location = location
+			r := gin.New()
+			server.RegisterRoutes(r.Group("/api"))
+			srv := httptest.NewServer(r)
+			t.Cleanup(srv.Close)
+
+			today := time.Now().In(location)
+			for id, day := range map[string]time.Time{"today": today, "tomorrow": today.AddDate(0, 0, 1)} {
+				item := WaitingFor{ID: id, What: "Quote", DelegatedTo: "Roofer", FollowUpAt: day.Format(time.DateOnly)}
+				if err := store.CreateWaitingFor(&item); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			status, data := request(t, srv, http.MethodGet, "/api/waiting-for?follow_up_due=true", "", nil)
+			if status != http.StatusOK {
+				t.Fatalf("list: %d %s", status, data)
+			}
+			var items []WaitingFor
+			if err := json.Unmarshal(data, &items); err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0].ID != "today" {
+				t.Errorf("got %s, want only the item due today", data)
+			}
+		})
+	}
+}
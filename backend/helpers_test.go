@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testStores are the kinds of store tests run against. Postgres needs a
+// server given by GSD_TEST_POSTGRES_DSN and is skipped without one.
+var testStores = []struct {
+	name string
+	new  func(t *testing.T, events *EventBus) Store
+}{
+	{"memory", func(t *testing.T, events *EventBus) Store { return NewMemoryStore(events) }},
+	{"sqlite", func(t *testing.T, events *EventBus) Store { return newSQLiteStore(t, events) }},
+	{"postgres", func(t *testing.T, events *EventBus) Store { return newPostgresStore(t, events) }},
+}
+
+// newSQLiteStore returns a store on a fresh SQLite database file.
+func newSQLiteStore(t *testing.T, events *EventBus) *SQLStore {
+	t.Helper()
+	db := InitDB(SQLite, filepath.Join(t.TempDir(), "gsd.db"), false)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLStore(db, SQLite, events)
+}
+
+// newPostgresStore returns a store on a fresh schema of the database given
+// by GSD_TEST_POSTGRES_DSN, which is dropped after the test.
+func newPostgresStore(t *testing.T, events *EventBus) *SQLStore {
+	t.Helper()
+	dsn := os.Getenv("GSD_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("GSD_TEST_POSTGRES_DSN is not set")
+	}
+	admin, err := sql.Open(Postgres.Driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "gsd_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+
+	// Unknown connection parameters are set on the session
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db := InitDB(Postgres, dsn, false)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLStore(db, Postgres, events)
+}
+
+// newTestServer serves the API of a store, without logins. Websocket and
+// SSE clients get the events published on events, if it isn't nil.
+func newTestServer(t *testing.T, store Store, events *EventBus) *httptest.Server {
+	t.Helper()
+	manager := NewClientManager(store, &OriginPolicy{})
+	go manager.Run()
+	if events != nil {
+		events.Subscribe(manager.BroadcastEvent)
+	}
+
+	r := gin.New()
+	NewServer(store, manager).RegisterRoutes(r.Group("/api"))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// request sends a request with a JSON body, unless body is nil, from the
+// client session sessionID, and returns the response status and body.
+func request(t *testing.T, srv *httptest.Server, method, path, sessionID string, body any) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sessionID != "" {
+		req.Header.Set(sessionHeader, sessionID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
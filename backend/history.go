@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes of the history endpoints
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// HistoryContext is the record type of contexts in the history, which
+// otherwise uses the trash record types.
+const HistoryContext = "context"
+
+// diffFields lists the fields that differ between two snapshots of a
+// record. Either snapshot may be nil, for records that were just created or
+// deleted.
+func diffFields(before, after json.RawMessage) ([]FieldChange, error) {
+	var from, to map[string]any
+	if before != nil {
+		if err := json.Unmarshal(before, &from); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &to); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := []string{}
+	for field := range from {
+		fields = append(fields, field)
+	}
+	for field := range to {
+		if _, ok := from[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if field == "id" || reflect.DeepEqual(from[field], to[field]) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: field, From: from[field], To: to[field]})
+	}
+	return changes, nil
+}
+
+// recordHistory takes the state of records after a request changed them and
+// adds the changed fields to their history, through the store that changed
+// them. It reports whether any record actually changed.
+func recordHistory(store Store, c *gin.Context, name string, changes []RecordChange) (bool, error) {
+	entries := []HistoryEntry{}
+	for i, change := range changes {
+		after, err := snapshot(store, change.Type, change.ID)
+		if err != nil {
+			return false, fmt.Errorf("recording history of %s: %w", name, err)
+		}
+		changes[i].After = after
+
+		fields, err := diffFields(change.Before, after)
+		if err != nil {
+			return false, fmt.Errorf("recording history of %s: %w", name, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		entries = append(entries, HistoryEntry{
+			RecordType: change.Type,
+			RecordID:   change.ID,
+			Operation:  name,
+			SessionID:  c.GetHeader(sessionHeader),
+			UserID:     c.GetString(userIDKey),
+			Changes:    fields,
+		})
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+
+	if err := store.AppendHistory(entries); err != nil {
+		return false, fmt.Errorf("recording history of %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// listHistory serves a page of history entries, latest first. A page that
+// isn't the last one comes with a next_cursor to pass as the cursor query
+// parameter for the following page.
+func (s *Server) listHistory(c *gin.Context, filter HistoryFilter) {
+	limit := defaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be a number from 1 to %d", maxHistoryLimit)})
+			return
+		}
+		limit = n
+	}
+	if value := c.Query("cursor"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		filter.Before = n
+	}
+
+	// One extra entry tells whether there is another page
+	filter.Limit = limit + 1
+	entries, err := s.store.ListHistory(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	page := gin.H{"entries": entries, "next_cursor": nil}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		page["entries"] = entries
+		page["next_cursor"] = strconv.FormatInt(entries[limit-1].ID, 10)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func (s *Server) GetProjectHistory(c *gin.Context) {
+	s.listHistory(c, HistoryFilter{RecordType: TrashProject, RecordID: c.Param("id")})
+}
+
+func (s *Server) GetNextActionHistory(c *gin.Context) {
+	s.listHistory(c, HistoryFilter{RecordType: TrashNextAction, RecordID: c.Param("id")})
+}
+
+// GetActivity is the feed of changes to every record.
+func (s *Server) GetActivity(c *gin.Context) {
+	s.listHistory(c, HistoryFilter{})
+}
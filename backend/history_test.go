@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestContextHistory records renaming and deleting a context in the history
+// of the context and of the actions that have it, with who did it.
+func TestContextHistory(t *testing.T) {
+	store := NewMemoryStore(nil)
+	manager := NewClientManager(store, &OriginPolicy{})
+	go manager.Run()
+	r := gin.New()
+	NewServer(store, manager).RegisterRoutes(r.Group("/api", func(c *gin.Context) { c.Set(userIDKey, "user-1") }))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	context := Context{Name: "@phone"}
+	if err := store.CreateContext(&context); err != nil {
+		t.Fatal(err)
+	}
+	action := NextAction{Action: "Call the plumber", Contexts: []string{"@phone"}}
+	if err := store.CreateNextAction(&action); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, data := request(t, srv, http.MethodPatch, "/api/contexts/"+context.ID, "", map[string]any{"name": "@call"}); status != http.StatusOK {
+		t.Fatalf("rename: %d %s", status, data)
+	}
+	if status, data := request(t, srv, http.MethodDelete, "/api/contexts/"+context.ID, "", nil); status != http.StatusOK {
+		t.Fatalf("delete: %d %s", status, data)
+	}
+
+	entries, err := store.ListHistory(HistoryFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type key struct{ operation, recordType string }
+	got := map[key]bool{}
+	for _, entry := range entries {
+		got[key{entry.Operation, entry.RecordType}] = true
+		if entry.UserID != "user-1" {
+			t.Errorf("%s of %s %s: got user %q, want user-1", entry.Operation, entry.RecordType, entry.RecordID, entry.UserID)
+		}
+	}
+	for _, want := range []key{
+		{"rename context", HistoryContext},
+		{"rename context", TrashNextAction},
+		{"delete context", HistoryContext},
+		{"delete context", TrashNextAction},
+	} {
+		if !got[want] {
+			t.Errorf("no history entry for %s of a %s in %+v", want.operation, want.recordType, entries)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "log"
+
+// foreignKeys lists the references between tables. Optional references are
+// cleared when they dangle; rows that exist only to link two records are
+// removed instead.
+var foreignKeys = []struct {
+	Table, Column, Parent string
+	Required              bool
+}{
+	{"next_actions", "project_id", "projects", false},
+	{"waiting_for", "project_id", "projects", false},
+	{"projects", "inbox_item_id", "inbox", false},
+	{"next_actions", "inbox_item_id", "inbox", false},
+	{"waiting_for", "inbox_item_id", "inbox", false},
+	{"someday", "inbox_item_id", "inbox", false},
+	{"reference_items", "inbox_item_id", "inbox", false},
+	{"next_action_contexts", "next_action_id", "next_actions", true},
+	{"next_action_contexts", "context_id", "contexts", true},
+}
+
+// CheckOrphans looks for records that refer to records which no longer
+// exist, as left behind by versions of gsd that didn't enforce foreign keys,
+// and logs what it finds. With repair set the dangling references are
+// removed.
+func (s *SQLStore) CheckOrphans(repair bool) error {
+	found := 0
+	for _, fk := range foreignKeys {
+		where := " WHERE " + fk.Column + " IS NOT NULL AND " + fk.Column + " NOT IN (SELECT id FROM " + fk.Parent + ")"
+
+		var count int
+		if err := s.queryRow("SELECT COUNT(*) FROM " + fk.Table + where).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+		found += count
+		if !repair {
+			log.Printf("Integrity check: %d %s rows refer to missing %s through %s", count, fk.Table, fk.Parent, fk.Column)
+			continue
+		}
+
+		query := "UPDATE " + fk.Table + " SET " + fk.Column + " = NULL" + where
+		if fk.Required {
+			query = "DELETE FROM " + fk.Table + where
+		}
+		if _, err := s.exec(query); err != nil {
+			return err
+		}
+		log.Printf("Integrity check: repaired %d %s rows that referred to missing %s through %s", count, fk.Table, fk.Parent, fk.Column)
+	}
+
+	if found > 0 && !repair {
+		log.Printf("Integrity check: run with --repair-orphans to clear the %d dangling references", found)
+	}
+	return nil
+}
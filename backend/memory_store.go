@@ -0,0 +1,1590 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store that keeps everything in memory. It is meant for
+// tests and for embedding gsd where persistence isn't needed.
+type MemoryStore struct {
+	mutex sync.Mutex
+	memoryState
+	events *EventBus
+	inTx   bool // the store is a transaction of Atomically, whose events wait for it to commit
+
+	// publishing is held from the end of a change until its events are
+	// published, so the events of the next one come after them
+	publishing sync.Mutex
+}
+
+// memoryState is the data of a MemoryStore.
+type memoryState struct {
+	projects    map[string]Project
+	nextActions map[string]NextAction
+	contexts    map[string]Context
+	links       map[string]map[string]bool // next action ID -> context IDs
+	waitingFor  map[string]WaitingFor
+	someday     map[string]SomedayItem
+	inbox       map[string]InboxItem
+	reference   map[string]ReferenceItem
+	trashed     map[string]string // trash type and record ID -> deleted_at, for records in the trash
+	operations  []Operation       // oldest first
+	lastOpID    int64
+	history     []HistoryEntry      // oldest first
+	revisions   map[string]int64    // entity and ID -> revision
+	scopes      map[string][]string // entity and ID -> scopes after its latest event
+	eventLog    []Event             // oldest first, the latest maxEvents
+	lastSeq     int64
+	pending     []Event // events of the change being made, published on unlock
+	users       map[string]User
+	sessions    map[string]LoginSession // by token hash
+}
+
+func NewMemoryStore(events *EventBus) *MemoryStore {
+	return &MemoryStore{
+		memoryState: memoryState{
+			projects:    make(map[string]Project),
+			nextActions: make(map[string]NextAction),
+			contexts:    make(map[string]Context),
+			links:       make(map[string]map[string]bool),
+			waitingFor:  make(map[string]WaitingFor),
+			someday:     make(map[string]SomedayItem),
+			inbox:       make(map[string]InboxItem),
+			reference:   make(map[string]ReferenceItem),
+			trashed:     make(map[string]string),
+			revisions:   make(map[string]int64),
+			scopes:      make(map[string][]string),
+			users:       make(map[string]User),
+			sessions:    make(map[string]LoginSession),
+		},
+		events: events,
+	}
+}
+
+// clone copies the state, so changes to the copy leave it alone.
+func (m memoryState) clone() memoryState {
+	m.projects = maps.Clone(m.projects)
+	m.nextActions = maps.Clone(m.nextActions)
+	m.contexts = maps.Clone(m.contexts)
+	links := make(map[string]map[string]bool, len(m.links))
+	for actionID, contextIDs := range m.links {
+		links[actionID] = maps.Clone(contextIDs)
+	}
+	m.links = links
+	m.waitingFor = maps.Clone(m.waitingFor)
+	m.someday = maps.Clone(m.someday)
+	m.inbox = maps.Clone(m.inbox)
+	m.reference = maps.Clone(m.reference)
+	m.trashed = maps.Clone(m.trashed)
+	m.operations = slices.Clone(m.operations)
+	m.history = slices.Clone(m.history)
+	m.revisions = maps.Clone(m.revisions)
+	m.scopes = maps.Clone(m.scopes)
+	m.eventLog = slices.Clone(m.eventLog)
+	m.pending = slices.Clone(m.pending)
+	m.users = maps.Clone(m.users)
+	m.sessions = maps.Clone(m.sessions)
+	return m
+}
+
+// Atomically runs fn on a copy of the state, which replaces the state if fn
+// succeeds. Other changes wait until it is done.
+func (s *MemoryStore) Atomically(fn func(tx Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	s.mutex.Lock()
+	defer s.unlock()
+
+	tx := &MemoryStore{memoryState: s.memoryState.clone(), inTx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.memoryState = tx.memoryState
+	return nil
+}
+
+// unlock releases the mutex and publishes the events of the changes made
+// while holding it.
+func (s *MemoryStore) unlock() {
+	if s.inTx {
+		s.mutex.Unlock()
+		return
+	}
+	events := s.pending
+	s.pending = nil
+	if len(events) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+	s.mutex.Unlock()
+	s.events.Publish(events)
+}
+
+// emit records the event of a change, bumping the revision of the entity.
+// It comes after the change, so the event carries the entity as it is now.
+func (s *MemoryStore) emit(entity string, change string, id string) {
+	var data any
+	switch entity {
+	case EntityProject:
+		data = s.projects[id]
+	case EntityNextAction:
+		data = s.withContexts(s.nextActions[id])
+	case EntityContext:
+		data = s.contexts[id]
+	case EntityWaitingFor:
+		data = s.waitingFor[id]
+	case EntitySomeday:
+		data = s.someday[id]
+	case EntityReference:
+		data = s.reference[id]
+	case EntityInbox:
+		data = s.inbox[id]
+	}
+	key := entity + "/" + id
+	s.revisions[key]++
+	event := newEvent(entity, change, id, s.revisions[key], data)
+	after := entityScopes(event.Data)
+	event.Scopes = eventScopes(s.scopes[key], after)
+	s.scopes[key] = after
+	s.lastSeq++
+	event.Sequence = s.lastSeq
+
+	s.eventLog = append(s.eventLog, event)
+	if len(s.eventLog) > maxEvents {
+		s.eventLog = slices.Clone(s.eventLog[len(s.eventLog)-maxEvents:])
+	}
+	s.pending = append(s.pending, event)
+}
+
+// emitMoved records the events of a move planned by planMove: the moved
+// record, or every record that isn't in the trash if the list was
+// renumbered.
+func (s *MemoryStore) emitMoved(entity string, id string, moved map[string]float64) {
+	if len(moved) == 1 {
+		s.emit(entity, EventUpdated, id)
+		return
+	}
+	ids := []string{}
+	for recordID := range moved {
+		if !s.inTrash(entity, recordID) {
+			ids = append(ids, recordID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return moved[ids[i]] < moved[ids[j]]
+	})
+	for _, recordID := range ids {
+		s.emit(entity, EventUpdated, recordID)
+	}
+}
+
+func (s *MemoryStore) ListProjects(filter ProjectFilter) ([]Project, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	projects := []Project{}
+	for _, project := range s.projects {
+		if s.inTrash(TrashProject, project.ID) {
+			continue
+		}
+		if len(filter.Statuses) > 0 && !containsString(filter.Statuses, project.Status) {
+			continue
+		}
+		projects = append(projects, project)
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Position < projects[j].Position
+	})
+	return projects, nil
+}
+
+func (s *MemoryStore) GetProject(id string) (Project, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	project, ok := s.projects[id]
+	if !ok || s.inTrash(TrashProject, id) {
+		return Project{}, ErrNotFound
+	}
+	return project, nil
+}
+
+func (s *MemoryStore) insertProject(project *Project) {
+	if project.ID == "" {
+		project.ID = uuid.New().String()
+	}
+	project.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if project.Status == "" {
+		project.Status = ProjectActive
+	}
+	project.CompletedAt = ""
+	if project.Status == ProjectCompleted {
+		project.CompletedAt = project.CreatedAt
+	}
+
+	project.Position = 1.0
+	for _, other := range s.projects {
+		if other.Position >= project.Position {
+			project.Position = other.Position + 1.0
+		}
+	}
+
+	s.projects[project.ID] = *project
+	s.emit(EntityProject, EventCreated, project.ID)
+}
+
+func (s *MemoryStore) CreateProject(project *Project) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.insertProject(project)
+	return nil
+}
+
+func (s *MemoryStore) UpdateProject(id string, update ProjectUpdate) (Project, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	project, ok := s.projects[id]
+	if !ok || s.inTrash(TrashProject, id) {
+		return Project{}, ErrNotFound
+	}
+	changed := update.Position != nil || update.Deadline != nil
+	if update.Status != nil && *update.Status != project.Status {
+		if !canTransitionProject(project.Status, *update.Status) {
+			return Project{}, ErrInvalidTransition
+		}
+		changed = true
+		project.Status = *update.Status
+		project.CompletedAt = ""
+		if project.Status == ProjectCompleted {
+			project.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	if update.Position != nil {
+		for otherID, other := range s.projects {
+			if otherID != id && other.Position == *update.Position {
+				return Project{}, fmt.Errorf("%w: position %v is taken", ErrConflict, *update.Position)
+			}
+		}
+		project.Position = *update.Position
+	}
+	if update.Deadline != nil {
+		project.Deadline = *update.Deadline
+	}
+	s.projects[id] = project
+	if changed {
+		s.emit(EntityProject, EventUpdated, id)
+	}
+	return project, nil
+}
+
+func (s *MemoryStore) MoveProject(id string, move Move) (Project, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	positions := map[string]float64{}
+	for projectID, project := range s.projects {
+		positions[projectID] = project.Position
+	}
+	moved, err := s.planMove(TrashProject, positions, id, move)
+	if err != nil {
+		return Project{}, err
+	}
+	for projectID, position := range moved {
+		project := s.projects[projectID]
+		project.Position = position
+		s.projects[projectID] = project
+	}
+	s.emitMoved(EntityProject, id, moved)
+	return s.projects[id], nil
+}
+
+// planMove works out the positions that change when a record of the given
+// trash type moves as move says, given the positions of every record in its
+// list.
+func (s *MemoryStore) planMove(recordType string, positions map[string]float64, id string, move Move) (map[string]float64, error) {
+	list := []positioned{}
+	for recordID, position := range positions {
+		list = append(list, positioned{ID: recordID, Position: position, Trashed: s.inTrash(recordType, recordID)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Position < list[j].Position
+	})
+
+	position, rebalanced, err := planMove(list, id, move)
+	if err != nil {
+		return nil, err
+	}
+	moved := map[string]float64{id: position}
+	for _, record := range rebalanced {
+		moved[record.ID] = record.Position
+	}
+	return moved, nil
+}
+
+// checkProjectRef returns ErrInvalidReference unless id names a project
+// that isn't in the trash.
+func (s *MemoryStore) checkProjectRef(id string) error {
+	if _, ok := s.projects[id]; !ok || s.inTrash(TrashProject, id) {
+		return fmt.Errorf("%w: project %s does not exist", ErrInvalidReference, id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteProject(id string, deletion ProjectDeletion) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.projects[id]; !ok || s.inTrash(TrashProject, id) {
+		return ErrNotFound
+	}
+	switch deletion.Actions {
+	case ProjectActionsOrphan, ProjectActionsDelete:
+	case ProjectActionsMove:
+		if deletion.MoveTo == id {
+			return fmt.Errorf("%w: project %s does not exist", ErrInvalidReference, id)
+		}
+		if err := s.checkProjectRef(deletion.MoveTo); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown project deletion policy %q", deletion.Actions)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	s.trashed[trashKey(TrashProject, id)] = now
+	// handOver applies the policy to a record of the project, returning its
+	// new project ID
+	handOver := func(recordType string, recordID string) string {
+		switch deletion.Actions {
+		case ProjectActionsDelete:
+			s.trashed[trashKey(recordType, recordID)] = now
+			return id
+		case ProjectActionsMove:
+			return deletion.MoveTo
+		}
+		return ""
+	}
+	// Handed over actions keep their order at the end of the list of the
+	// project receiving them
+	actions := []NextAction{}
+	for actionID, action := range s.nextActions {
+		if action.ProjectID == id && !s.inTrash(TrashNextAction, actionID) {
+			actions = append(actions, action)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return *actions[i].ProjectPosition < *actions[j].ProjectPosition
+	})
+	for _, action := range actions {
+		if action.ProjectID = handOver(TrashNextAction, action.ID); action.ProjectID != id {
+			action.ProjectPosition = nil
+			if action.ProjectID != "" {
+				action.ProjectPosition = s.nextProjectPosition(action.ProjectID)
+			}
+		}
+		s.nextActions[action.ID] = action
+	}
+	waitingFor := []string{}
+	for itemID, item := range s.waitingFor {
+		if item.ProjectID == id && !s.inTrash(TrashWaitingFor, itemID) {
+			item.ProjectID = handOver(TrashWaitingFor, itemID)
+			s.waitingFor[itemID] = item
+			waitingFor = append(waitingFor, itemID)
+		}
+	}
+	sort.Strings(waitingFor)
+
+	change := EventUpdated
+	if deletion.Actions == ProjectActionsDelete {
+		change = EventDeleted
+	}
+	for _, action := range actions {
+		s.emit(EntityNextAction, change, action.ID)
+	}
+	for _, itemID := range waitingFor {
+		s.emit(EntityWaitingFor, change, itemID)
+	}
+	s.emit(EntityProject, EventDeleted, id)
+	return nil
+}
+
+func (s *MemoryStore) ListNextActions(filter NextActionFilter) ([]NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	actions := []NextAction{}
+	for _, action := range s.nextActions {
+		if s.inTrash(TrashNextAction, action.ID) {
+			continue
+		}
+		action = s.withContexts(action)
+		if filter.Context != "" && !containsString(action.Contexts, filter.Context) {
+			continue
+		}
+		if !filter.IncludeDeferred && action.DeferUntil > now {
+			continue
+		}
+		if filter.ProjectID != "" && action.ProjectID != filter.ProjectID {
+			continue
+		}
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		if filter.ProjectID != "" {
+			return *actions[i].ProjectPosition < *actions[j].ProjectPosition
+		}
+		return actions[i].Position < actions[j].Position
+	})
+	return actions, nil
+}
+
+// nextProjectPosition returns the position after the last action of a
+// project.
+func (s *MemoryStore) nextProjectPosition(projectID string) *float64 {
+	var last *float64
+	for _, action := range s.nextActions {
+		if action.ProjectID == projectID && action.ProjectPosition != nil && (last == nil || *action.ProjectPosition > *last) {
+			last = action.ProjectPosition
+		}
+	}
+	position := 1.0
+	if last != nil {
+		position = *last + 1.0
+	}
+	return &position
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withContexts returns action with its context names filled in.
+func (s *MemoryStore) withContexts(action NextAction) NextAction {
+	action.Contexts = []string{}
+	for contextID := range s.links[action.ID] {
+		action.Contexts = append(action.Contexts, s.contexts[contextID].Name)
+	}
+	sort.Strings(action.Contexts)
+	return action
+}
+
+// setContexts replaces the contexts of an action, creating contexts that
+// don't exist yet.
+func (s *MemoryStore) setContexts(actionID string, names []string) {
+	byName := make(map[string]string)
+	for _, context := range s.contexts {
+		byName[context.Name] = context.ID
+	}
+
+	links := make(map[string]bool)
+	for _, name := range normalizeContextNames(names) {
+		contextID, ok := byName[name]
+		if !ok {
+			contextID = uuid.New().String()
+			s.contexts[contextID] = Context{ID: contextID, Name: name, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+			s.emit(EntityContext, EventCreated, contextID)
+		}
+		links[contextID] = true
+	}
+	s.links[actionID] = links
+}
+
+func (s *MemoryStore) GetNextAction(id string) (NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	action, ok := s.nextActions[id]
+	if !ok || s.inTrash(TrashNextAction, id) {
+		return NextAction{}, ErrNotFound
+	}
+	return s.withContexts(action), nil
+}
+
+func (s *MemoryStore) CreateNextAction(action *NextAction) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if action.ProjectID != "" {
+		if err := s.checkProjectRef(action.ProjectID); err != nil {
+			return err
+		}
+	}
+	s.insertNextAction(action)
+	return nil
+}
+
+// insertNextAction adds action at the end of the list.
+func (s *MemoryStore) insertNextAction(action *NextAction) {
+	if action.ID == "" {
+		action.ID = uuid.New().String()
+	}
+	action.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	action.CompletedAt = ""
+
+	action.Position = 1.0
+	for _, other := range s.nextActions {
+		if other.Position >= action.Position {
+			action.Position = other.Position + 1.0
+		}
+	}
+	action.ProjectPosition = nil
+	if action.ProjectID != "" {
+		action.ProjectPosition = s.nextProjectPosition(action.ProjectID)
+	}
+
+	s.nextActions[action.ID] = *action
+	s.setContexts(action.ID, action.Contexts)
+	*action = s.withContexts(*action)
+	s.emit(EntityNextAction, EventCreated, action.ID)
+}
+
+func (s *MemoryStore) UpdateNextAction(id string, update NextActionUpdate) (NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	action, ok := s.nextActions[id]
+	if !ok || s.inTrash(TrashNextAction, id) {
+		return NextAction{}, ErrNotFound
+	}
+	if update.ProjectID != nil && *update.ProjectID != "" {
+		if err := s.checkProjectRef(*update.ProjectID); err != nil {
+			return NextAction{}, err
+		}
+	}
+	projectID := action.ProjectID
+	if update.Action != nil {
+		action.Action = *update.Action
+	}
+	if update.ProjectID != nil {
+		action.ProjectID = *update.ProjectID
+	}
+	if update.URL != nil {
+		action.URL = *update.URL
+	}
+	if update.Size != nil {
+		action.Size = *update.Size
+	}
+	if update.Energy != nil {
+		action.Energy = *update.Energy
+	}
+	if update.CompletedAt != nil {
+		action.CompletedAt = *update.CompletedAt
+	}
+	if update.Position != nil {
+		for otherID, other := range s.nextActions {
+			if otherID != id && other.Position == *update.Position {
+				return NextAction{}, fmt.Errorf("%w: position %v is taken", ErrConflict, *update.Position)
+			}
+		}
+		action.Position = *update.Position
+	}
+	if update.DeferUntil != nil {
+		action.DeferUntil = *update.DeferUntil
+	}
+	if update.Recurrence != nil {
+		action.Recurrence = *update.Recurrence
+	}
+	if update.RecurrenceStart != nil {
+		action.RecurrenceStart = *update.RecurrenceStart
+	}
+	if update.OccursAt != nil {
+		action.OccursAt = *update.OccursAt
+	}
+	if action.ProjectID != projectID {
+		action.ProjectPosition = nil
+		if action.ProjectID != "" {
+			action.ProjectPosition = s.nextProjectPosition(action.ProjectID)
+		}
+	}
+	if update.ProjectPosition != nil && action.ProjectID != "" {
+		for otherID, other := range s.nextActions {
+			if otherID != id && other.ProjectID == action.ProjectID && other.ProjectPosition != nil && *other.ProjectPosition == *update.ProjectPosition {
+				return NextAction{}, fmt.Errorf("%w: position %v is taken", ErrConflict, *update.ProjectPosition)
+			}
+		}
+		position := *update.ProjectPosition
+		action.ProjectPosition = &position
+	}
+	if update.Contexts != nil {
+		s.setContexts(id, *update.Contexts)
+	}
+	action = s.withContexts(action)
+
+	s.nextActions[id] = action
+	s.emit(EntityNextAction, EventUpdated, id)
+	return action, nil
+}
+
+func (s *MemoryStore) MoveNextAction(id string, move Move) (NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	positions := map[string]float64{}
+	for actionID, action := range s.nextActions {
+		positions[actionID] = action.Position
+	}
+	moved, err := s.planMove(TrashNextAction, positions, id, move)
+	if err != nil {
+		return NextAction{}, err
+	}
+	for actionID, position := range moved {
+		action := s.nextActions[actionID]
+		action.Position = position
+		s.nextActions[actionID] = action
+	}
+	s.emitMoved(EntityNextAction, id, moved)
+	return s.withContexts(s.nextActions[id]), nil
+}
+
+func (s *MemoryStore) MoveProjectNextAction(projectID string, id string, move Move) (NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	positions := map[string]float64{}
+	for actionID, action := range s.nextActions {
+		if action.ProjectID == projectID && action.ProjectPosition != nil {
+			positions[actionID] = *action.ProjectPosition
+		}
+	}
+	moved, err := s.planMove(TrashNextAction, positions, id, move)
+	if err != nil {
+		return NextAction{}, err
+	}
+	for actionID, position := range moved {
+		action := s.nextActions[actionID]
+		action.ProjectPosition = &position
+		s.nextActions[actionID] = action
+	}
+	s.emitMoved(EntityNextAction, id, moved)
+	return s.withContexts(s.nextActions[id]), nil
+}
+
+func (s *MemoryStore) DeleteNextAction(id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.nextActions[id]; !ok || s.inTrash(TrashNextAction, id) {
+		return ErrNotFound
+	}
+	s.trashed[trashKey(TrashNextAction, id)] = time.Now().UTC().Format(time.RFC3339)
+	s.emit(EntityNextAction, EventDeleted, id)
+	return nil
+}
+
+func (s *MemoryStore) ListContexts() ([]Context, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	contexts := []Context{}
+	for _, context := range s.contexts {
+		contexts = append(contexts, context)
+	}
+	sort.Slice(contexts, func(i, j int) bool {
+		return contexts[i].Name < contexts[j].Name
+	})
+	return contexts, nil
+}
+
+// contextNameTaken reports whether a context other than exceptID already
+// uses name.
+func (s *MemoryStore) contextNameTaken(name string, exceptID string) bool {
+	for _, context := range s.contexts {
+		if context.Name == name && context.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) CreateContext(context *Context) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if context.ID == "" {
+		context.ID = uuid.New().String()
+	}
+	context.Name = normalizeContextName(context.Name)
+	context.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if s.contextNameTaken(context.Name, context.ID) {
+		return ErrConflict
+	}
+	s.contexts[context.ID] = *context
+	s.emit(EntityContext, EventCreated, context.ID)
+	return nil
+}
+
+func (s *MemoryStore) RenameContext(id string, name string) (Context, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	context, ok := s.contexts[id]
+	if !ok {
+		return Context{}, ErrNotFound
+	}
+	name = normalizeContextName(name)
+	if s.contextNameTaken(name, id) {
+		return Context{}, ErrConflict
+	}
+	context.Name = name
+	s.contexts[id] = context
+
+	// The actions with the context show its new name
+	s.emit(EntityContext, EventUpdated, id)
+	for _, actionID := range s.contextActionIDs(id) {
+		s.emit(EntityNextAction, EventUpdated, actionID)
+	}
+	return context, nil
+}
+
+func (s *MemoryStore) DeleteContext(id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.contexts[id]; !ok {
+		return ErrNotFound
+	}
+	actionIDs := s.contextActionIDs(id)
+	delete(s.contexts, id)
+	for _, links := range s.links {
+		delete(links, id)
+	}
+	s.emit(EntityContext, EventDeleted, id)
+	for _, actionID := range actionIDs {
+		s.emit(EntityNextAction, EventUpdated, actionID)
+	}
+	return nil
+}
+
+// contextActionIDs lists the next actions with a context, leaving out the
+// ones in the trash.
+func (s *MemoryStore) contextActionIDs(contextID string) []string {
+	actions := []NextAction{}
+	for actionID, links := range s.links {
+		if links[contextID] && !s.inTrash(TrashNextAction, actionID) {
+			actions = append(actions, s.nextActions[actionID])
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Position < actions[j].Position
+	})
+	ids := []string{}
+	for _, action := range actions {
+		ids = append(ids, action.ID)
+	}
+	return ids
+}
+
+func (s *MemoryStore) ListWaitingFor(filter WaitingForFilter) ([]WaitingFor, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	items := []WaitingFor{}
+	for _, item := range s.waitingFor {
+		if s.inTrash(TrashWaitingFor, item.ID) {
+			continue
+		}
+		if !filter.IncludeResolved && item.ResolvedAt != "" {
+			continue
+		}
+		if filter.FollowUpDue != "" && (item.FollowUpAt == "" || item.FollowUpAt > filter.FollowUpDue) {
+			continue
+		}
+		items = append(items, item)
+	}
+	// Items without a follow-up date go last
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if (a.FollowUpAt == "") != (b.FollowUpAt == "") {
+			return b.FollowUpAt == ""
+		}
+		if a.FollowUpAt != b.FollowUpAt {
+			return a.FollowUpAt < b.FollowUpAt
+		}
+		return a.CreatedAt < b.CreatedAt
+	})
+	return items, nil
+}
+
+func (s *MemoryStore) insertWaitingFor(item *WaitingFor) {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	now := time.Now().UTC()
+	item.CreatedAt = now.Format(time.RFC3339)
+	if item.DelegatedAt == "" {
+		item.DelegatedAt = now.Format(time.DateOnly)
+	}
+	item.ResolvedAt = ""
+
+	s.waitingFor[item.ID] = *item
+	s.emit(EntityWaitingFor, EventCreated, item.ID)
+}
+
+func (s *MemoryStore) GetWaitingFor(id string) (WaitingFor, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.waitingFor[id]
+	if !ok || s.inTrash(TrashWaitingFor, id) {
+		return WaitingFor{}, ErrNotFound
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) CreateWaitingFor(item *WaitingFor) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if item.ProjectID != "" {
+		if err := s.checkProjectRef(item.ProjectID); err != nil {
+			return err
+		}
+	}
+	s.insertWaitingFor(item)
+	return nil
+}
+
+func (s *MemoryStore) UpdateWaitingFor(id string, update WaitingForUpdate) (WaitingFor, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.waitingFor[id]
+	if !ok || s.inTrash(TrashWaitingFor, id) {
+		return WaitingFor{}, ErrNotFound
+	}
+	if update.What != nil {
+		item.What = *update.What
+	}
+	if update.DelegatedTo != nil {
+		item.DelegatedTo = *update.DelegatedTo
+	}
+	if update.DelegatedAt != nil {
+		item.DelegatedAt = *update.DelegatedAt
+	}
+	if update.FollowUpAt != nil {
+		item.FollowUpAt = *update.FollowUpAt
+	}
+	if update.ProjectID != nil {
+		if *update.ProjectID != "" {
+			if err := s.checkProjectRef(*update.ProjectID); err != nil {
+				return WaitingFor{}, err
+			}
+		}
+		item.ProjectID = *update.ProjectID
+	}
+	if update.ResolvedAt != nil {
+		item.ResolvedAt = *update.ResolvedAt
+	}
+	s.waitingFor[id] = item
+	if update != (WaitingForUpdate{}) {
+		s.emit(EntityWaitingFor, EventUpdated, id)
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) DeleteWaitingFor(id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.waitingFor[id]; !ok || s.inTrash(TrashWaitingFor, id) {
+		return ErrNotFound
+	}
+	s.trashed[trashKey(TrashWaitingFor, id)] = time.Now().UTC().Format(time.RFC3339)
+	s.emit(EntityWaitingFor, EventDeleted, id)
+	return nil
+}
+
+func (s *MemoryStore) ListSomeday() ([]SomedayItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	items := []SomedayItem{}
+	for _, item := range s.someday {
+		if !s.inTrash(TrashSomeday, item.ID) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt < items[j].CreatedAt
+	})
+	return items, nil
+}
+
+func (s *MemoryStore) insertSomeday(item *SomedayItem) {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	s.someday[item.ID] = *item
+	s.emit(EntitySomeday, EventCreated, item.ID)
+}
+
+func (s *MemoryStore) GetSomeday(id string) (SomedayItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.someday[id]
+	if !ok || s.inTrash(TrashSomeday, id) {
+		return SomedayItem{}, ErrNotFound
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) CreateSomeday(item *SomedayItem) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.insertSomeday(item)
+	return nil
+}
+
+func (s *MemoryStore) UpdateSomeday(id string, update SomedayUpdate) (SomedayItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.someday[id]
+	if !ok || s.inTrash(TrashSomeday, id) {
+		return SomedayItem{}, ErrNotFound
+	}
+	if update.Title != nil {
+		item.Title = *update.Title
+	}
+	if update.Notes != nil {
+		item.Notes = *update.Notes
+	}
+	if update.URL != nil {
+		item.URL = *update.URL
+	}
+	s.someday[id] = item
+	if update != (SomedayUpdate{}) {
+		s.emit(EntitySomeday, EventUpdated, id)
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) DeleteSomeday(id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.someday[id]; !ok || s.inTrash(TrashSomeday, id) {
+		return ErrNotFound
+	}
+	s.trashed[trashKey(TrashSomeday, id)] = time.Now().UTC().Format(time.RFC3339)
+	s.emit(EntitySomeday, EventDeleted, id)
+	return nil
+}
+
+func (s *MemoryStore) PromoteSomeday(id string) (Project, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.someday[id]
+	if !ok || s.inTrash(TrashSomeday, id) {
+		return Project{}, ErrNotFound
+	}
+
+	project := Project{Name: item.Title, InboxItemID: item.InboxItemID}
+	s.insertProject(&project)
+	s.trashed[trashKey(TrashSomeday, id)] = time.Now().UTC().Format(time.RFC3339)
+	s.emit(EntitySomeday, EventDeleted, id)
+	return project, nil
+}
+
+func (s *MemoryStore) ListReference() ([]ReferenceItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	items := []ReferenceItem{}
+	for _, item := range s.reference {
+		if !s.inTrash(TrashReference, item.ID) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Title < items[j].Title
+	})
+	return items, nil
+}
+
+func (s *MemoryStore) insertReference(item *ReferenceItem) {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	s.reference[item.ID] = *item
+	s.emit(EntityReference, EventCreated, item.ID)
+}
+
+func (s *MemoryStore) GetReference(id string) (ReferenceItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.reference[id]
+	if !ok || s.inTrash(TrashReference, id) {
+		return ReferenceItem{}, ErrNotFound
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) CreateReference(item *ReferenceItem) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.insertReference(item)
+	return nil
+}
+
+func (s *MemoryStore) DeleteReference(id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, ok := s.reference[id]; !ok || s.inTrash(TrashReference, id) {
+		return ErrNotFound
+	}
+	s.trashed[trashKey(TrashReference, id)] = time.Now().UTC().Format(time.RFC3339)
+	s.emit(EntityReference, EventDeleted, id)
+	return nil
+}
+
+func (s *MemoryStore) ListInboxItems(filter InboxFilter) ([]InboxItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	items := []InboxItem{}
+	for _, item := range s.inbox {
+		var match bool
+		switch {
+		case len(filter.States) > 0:
+			match = containsString(filter.States, item.State)
+		case filter.IncludeDeferred:
+			match = item.State == InboxOpen || item.State == InboxDeferred
+		default:
+			match = item.State == InboxOpen || (item.State == InboxDeferred && item.DeferUntil <= now)
+		}
+		if match {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt < items[j].CreatedAt
+	})
+	return items, nil
+}
+
+func (s *MemoryStore) GetInboxItem(id string) (InboxItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	item, ok := s.inbox[id]
+	if !ok {
+		return InboxItem{}, ErrNotFound
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) CreateInboxItem(item *InboxItem) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	item.State = InboxOpen
+	item.DeferredAt, item.ProcessedAt, item.DeletedAt = "", "", ""
+	if item.DeferUntil != "" {
+		item.State = InboxDeferred
+		item.DeferredAt = item.CreatedAt
+	}
+
+	s.inbox[item.ID] = *item
+	s.emit(EntityInbox, EventCreated, item.ID)
+	return nil
+}
+
+func (s *MemoryStore) UpdateInboxItem(id string, update InboxItemUpdate) (InboxItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	current, ok := s.inbox[id]
+	if !ok {
+		return InboxItem{}, ErrNotFound
+	}
+	item, err := applyInboxUpdate(current, update, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return InboxItem{}, err
+	}
+	s.inbox[id] = item
+	s.emit(EntityInbox, inboxChange(current.State, item.State), id)
+	return item, nil
+}
+
+func (s *MemoryStore) DeleteInboxItem(id string) error {
+	deleted := InboxDeleted
+	_, err := s.UpdateInboxItem(id, InboxItemUpdate{State: &deleted})
+	return err
+}
+
+func (s *MemoryStore) ProcessInboxItem(id string, processing InboxProcessing) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	current, ok := s.inbox[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.State == InboxProcessed {
+		return fmt.Errorf("%w: inbox item was already processed", ErrInvalidTransition)
+	}
+	processed := InboxProcessed
+	item, err := applyInboxUpdate(current, InboxItemUpdate{State: &processed}, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case processing.NextAction != nil:
+		action := processing.NextAction
+		action.Action = defaultString(action.Action, item.Description)
+		action.URL = defaultString(action.URL, item.URL)
+		action.InboxItemID = id
+		if action.ProjectID != "" {
+			if err := s.checkProjectRef(action.ProjectID); err != nil {
+				return err
+			}
+		}
+		s.insertNextAction(action)
+	case processing.Project != nil:
+		project := processing.Project
+		project.Name = defaultString(project.Name, item.Description)
+		project.InboxItemID = id
+		s.insertProject(project)
+	case processing.WaitingFor != nil:
+		waitingFor := processing.WaitingFor
+		waitingFor.What = defaultString(waitingFor.What, item.Description)
+		waitingFor.InboxItemID = id
+		if waitingFor.ProjectID != "" {
+			if err := s.checkProjectRef(waitingFor.ProjectID); err != nil {
+				return err
+			}
+		}
+		s.insertWaitingFor(waitingFor)
+	case processing.Someday != nil:
+		someday := processing.Someday
+		someday.Title = defaultString(someday.Title, item.Description)
+		someday.URL = defaultString(someday.URL, item.URL)
+		someday.InboxItemID = id
+		s.insertSomeday(someday)
+	case processing.Reference != nil:
+		reference := processing.Reference
+		reference.Title = defaultString(reference.Title, item.Description)
+		reference.URL = defaultString(reference.URL, item.URL)
+		reference.InboxItemID = id
+		s.insertReference(reference)
+	default:
+		return errors.New("nothing to process the inbox item into")
+	}
+
+	s.inbox[id] = item
+	s.emit(EntityInbox, EventUpdated, id)
+	return nil
+}
+
+func (s *MemoryStore) ListTrash() ([]TrashItem, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	items := []TrashItem{}
+	for key, deletedAt := range s.trashed {
+		recordType, id, _ := strings.Cut(key, "/")
+		item := TrashItem{Type: recordType, ID: id, DeletedAt: deletedAt}
+		switch recordType {
+		case TrashProject:
+			item.Title = s.projects[id].Name
+		case TrashNextAction:
+			item.Title = s.nextActions[id].Action
+		case TrashWaitingFor:
+			item.Title = s.waitingFor[id].What
+		case TrashSomeday:
+			item.Title = s.someday[id].Title
+		case TrashReference:
+			item.Title = s.reference[id].Title
+		}
+		items = append(items, item)
+	}
+	for _, inboxItem := range s.inbox {
+		if inboxItem.State == InboxDeleted {
+			items = append(items, TrashItem{Type: TrashInboxItem, ID: inboxItem.ID, Title: inboxItem.Description, DeletedAt: inboxItem.DeletedAt})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].DeletedAt != items[j].DeletedAt {
+			return items[i].DeletedAt > items[j].DeletedAt
+		}
+		return items[i].Title < items[j].Title
+	})
+	return items, nil
+}
+
+// trashKey is the key of a record in the trash, as IDs are only unique
+// among the records of a type.
+func trashKey(recordType string, id string) string {
+	return recordType + "/" + id
+}
+
+// inTrash reports whether the record of the given trash type is in the
+// trash.
+func (s *MemoryStore) inTrash(recordType string, id string) bool {
+	return s.trashed[trashKey(recordType, id)] != ""
+}
+
+func (s *MemoryStore) RestoreTrash(recordType string, id string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if recordType == TrashInboxItem {
+		item, ok := s.inbox[id]
+		if !ok || item.State != InboxDeleted {
+			return ErrNotFound
+		}
+		open := InboxOpen
+		item, err := applyInboxUpdate(item, InboxItemUpdate{State: &open}, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		s.inbox[id] = item
+		s.emit(EntityInbox, EventCreated, id)
+		return nil
+	}
+
+	if !s.inTrash(recordType, id) {
+		return ErrNotFound
+	}
+	delete(s.trashed, trashKey(recordType, id))
+	s.emit(entityOfTrashType(recordType), EventCreated, id)
+	return nil
+}
+
+func (s *MemoryStore) PurgeTrash(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	cutoff := before.UTC().Format(time.RFC3339)
+	purged := 0
+	// Records that outlive a purged project and aren't in the trash are
+	// reported as updated
+	unlinkedActions, unlinkedWaitingFor := []string{}, []string{}
+	for key, deletedAt := range s.trashed {
+		if deletedAt >= cutoff {
+			continue
+		}
+		recordType, id, _ := strings.Cut(key, "/")
+		switch recordType {
+		case TrashProject:
+			// Records that outlive a purged project lose their link to it
+			for actionID, action := range s.nextActions {
+				if action.ProjectID == id {
+					action.ProjectID, action.ProjectPosition = "", nil
+					s.nextActions[actionID] = action
+					if !s.inTrash(TrashNextAction, actionID) {
+						unlinkedActions = append(unlinkedActions, actionID)
+					}
+				}
+			}
+			for itemID, item := range s.waitingFor {
+				if item.ProjectID == id {
+					item.ProjectID = ""
+					s.waitingFor[itemID] = item
+					if !s.inTrash(TrashWaitingFor, itemID) {
+						unlinkedWaitingFor = append(unlinkedWaitingFor, itemID)
+					}
+				}
+			}
+			delete(s.projects, id)
+		case TrashNextAction:
+			delete(s.nextActions, id)
+			delete(s.links, id)
+		case TrashWaitingFor:
+			delete(s.waitingFor, id)
+		case TrashSomeday:
+			delete(s.someday, id)
+		case TrashReference:
+			delete(s.reference, id)
+		}
+		delete(s.trashed, key)
+		purged++
+	}
+	for id, item := range s.inbox {
+		if item.State == InboxDeleted && item.DeletedAt < cutoff {
+			delete(s.inbox, id)
+			purged++
+		}
+	}
+
+	for _, id := range unlinkedActions {
+		s.emit(EntityNextAction, EventUpdated, id)
+	}
+	for _, id := range unlinkedWaitingFor {
+		s.emit(EntityWaitingFor, EventUpdated, id)
+	}
+	return purged, nil
+}
+
+func (s *MemoryStore) RecordOperation(op *Operation) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.lastOpID++
+	op.ID = s.lastOpID
+	op.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	op.UndoneAt = ""
+
+	// A new operation can't be followed by the ones that were undone, and
+	// only the latest maxOperations of the session and user are kept
+	s.operations = append(s.operations, *op)
+	kept := []Operation{}
+	count := 0
+	for i := len(s.operations) - 1; i >= 0; i-- {
+		other := s.operations[i]
+		if other.SessionID == op.SessionID && other.UserID == op.UserID {
+			if other.UndoneAt != "" || count == maxOperations {
+				continue
+			}
+			count++
+		}
+		kept = append(kept, other)
+	}
+	slices.Reverse(kept)
+	s.operations = kept
+	return nil
+}
+
+func (s *MemoryStore) OperationToUndo(sessionID string, userID string) (Operation, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for i := len(s.operations) - 1; i >= 0; i-- {
+		if op := s.operations[i]; op.SessionID == sessionID && op.UserID == userID && op.UndoneAt == "" {
+			return op, nil
+		}
+	}
+	return Operation{}, ErrNotFound
+}
+
+func (s *MemoryStore) OperationToRedo(sessionID string, userID string) (Operation, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for _, op := range s.operations {
+		if op.SessionID == sessionID && op.UserID == userID && op.UndoneAt != "" {
+			return op, nil
+		}
+	}
+	return Operation{}, ErrNotFound
+}
+
+func (s *MemoryStore) SetOperationUndone(id int64, undone bool) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for i, op := range s.operations {
+		if op.ID != id {
+			continue
+		}
+		s.operations[i].UndoneAt = ""
+		if undone {
+			s.operations[i].UndoneAt = time.Now().UTC().Format(time.RFC3339)
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) AppendHistory(entries []HistoryEntry) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i := range entries {
+		entries[i].ID = int64(len(s.history) + 1)
+		entries[i].CreatedAt = now
+		s.history = append(s.history, entries[i])
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListHistory(filter HistoryFilter) ([]HistoryEntry, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	entries := []HistoryEntry{}
+	for i := len(s.history) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		entry := s.history[i]
+		if filter.RecordType != "" && (entry.RecordType != filter.RecordType || entry.RecordID != filter.RecordID) {
+			continue
+		}
+		if filter.Before > 0 && entry.ID >= filter.Before {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) ReleaseDeferred(now time.Time) ([]InboxItem, []NextAction, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	cutoff := now.UTC().Format(time.RFC3339)
+	open := InboxOpen
+	items := []InboxItem{}
+	for id, item := range s.inbox {
+		if item.State != InboxDeferred || item.DeferUntil > cutoff {
+			continue
+		}
+		item, err := applyInboxUpdate(item, InboxItemUpdate{State: &open}, cutoff)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.inbox[id] = item
+		s.emit(EntityInbox, EventUpdated, id)
+		items = append(items, item)
+	}
+
+	actions := []NextAction{}
+	for id, action := range s.nextActions {
+		if s.inTrash(TrashNextAction, id) || action.DeferUntil == "" || action.DeferUntil > cutoff {
+			continue
+		}
+		action.DeferUntil = ""
+		s.nextActions[id] = action
+		s.emit(EntityNextAction, EventUpdated, id)
+		actions = append(actions, s.withContexts(action))
+	}
+	return items, actions, nil
+}
+
+func (s *MemoryStore) EventsSince(since int64) ([]Event, int64, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	oldest := s.lastSeq + 1
+	if len(s.eventLog) > 0 {
+		oldest = s.eventLog[0].Sequence
+	}
+	if since > s.lastSeq || since < oldest-1 {
+		return nil, s.lastSeq, ErrEventsCompacted
+	}
+	events := []Event{}
+	for _, event := range s.eventLog {
+		if event.Sequence > since {
+			events = append(events, event)
+		}
+	}
+	return events, s.lastSeq, nil
+}
+
+func (s *MemoryStore) CreateUser(user *User) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for _, other := range s.users {
+		if other.Username == user.Username {
+			return ErrConflict
+		}
+	}
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	user.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *MemoryStore) GetUser(id string) (User, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) GetUserByUsername(username string) (User, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *MemoryStore) CountUsers() (int, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	return len(s.users), nil
+}
+
+func (s *MemoryStore) CreateLoginSession(session *LoginSession) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for tokenHash, other := range s.sessions {
+		if other.ExpiresAt <= now {
+			delete(s.sessions, tokenHash)
+		}
+	}
+	session.CreatedAt = now
+	s.sessions[session.TokenHash] = *session
+	return nil
+}
+
+func (s *MemoryStore) GetLoginSession(tokenHash string) (LoginSession, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok || session.ExpiresAt <= time.Now().UTC().Format(time.RFC3339) {
+		return LoginSession{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *MemoryStore) DeleteLoginSession(tokenHash string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	delete(s.sessions, tokenHash)
+	return nil
+}
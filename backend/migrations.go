@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Embed schema migrations, one directory per dialect. Files are named
+// NNNN_description.sql and are applied in version order.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads every NNNN_description.sql file in dir and returns
+// them sorted by version.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_description.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", entry.Name(), prefix)
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("migration %s: version %d already used by %s", entry.Name(), version, other)
+		}
+		seen[version] = entry.Name()
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// appliedMigrations returns the set of versions recorded in schema_migrations,
+// creating the table if it doesn't exist yet. With readOnly set the table is
+// left alone, and a missing one means no migrations have been applied.
+func appliedMigrations(db *sql.DB, dialect Dialect, readOnly bool) (map[int]bool, error) {
+	applied := make(map[int]bool)
+	if readOnly {
+		var tables int
+		if err := db.QueryRow(dialect.Rebind(dialect.tableExists), "schema_migrations").Scan(&tables); err != nil {
+			return nil, err
+		}
+		if tables == 0 {
+			return applied, nil
+		}
+	} else {
+		_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)`)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Migrate brings the database schema up to date. Each pending migration runs
+// in its own transaction together with its schema_migrations record. It
+// refuses to touch a database that has migrations this binary doesn't know
+// about, since that means it was written by a newer version of gsd. With
+// dryRun set, pending migrations are only logged and the database isn't
+// written to at all.
+func Migrate(db *sql.DB, dialect Dialect, migrations []Migration, dryRun bool) error {
+	applied, err := appliedMigrations(db, dialect, dryRun)
+	if err != nil {
+		return fmt.Errorf("reading schema_migrations: %w", err)
+	}
+
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d which this binary does not know about; upgrade gsd before using this database", version)
+		}
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		if dryRun {
+			log.Printf("Pending migration %04d_%s", m.Version, m.Name)
+			continue
+		}
+
+		log.Printf("Applying migration %04d_%s", m.Version, m.Name)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec(dialect.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+			m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("recording migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
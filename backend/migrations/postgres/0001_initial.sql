@@ -0,0 +1,27 @@
+-- Initial schema. Timestamps are stored as RFC 3339 text, like in SQLite,
+-- so both backends return them to clients in exactly the same format.
+CREATE TABLE IF NOT EXISTS inbox (
+	id TEXT PRIMARY KEY,
+	description TEXT NOT NULL,
+	url TEXT,
+	created_at TEXT NOT NULL,
+	state TEXT CHECK(state IS NULL OR state IN ('deleted'))
+);
+CREATE TABLE IF NOT EXISTS projects (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	position DOUBLE PRECISION NOT NULL UNIQUE,
+	created_at TEXT NOT NULL,
+	deadline TEXT
+);
+CREATE TABLE IF NOT EXISTS next_actions (
+	id TEXT PRIMARY KEY,
+	action TEXT NOT NULL,
+	project_id TEXT REFERENCES projects(id),
+	url TEXT,
+	size TEXT CHECK(size IS NULL OR size IN ('small', 'medium', 'big')),
+	energy TEXT CHECK(energy IS NULL OR energy IN ('high', 'low')),
+	created_at TEXT NOT NULL,
+	completed_at TEXT,
+	position DOUBLE PRECISION NOT NULL UNIQUE
+);
@@ -0,0 +1,11 @@
+CREATE TABLE contexts (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created_at TEXT NOT NULL
+);
+CREATE TABLE next_action_contexts (
+	next_action_id TEXT NOT NULL REFERENCES next_actions(id) ON DELETE CASCADE,
+	context_id TEXT NOT NULL REFERENCES contexts(id) ON DELETE CASCADE,
+	PRIMARY KEY(next_action_id, context_id)
+);
+CREATE INDEX next_action_contexts_context_id ON next_action_contexts(context_id);
@@ -0,0 +1,12 @@
+CREATE TABLE waiting_for (
+	id TEXT PRIMARY KEY,
+	what TEXT NOT NULL,
+	delegated_to TEXT NOT NULL,
+	delegated_at TEXT NOT NULL,
+	follow_up_at TEXT,
+	project_id TEXT REFERENCES projects(id),
+	inbox_item_id TEXT REFERENCES inbox(id),
+	created_at TEXT NOT NULL,
+	resolved_at TEXT
+);
+CREATE INDEX waiting_for_follow_up_at ON waiting_for(follow_up_at);
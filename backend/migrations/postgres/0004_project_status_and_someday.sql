@@ -0,0 +1,13 @@
+ALTER TABLE projects ADD COLUMN status TEXT NOT NULL DEFAULT 'active'
+	CHECK(status IN ('active', 'on_hold', 'someday', 'completed', 'dropped'));
+ALTER TABLE projects ADD COLUMN completed_at TEXT;
+CREATE INDEX projects_status ON projects(status);
+
+CREATE TABLE someday (
+	id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	notes TEXT,
+	url TEXT,
+	inbox_item_id TEXT REFERENCES inbox(id),
+	created_at TEXT NOT NULL
+);
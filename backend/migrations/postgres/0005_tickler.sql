@@ -0,0 +1,6 @@
+-- defer_until holds an RFC 3339 UTC timestamp. Deferred records stay hidden
+-- until then; the tickler clears the column when it releases them.
+ALTER TABLE inbox ADD COLUMN defer_until TEXT;
+ALTER TABLE next_actions ADD COLUMN defer_until TEXT;
+CREATE INDEX inbox_defer_until ON inbox(defer_until);
+CREATE INDEX next_actions_defer_until ON next_actions(defer_until);
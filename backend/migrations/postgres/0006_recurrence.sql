@@ -0,0 +1,5 @@
+-- recurrence is an RRULE subset counted from recurrence_start; occurs_at is
+-- the occurrence a next action stands for. Both times are RFC 3339 UTC.
+ALTER TABLE next_actions ADD COLUMN recurrence TEXT;
+ALTER TABLE next_actions ADD COLUMN recurrence_start TEXT;
+ALTER TABLE next_actions ADD COLUMN occurs_at TEXT;
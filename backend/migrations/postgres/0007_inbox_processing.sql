@@ -0,0 +1,18 @@
+-- Processed inbox items are kept with a 'processed' state
+ALTER TABLE inbox DROP CONSTRAINT IF EXISTS inbox_state_check;
+ALTER TABLE inbox ADD CONSTRAINT inbox_state_check
+	CHECK(state IS NULL OR state IN ('deleted', 'processed'));
+ALTER TABLE inbox ADD COLUMN processed_at TEXT;
+
+-- Records created from an inbox item link back to it
+ALTER TABLE next_actions ADD COLUMN inbox_item_id TEXT REFERENCES inbox(id);
+ALTER TABLE projects ADD COLUMN inbox_item_id TEXT REFERENCES inbox(id);
+
+CREATE TABLE reference_items (
+	id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	notes TEXT,
+	url TEXT,
+	inbox_item_id TEXT REFERENCES inbox(id),
+	created_at TEXT NOT NULL
+);
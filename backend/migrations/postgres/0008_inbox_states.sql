@@ -0,0 +1,12 @@
+-- Every inbox item now has an explicit state, and the time it last entered
+-- each state is kept so we can tell what happened to captured items.
+ALTER TABLE inbox DROP CONSTRAINT IF EXISTS inbox_state_check;
+UPDATE inbox SET state = 'deferred' WHERE state IS NULL AND defer_until IS NOT NULL;
+UPDATE inbox SET state = 'inbox' WHERE state IS NULL;
+ALTER TABLE inbox ALTER COLUMN state SET DEFAULT 'inbox';
+ALTER TABLE inbox ALTER COLUMN state SET NOT NULL;
+ALTER TABLE inbox ADD CONSTRAINT inbox_state_check
+	CHECK(state IN ('inbox', 'deferred', 'processed', 'deleted'));
+ALTER TABLE inbox ADD COLUMN deferred_at TEXT;
+ALTER TABLE inbox ADD COLUMN deleted_at TEXT;
+CREATE INDEX inbox_state ON inbox(state);
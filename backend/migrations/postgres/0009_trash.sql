@@ -0,0 +1,19 @@
+-- Deleting a record moves it to the trash by setting deleted_at; it is
+-- removed for good once it has been in the trash longer than the retention
+-- window.
+ALTER TABLE projects ADD COLUMN deleted_at TEXT;
+ALTER TABLE next_actions ADD COLUMN deleted_at TEXT;
+ALTER TABLE waiting_for ADD COLUMN deleted_at TEXT;
+ALTER TABLE someday ADD COLUMN deleted_at TEXT;
+ALTER TABLE reference_items ADD COLUMN deleted_at TEXT;
+CREATE INDEX projects_deleted_at ON projects(deleted_at);
+CREATE INDEX next_actions_deleted_at ON next_actions(deleted_at);
+CREATE INDEX waiting_for_deleted_at ON waiting_for(deleted_at);
+CREATE INDEX someday_deleted_at ON someday(deleted_at);
+CREATE INDEX reference_items_deleted_at ON reference_items(deleted_at);
+
+-- Inbox items deleted before deletion times were recorded get a full
+-- retention window from now on.
+UPDATE inbox SET deleted_at = to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+	WHERE state = 'deleted' AND deleted_at IS NULL;
+CREATE INDEX inbox_deleted_at ON inbox(deleted_at);
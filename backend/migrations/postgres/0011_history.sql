@@ -0,0 +1,12 @@
+-- Append-only audit history: one row per record changed by a request, with
+-- the changed fields as JSON.
+CREATE TABLE history (
+	id BIGSERIAL PRIMARY KEY,
+	record_type TEXT NOT NULL,
+	record_id TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	session_id TEXT,
+	changes TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE INDEX history_record ON history(record_type, record_id, id);
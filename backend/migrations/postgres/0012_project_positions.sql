@@ -0,0 +1,6 @@
+-- Next actions of a project have their own order within the project,
+-- independent of their position among all next actions. Existing actions
+-- start out in their current order.
+ALTER TABLE next_actions ADD COLUMN project_position DOUBLE PRECISION;
+UPDATE next_actions SET project_position = position WHERE project_id IS NOT NULL;
+CREATE UNIQUE INDEX next_actions_project_position ON next_actions(project_id, project_position);
@@ -0,0 +1,8 @@
+-- Every entity counts its changes, so clients can tell which of two events
+-- about it is newer. Entities get a row with their first event.
+CREATE TABLE revisions (
+	entity TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	revision BIGINT NOT NULL,
+	PRIMARY KEY (entity, entity_id)
+);
@@ -0,0 +1,6 @@
+-- Events record the projects and contexts their entity belonged to before
+-- and after the change, which pick the events of narrower topics. Revisions
+-- keep the ones after the latest change for the next one. Events from
+-- before have none, so replays only match them by entity.
+ALTER TABLE events ADD COLUMN scopes TEXT;
+ALTER TABLE revisions ADD COLUMN scopes TEXT;
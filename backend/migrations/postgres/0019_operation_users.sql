@@ -0,0 +1,3 @@
+-- Operations record the logged-in user who made them, who is the only one
+-- who can undo and redo them, even from a session with the same ID.
+ALTER TABLE operations ADD COLUMN user_id TEXT;
@@ -0,0 +1,28 @@
+-- Initial schema. Uses IF NOT EXISTS so databases created before
+-- migrations were introduced are adopted without changes.
+CREATE TABLE IF NOT EXISTS inbox (
+	id TEXT PRIMARY KEY,
+	description TEXT NOT NULL,
+	url TEXT,
+	created_at DATETIME NOT NULL,
+	state TEXT CHECK(state IS NULL OR state IN ('deleted'))
+);
+CREATE TABLE IF NOT EXISTS projects (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	position REAL NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	deadline TEXT
+);
+CREATE TABLE IF NOT EXISTS next_actions (
+	id TEXT PRIMARY KEY,
+	action TEXT NOT NULL,
+	project_id TEXT,
+	url TEXT,
+	size TEXT CHECK(size IS NULL OR size IN ('small', 'medium', 'big')),
+	energy TEXT CHECK(energy IS NULL OR energy IN ('high', 'low')),
+	created_at DATETIME NOT NULL,
+	completed_at DATETIME,
+	position REAL NOT NULL UNIQUE,
+	FOREIGN KEY(project_id) REFERENCES projects(id)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE contexts (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL
+);
+CREATE TABLE next_action_contexts (
+	next_action_id TEXT NOT NULL,
+	context_id TEXT NOT NULL,
+	PRIMARY KEY(next_action_id, context_id),
+	FOREIGN KEY(next_action_id) REFERENCES next_actions(id) ON DELETE CASCADE,
+	FOREIGN KEY(context_id) REFERENCES contexts(id) ON DELETE CASCADE
+);
+CREATE INDEX next_action_contexts_context_id ON next_action_contexts(context_id);
@@ -0,0 +1,14 @@
+CREATE TABLE waiting_for (
+	id TEXT PRIMARY KEY,
+	what TEXT NOT NULL,
+	delegated_to TEXT NOT NULL,
+	delegated_at TEXT NOT NULL,
+	follow_up_at TEXT,
+	project_id TEXT,
+	inbox_item_id TEXT,
+	created_at DATETIME NOT NULL,
+	resolved_at DATETIME,
+	FOREIGN KEY(project_id) REFERENCES projects(id),
+	FOREIGN KEY(inbox_item_id) REFERENCES inbox(id)
+);
+CREATE INDEX waiting_for_follow_up_at ON waiting_for(follow_up_at);
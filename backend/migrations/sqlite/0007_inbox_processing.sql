@@ -0,0 +1,30 @@
+-- Processed inbox items are kept with a 'processed' state. SQLite can't
+-- change a CHECK constraint in place, so the inbox table is rebuilt.
+CREATE TABLE inbox_new (
+	id TEXT PRIMARY KEY,
+	description TEXT NOT NULL,
+	url TEXT,
+	created_at DATETIME NOT NULL,
+	state TEXT CHECK(state IS NULL OR state IN ('deleted', 'processed')),
+	defer_until TEXT,
+	processed_at DATETIME
+);
+INSERT INTO inbox_new (id, description, url, created_at, state, defer_until)
+	SELECT id, description, url, created_at, state, defer_until FROM inbox;
+DROP TABLE inbox;
+ALTER TABLE inbox_new RENAME TO inbox;
+CREATE INDEX inbox_defer_until ON inbox(defer_until);
+
+-- Records created from an inbox item link back to it
+ALTER TABLE next_actions ADD COLUMN inbox_item_id TEXT REFERENCES inbox(id);
+ALTER TABLE projects ADD COLUMN inbox_item_id TEXT REFERENCES inbox(id);
+
+CREATE TABLE reference_items (
+	id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	notes TEXT,
+	url TEXT,
+	inbox_item_id TEXT,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY(inbox_item_id) REFERENCES inbox(id)
+);
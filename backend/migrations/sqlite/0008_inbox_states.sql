@@ -0,0 +1,28 @@
+-- Every inbox item now has an explicit state, and the time it last entered
+-- each state is kept so we can tell what happened to captured items. The
+-- table is rebuilt to change the state constraint.
+CREATE TABLE inbox_new (
+	id TEXT PRIMARY KEY,
+	description TEXT NOT NULL,
+	url TEXT,
+	created_at DATETIME NOT NULL,
+	state TEXT NOT NULL DEFAULT 'inbox'
+		CHECK(state IN ('inbox', 'deferred', 'processed', 'deleted')),
+	defer_until TEXT,
+	deferred_at DATETIME,
+	processed_at DATETIME,
+	deleted_at DATETIME
+);
+INSERT INTO inbox_new (id, description, url, created_at, state, defer_until, processed_at)
+	SELECT id, description, url, created_at,
+		CASE
+			WHEN state IS NOT NULL THEN state
+			WHEN defer_until IS NOT NULL THEN 'deferred'
+			ELSE 'inbox'
+		END,
+		defer_until, processed_at
+	FROM inbox;
+DROP TABLE inbox;
+ALTER TABLE inbox_new RENAME TO inbox;
+CREATE INDEX inbox_defer_until ON inbox(defer_until);
+CREATE INDEX inbox_state ON inbox(state);
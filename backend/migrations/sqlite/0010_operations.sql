@@ -0,0 +1,12 @@
+-- Journal of the changes made through the API, so every client session can
+-- undo and redo its own operations. changes holds the JSON state of each
+-- touched record before and after the operation.
+CREATE TABLE operations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	changes TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	undone_at DATETIME
+);
+CREATE INDEX operations_session ON operations(session_id, id);
@@ -0,0 +1,12 @@
+-- Log of the latest entity events, numbered in the order they were made, so
+-- clients can catch up on the events they missed while disconnected.
+CREATE TABLE events (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	version INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	entity TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	data TEXT
+);
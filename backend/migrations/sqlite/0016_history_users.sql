@@ -0,0 +1,3 @@
+-- History entries record who made the change, for requests made by a
+-- logged-in user.
+ALTER TABLE history ADD COLUMN user_id TEXT;
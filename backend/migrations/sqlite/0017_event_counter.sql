@@ -0,0 +1,8 @@
+-- Event sequence numbers are taken from a single counter row. Its row lock
+-- makes transactions number their events one after the other, so events
+-- become visible in the order of their numbers.
+CREATE TABLE event_counter (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	seq INTEGER NOT NULL
+);
+INSERT INTO event_counter (id, seq) SELECT 1, COALESCE(MAX(seq), 0) FROM events;
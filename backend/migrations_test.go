@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "widgets", SQL: "CREATE TABLE widgets (id TEXT PRIMARY KEY)"},
+	{Version: 2, Name: "widget_names", SQL: "ALTER TABLE widgets ADD COLUMN name TEXT"},
+}
+
+// openMigrationsDB returns an empty SQLite database.
+func openMigrationsDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(SQLite.Driver, filepath.Join(t.TempDir(), "gsd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordedMigrations lists the versions in schema_migrations in order.
+func recordedMigrations(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	versions := []int{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func hasTable(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var tables int
+	if err := db.QueryRow(SQLite.tableExists, name).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	return tables > 0
+}
+
+// TestMigrateInOrder applies migrations by version, each one building on
+// the ones before it.
+func TestMigrateInOrder(t *testing.T) {
+	db := openMigrationsDB(t)
+	if err := Migrate(db, SQLite, testMigrations, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO widgets (id, name) VALUES ('1', 'sprocket')"); err != nil {
+		t.Fatal(err)
+	}
+	if got := recordedMigrations(t, db); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("recorded migrations %v, want [1 2]", got)
+	}
+}
+
+// TestMigrateSkipsApplied only runs migrations that aren't recorded yet, so
+// migrating an up-to-date database is a no-op.
+func TestMigrateSkipsApplied(t *testing.T) {
+	db := openMigrationsDB(t)
+	if err := Migrate(db, SQLite, testMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := Migrate(db, SQLite, testMigrations, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := recordedMigrations(t, db); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("recorded migrations %v, want [1 2]", got)
+	}
+
+	if err := Migrate(db, SQLite, testMigrations[:1], false); err == nil {
+		t.Error("migrating with a binary that doesn't know migration 2 succeeded")
+	}
+}
+
+// TestMigrateDryRun reports pending migrations without changing the
+// database, or creating it if it doesn't exist.
+func TestMigrateDryRun(t *testing.T) {
+	db := openMigrationsDB(t)
+	if err := Migrate(db, SQLite, testMigrations, true); err != nil {
+		t.Fatal(err)
+	}
+	if hasTable(t, db, "schema_migrations") || hasTable(t, db, "widgets") {
+		t.Error("dry run created tables")
+	}
+
+	if err := Migrate(db, SQLite, testMigrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db, SQLite, testMigrations, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := recordedMigrations(t, db); !slices.Equal(got, []int{1}) {
+		t.Errorf("recorded migrations %v after dry run, want [1]", got)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	InitDB(SQLite, filepath.Join(dir, "gsd.db"), true).Close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("dry run created %s", dir)
+	}
+
+	// An existing database is opened read-only
+	file := filepath.Join(t.TempDir(), "gsd.db")
+	InitDB(SQLite, file, false).Close()
+	InitDB(SQLite, file, true).Close()
+}
+
+// TestMigrateRollsBack leaves no trace of a migration that fails partway,
+// while keeping the ones applied before it.
+func TestMigrateRollsBack(t *testing.T) {
+	db := openMigrationsDB(t)
+	migrations := append(slices.Clone(testMigrations), Migration{Version: 3, Name: "broken",
+		SQL: "CREATE TABLE gadgets (id TEXT PRIMARY KEY); INSERT INTO missing (id) VALUES ('1')"})
+	if err := Migrate(db, SQLite, migrations, false); err == nil {
+		t.Fatal("broken migration succeeded")
+	}
+	if hasTable(t, db, "gadgets") {
+		t.Error("failed migration left its table behind")
+	}
+	if got := recordedMigrations(t, db); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("recorded migrations %v, want [1 2]", got)
+	}
+}
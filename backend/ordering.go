@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Move says where a record goes in its list: right before the Before
+// record, or right after the After record if Before is empty, or at the
+// end of the list if both are empty. Given both, After has to come before
+// Before.
+type Move struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// positioned is the place of a record in a list ordered by position.
+// Trashed records keep their position, so they are part of the list even
+// though they can't be moved next to.
+type positioned struct {
+	ID       string
+	Position float64
+	Trashed  bool
+}
+
+// planMove works out the new position of record id in list, which is sorted
+// by position. A moved record goes halfway between its new neighbours. When
+// floats leave no room between them, the whole list is renumbered 1, 2,
+// 3... with the record in its new place, and the new positions of every
+// record are returned as well; otherwise the second result is nil.
+func planMove(list []positioned, id string, move Move) (float64, []positioned, error) {
+	index := func(recordID string) (int, error) {
+		i := slices.IndexFunc(list, func(p positioned) bool { return p.ID == recordID })
+		if i < 0 || list[i].Trashed || recordID == id {
+			return 0, fmt.Errorf("%w: can't move next to %s", ErrInvalidReference, recordID)
+		}
+		return i, nil
+	}
+
+	self := slices.IndexFunc(list, func(p positioned) bool { return p.ID == id })
+	if self < 0 || list[self].Trashed {
+		return 0, nil, ErrNotFound
+	}
+
+	// at is where the record goes in list, before taking it out of its
+	// current place
+	at := len(list)
+	if move.Before != "" {
+		before, err := index(move.Before)
+		if err != nil {
+			return 0, nil, err
+		}
+		at = before
+	}
+	if move.After != "" {
+		after, err := index(move.After)
+		if err != nil {
+			return 0, nil, err
+		}
+		if move.Before == "" {
+			at = after + 1
+		} else if after >= at {
+			return 0, nil, fmt.Errorf("%w: %s comes after %s", ErrInvalidReference, move.After, move.Before)
+		}
+	}
+
+	others := slices.Delete(slices.Clone(list), self, self+1)
+	if at > self {
+		at--
+	}
+
+	switch {
+	case len(others) == 0:
+		return 1, nil, nil
+	case at == 0:
+		return others[0].Position - 1, nil, nil
+	case at == len(others):
+		return others[at-1].Position + 1, nil, nil
+	}
+	lower, upper := others[at-1].Position, others[at].Position
+	if position := lower + (upper-lower)/2; lower < position && position < upper {
+		return position, nil, nil
+	}
+
+	rebalanced := slices.Insert(others, at, list[self])
+	for i := range rebalanced {
+		rebalanced[i].Position = float64(i + 1)
+	}
+	return float64(at + 1), rebalanced, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OriginPolicy decides which web pages may use the API from a browser. Pages
+// served by gsd itself always may; pages of other origins only if they are
+// allowed explicitly, so a page the user happens to visit can't read or
+// change their data.
+//
+// Requests must also be sent to a host name gsd knows it is reached by.
+// Otherwise a page could point its own name at gsd's address by DNS
+// rebinding, and become gsd's own origin to the browser.
+type OriginPolicy struct {
+	allowed  map[string]bool
+	allowAll bool // "*" was allowed
+
+	hosts         map[string]bool // besides loopback names and IP addresses
+	allowAllHosts bool            // "*" was given as a host
+}
+
+// NewOriginPolicy returns a policy allowing the given origins besides the
+// server's own, such as "http://localhost:3000". "*" allows every origin,
+// without credentials. Requests may be sent to localhost, an IP address, the
+// given hosts, such as "gsd.example.com", or the hosts of the allowed
+// origins. "*" allows every host.
+func NewOriginPolicy(origins []string, hosts []string) (*OriginPolicy, error) {
+	policy := &OriginPolicy{allowed: make(map[string]bool), hosts: make(map[string]bool)}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		switch {
+		case host == "":
+		case host == "*":
+			policy.allowAllHosts = true
+		case strings.ContainsAny(host, ":/"):
+			return nil, fmt.Errorf("invalid host %q, expected a host name without scheme or port", host)
+		default:
+			policy.hosts[host] = true
+		}
+	}
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			policy.allowAll = true
+			continue
+		}
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			return nil, err
+		}
+		policy.allowed[normalized] = true
+		u, _ := url.Parse(normalized)
+		policy.hosts[u.Hostname()] = true
+	}
+	return policy, nil
+}
+
+// normalizeOrigin checks that origin is a scheme and host, and lowercases it
+// the way browsers send it.
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") ||
+		u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// AllowsHost reports whether a request was sent to a host gsd is reached
+// by. Loopback names and IP addresses always are, as pages can't rebind
+// them.
+func (p *OriginPolicy) AllowsHost(r *http.Request) bool {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return p.allowAllHosts || p.hosts[host] || host == "localhost" ||
+		strings.HasSuffix(host, ".localhost") || net.ParseIP(host) != nil
+}
+
+// Allows reports whether the page a request comes from may use the API.
+// Requests without an Origin header don't come from a page, like the ones of
+// curl, and are allowed if they are sent to an allowed host.
+func (p *OriginPolicy) Allows(r *http.Request) bool {
+	return p.AllowsCredentials(r) || (p.AllowsHost(r) && p.allowAll)
+}
+
+// AllowsCredentials reports whether the page a request comes from may use
+// the API logged in as the user. Origins allowed only by "*" may not: the
+// login cookie is SameSite=Lax, so browsers still send it from other ports
+// of the same host, such as another local development server.
+func (p *OriginPolicy) AllowsCredentials(r *http.Request) bool {
+	if !p.AllowsHost(r) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || p.sameOrigin(r, origin) || p.allowed[strings.ToLower(origin)]
+}
+
+// sameOrigin reports whether origin is the scheme and host the request was
+// sent to. Behind a proxy terminating HTTPS, requests come in over HTTP, so
+// the HTTPS origin has to be allowed explicitly.
+func (p *OriginPolicy) sameOrigin(r *http.Request, origin string) bool {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, r.Host)
+}
+
+// Middleware rejects requests to unknown hosts and from pages of origins that
+// aren't allowed, and adds the CORS headers that let browsers hand the
+// responses of allowed ones to pages of other origins. Requests of origins
+// allowed only by "*" have their cookies removed, so they are never logged
+// in. It answers CORS preflight requests itself.
+func (p *OriginPolicy) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if !p.AllowsHost(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "host not allowed, add it to gsd's --hosts"})
+			return
+		}
+		if !p.Allows(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+			return
+		}
+		if origin == "" || p.sameOrigin(c.Request, origin) {
+			c.Next()
+			return
+		}
+
+		if p.AllowsCredentials(c.Request) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Add("Vary", "Origin")
+		} else {
+			c.Header("Access-Control-Allow-Origin", "*")
+			c.Request.Header.Del("Cookie")
+		}
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+			c.Header("Access-Control-Allow-Headers", c.GetHeader("Access-Control-Request-Headers"))
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
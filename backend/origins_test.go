@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// TestOriginPolicy checks which hosts and origins requests are let through
+// from, and the CORS headers they get.
+func TestOriginPolicy(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"http://localhost:3000", "*"}, []string{"gsd.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := NewOriginPolicy([]string{"https://dash.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		policy      *OriginPolicy
+		host        string
+		https       bool
+		origin      string
+		status      int
+		allowOrigin string
+		credentials bool
+	}{
+		{"no origin", strict, "localhost:8081", false, "", http.StatusOK, "", false},
+		{"own origin", strict, "localhost:8081", false, "http://localhost:8081", http.StatusOK, "", false},
+		{"own origin over https", strict, "127.0.0.1:8081", true, "https://127.0.0.1:8081", http.StatusOK, "", false},
+		{"other scheme", strict, "localhost:8081", true, "http://localhost:8081", http.StatusForbidden, "", false},
+		{"other origin", strict, "localhost:8081", false, "http://evil.example", http.StatusForbidden, "", false},
+		{"allowed origin", strict, "localhost:8081", false, "https://dash.example.com", http.StatusOK, "https://dash.example.com", true},
+		{"IPv6 address", strict, "[::1]:8081", false, "", http.StatusOK, "", false},
+		{"host of allowed origin", strict, "dash.example.com", false, "", http.StatusOK, "", false},
+		{"rebound host", strict, "evil.example:8081", false, "http://evil.example:8081", http.StatusForbidden, "", false},
+		{"rebound host without origin", strict, "evil.example:8081", false, "", http.StatusForbidden, "", false},
+		{"configured host", policy, "gsd.example.com", false, "http://gsd.example.com", http.StatusOK, "", false},
+		{"explicit origin besides *", policy, "localhost:8081", false, "http://localhost:3000", http.StatusOK, "http://localhost:3000", true},
+		{"origin allowed by *", policy, "localhost:8081", false, "http://evil.example", http.StatusOK, "*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/api/ping", tt.policy.Middleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+			req := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+			req.Host = tt.host
+			if tt.https {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.allowOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Errorf("got credentials %v, want %v", got, tt.credentials)
+			}
+		})
+	}
+}
+
+// TestInvalidHosts rejects hosts given with a scheme or port.
+func TestInvalidHosts(t *testing.T) {
+	for _, host := range []string{"http://gsd.example.com", "gsd.example.com:8081"} {
+		if _, err := NewOriginPolicy(nil, []string{host}); err == nil {
+			t.Errorf("host %q was accepted", host)
+		}
+	}
+}
+
+// TestPreflight answers the CORS preflight of an allowed origin without
+// passing it on.
+func TestPreflight(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"http://localhost:3000"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(policy.Middleware())
+	r.OPTIONS("/api/projects", func(c *gin.Context) { t.Error("the preflight was passed on") })
+	req := httptest.NewRequest(http.MethodOptions, "/api/projects", nil)
+	req.Host = "localhost:8081"
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "content-type" {
+		t.Errorf("got Access-Control-Allow-Headers %q", got)
+	}
+}
+
+// TestInvalidOrigins rejects origins that aren't just a scheme and host.
+func TestInvalidOrigins(t *testing.T) {
+	for _, origin := range []string{"localhost:3000", "http://localhost:3000/app", "http://user@localhost:3000"} {
+		if _, err := NewOriginPolicy([]string{origin}, nil); err == nil {
+			t.Errorf("origin %q was accepted", origin)
+		}
+	}
+}
+
+// TestWebSocketOrigin refuses websocket upgrades from pages of other
+// origins, and of origins allowed only by "*", as the connection would be
+// logged in.
+func TestWebSocketOrigin(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"http://localhost:3000", "*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewClientManager(NewMemoryStore(nil), policy)
+	go manager.Run()
+	r := gin.New()
+	r.GET("/api/ws", manager.HandleWebSocket)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+
+	for origin, allowed := range map[string]bool{
+		"":                      true,
+		"http://localhost:3000": true,
+		srv.URL:                 true,
+		"http://localhost:5173": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if allowed && err != nil {
+			t.Errorf("origin %q: %v", origin, err)
+		}
+		if !allowed && (err == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q was let through", origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// TestWildcardOriginLoggedOut sends the login cookie from a page of an
+// origin allowed only by "*". Browsers send the SameSite=Lax cookie from
+// other ports of the same host, but the page must not get logged in.
+func TestWildcardOriginLoggedOut(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore(nil)
+	user := User{Username: "alice"}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	session := LoginSession{
+		TokenHash: hashSessionToken("token"),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+	if err := store.CreateLoginSession(&session); err != nil {
+		t.Fatal(err)
+	}
+	manager := NewClientManager(store, policy)
+	go manager.Run()
+	server := NewServer(store, manager)
+	r := gin.New()
+	api := r.Group("/api", policy.Middleware())
+	server.RegisterAuthRoutes(api)
+	server.RegisterRoutes(api.Group("", server.RequireLogin()))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for origin, loggedIn := range map[string]bool{"": true, "http://localhost:5173": false} {
+		header := http.Header{}
+		header.Set("Cookie", sessionCookie+"=token")
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/inbox", strings.NewReader(`{"description":"Planted"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header.Clone()
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := map[bool]int{true: http.StatusOK, false: http.StatusUnauthorized}[loggedIn]; resp.StatusCode != want {
+			t.Errorf("POST from origin %q: got status %d, want %d", origin, resp.StatusCode, want)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws", header)
+		if loggedIn && err != nil {
+			t.Errorf("websocket from origin %q: %v", origin, err)
+		}
+		if !loggedIn && err == nil {
+			t.Errorf("websocket from origin %q was let through", origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	items, err := store.ListInboxItems(InboxFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Errorf("got %d inbox items, want only the one sent without an origin", len(items))
+	}
+}
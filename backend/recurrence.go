@@ -0,0 +1,540 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule is a recurrence rule using a subset of RFC 5545 RRULE: FREQ (DAILY,
+// WEEKLY, MONTHLY or YEARLY), INTERVAL, BYDAY (with ordinals such as 1MO or
+// -1FR for MONTHLY and YEARLY), BYMONTHDAY (negative values count from the
+// end of the month), BYMONTH, COUNT and UNTIL. In a YEARLY rule without
+// BYMONTH, BYMONTHDAY applies to every month and BYDAY alone to the whole
+// year, so FREQ=YEARLY;BYDAY=1MO is the first Monday of January and
+// FREQ=YEARLY;BYDAY=MO every Monday. As in RFC 5545, dates that
+// don't exist in a given month, such as the 31st of April, are skipped rather
+// than moved.
+type Rule struct {
+	Freq       string
+	Interval   int
+	ByDay      []ruleWeekday
+	ByMonthDay []int
+	ByMonth    []time.Month
+	Count      int
+	Until      time.Time
+}
+
+// ruleWeekday is a BYDAY entry. N selects the Nth such weekday of the month,
+// or of the year in a YEARLY rule without BYMONTH (negative counts from the
+// end); zero means every such weekday.
+type ruleWeekday struct {
+	N   int
+	Day time.Weekday
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// ruleShortcuts are accepted in place of a full rule.
+var ruleShortcuts = map[string]string{
+	"daily":   "FREQ=DAILY",
+	"weekly":  "FREQ=WEEKLY",
+	"monthly": "FREQ=MONTHLY",
+	"yearly":  "FREQ=YEARLY",
+}
+
+// maxRulePeriods bounds how many periods (days, weeks, months or years) a
+// rule is expanded over, so rules that can never match don't loop forever.
+const maxRulePeriods = 50000
+
+// ParseRule parses a recurrence rule such as "FREQ=WEEKLY;BYDAY=MO,TH" or one
+// of the shortcuts daily, weekly, monthly and yearly. Dates and floating
+// times in UNTIL are taken in loc.
+func ParseRule(s string, loc *time.Location) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if shortcut, ok := ruleShortcuts[strings.ToLower(s)]; ok {
+		s = shortcut
+	}
+	s = strings.TrimPrefix(strings.ToUpper(s), "RRULE:")
+
+	rule := Rule{Interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return Rule{}, fmt.Errorf("invalid rule part %q", part)
+		}
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rule.Freq = value
+			default:
+				err = fmt.Errorf("unsupported FREQ %q", value)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(value)
+			if err == nil && rule.Interval < 1 {
+				err = errors.New("INTERVAL must be positive")
+			}
+		case "BYDAY":
+			for _, code := range strings.Split(value, ",") {
+				var day ruleWeekday
+				if day, err = parseRuleWeekday(code); err != nil {
+					break
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				var day int
+				day, err = strconv.Atoi(v)
+				if err != nil || day == 0 || day < -31 || day > 31 {
+					err = fmt.Errorf("invalid BYMONTHDAY %q", v)
+					break
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, day)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				var month int
+				month, err = strconv.Atoi(v)
+				if err != nil || month < 1 || month > 12 {
+					err = fmt.Errorf("invalid BYMONTH %q", v)
+					break
+				}
+				rule.ByMonth = append(rule.ByMonth, time.Month(month))
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(value)
+			if err == nil && rule.Count < 1 {
+				err = errors.New("COUNT must be positive")
+			}
+		case "UNTIL":
+			rule.Until, err = parseRuleUntil(value, loc)
+		case "WKST":
+			if value != "MO" {
+				err = errors.New("only WKST=MO is supported")
+			}
+		default:
+			err = fmt.Errorf("unsupported rule part %s", key)
+		}
+		if err != nil {
+			return Rule{}, err
+		}
+	}
+
+	if rule.Freq == "" {
+		return Rule{}, errors.New("FREQ is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return Rule{}, errors.New("COUNT and UNTIL can't be combined")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != "MONTHLY" && rule.Freq != "YEARLY" {
+			return Rule{}, errors.New("BYDAY ordinals are only supported with FREQ=MONTHLY or FREQ=YEARLY")
+		}
+	}
+	return rule, nil
+}
+
+func parseRuleWeekday(code string) (ruleWeekday, error) {
+	if len(code) < 2 {
+		return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", code)
+	}
+	day, ok := weekdayCodes[code[len(code)-2:]]
+	if !ok {
+		return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", code)
+	}
+	n := 0
+	if prefix := code[:len(code)-2]; prefix != "" {
+		var err error
+		n, err = strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", code)
+		}
+	}
+	return ruleWeekday{N: n, Day: day}, nil
+}
+
+// parseRuleUntil accepts the UNTIL forms of RFC 5545: a date, which includes
+// the whole day, a UTC date-time or a floating date-time in loc.
+func parseRuleUntil(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", value)
+}
+
+// String formats the rule in canonical RRULE form, without the RRULE: prefix.
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByMonth) > 0 {
+		var months []string
+		for _, month := range r.ByMonth {
+			months = append(months, strconv.Itoa(int(month)))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			code := strings.ToUpper(day.Day.String()[:2])
+			if day.N != 0 {
+				code = strconv.Itoa(day.N) + code
+			}
+			days = append(days, code)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences returns up to n occurrences of the rule starting at start that
+// are strictly after after. Occurrences keep the wall clock time of start in
+// its location, so a rule starting at 09:00 stays at 09:00 across daylight
+// saving time changes.
+func (r Rule) Occurrences(start time.Time, after time.Time, n int) []time.Time {
+	var occurrences []time.Time
+	if n <= 0 {
+		return occurrences
+	}
+
+	count := 0
+	for period := 0; period < maxRulePeriods; period++ {
+		for _, t := range r.period(start, period) {
+			if t.Before(start) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return occurrences
+			}
+			count++
+			if t.After(after) {
+				occurrences = append(occurrences, t)
+				if len(occurrences) == n {
+					return occurrences
+				}
+			}
+			if r.Count > 0 && count >= r.Count {
+				return occurrences
+			}
+		}
+	}
+	return occurrences
+}
+
+// Next returns the first occurrence strictly after after, or false if the
+// rule has no more occurrences.
+func (r Rule) Next(start time.Time, after time.Time) (time.Time, bool) {
+	occurrences := r.Occurrences(start, after, 1)
+	if len(occurrences) == 0 {
+		return time.Time{}, false
+	}
+	return occurrences[0], true
+}
+
+// period returns the sorted candidate occurrences in the given period after
+// the one containing start.
+func (r Rule) period(start time.Time, period int) []time.Time {
+	loc := start.Location()
+	hour, min, sec := start.Clock()
+	year, month, day := start.Date()
+
+	// at builds an occurrence on the given day, reporting false for days
+	// that don't exist, like February 30th.
+	at := func(year int, month time.Month, day int) (time.Time, bool) {
+		t := localTime(year, month, day, hour, min, sec, loc)
+		y, m, d := t.Date()
+		return t, y == year && m == month && d == day
+	}
+
+	var candidates []time.Time
+	switch r.Freq {
+	case "DAILY":
+		t := localTime(year, month, day+period*r.Interval, hour, min, sec, loc)
+		if r.matchesMonth(t.Month()) && r.matchesMonthDay(t) && r.matchesWeekday(t.Weekday()) {
+			candidates = append(candidates, t)
+		}
+	case "WEEKLY":
+		// Weeks start on Monday
+		offset := (int(start.Weekday()) + 6) % 7
+		weekStart := day - offset + period*r.Interval*7
+		days := []time.Weekday{start.Weekday()}
+		if len(r.ByDay) > 0 {
+			days = nil
+			for _, byDay := range r.ByDay {
+				days = append(days, byDay.Day)
+			}
+		}
+		for _, weekday := range days {
+			t := localTime(year, month, weekStart+(int(weekday)+6)%7, hour, min, sec, loc)
+			if r.matchesMonth(t.Month()) {
+				candidates = append(candidates, t)
+			}
+		}
+	case "MONTHLY":
+		first := time.Date(year, month+time.Month(period*r.Interval), 1, 0, 0, 0, 0, loc)
+		if r.matchesMonth(first.Month()) {
+			for _, d := range r.daysInMonth(first.Year(), first.Month(), day) {
+				if t, ok := at(first.Year(), first.Month(), d); ok {
+					candidates = append(candidates, t)
+				}
+			}
+		}
+	case "YEARLY":
+		y := year + period*r.Interval
+		if len(r.ByMonth) == 0 && len(r.ByMonthDay) == 0 && len(r.ByDay) > 0 {
+			for _, d := range r.daysInYear(y) {
+				candidates = append(candidates, localTime(y, time.January, d, hour, min, sec, loc))
+			}
+			break
+		}
+		months := r.ByMonth
+		switch {
+		case len(months) > 0:
+		case len(r.ByMonthDay) > 0:
+			// BYMONTHDAY without BYMONTH applies to every month
+			for m := time.January; m <= time.December; m++ {
+				months = append(months, m)
+			}
+		default:
+			months = []time.Month{month}
+		}
+		for _, m := range months {
+			for _, d := range r.daysInMonth(y, m, day) {
+				if t, ok := at(y, m, d); ok {
+					candidates = append(candidates, t)
+				}
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+	return candidates
+}
+
+// localTime is time.Date for a wall clock time in loc, except that a time
+// skipped when the clocks go forward is read with the UTC offset from before
+// the change, as RFC 5545 says, so it comes out later by the length of the
+// gap rather than earlier.
+func localTime(year int, month time.Month, day, hour, min, sec int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+	if h, m, s := t.Clock(); h == hour && m == min && s == sec {
+		return t
+	}
+	_, offset := t.Add(-24 * time.Hour).Zone()
+	return time.Date(year, month, day, hour, min, sec, 0, time.FixedZone("", offset)).In(loc)
+}
+
+// daysInMonth returns the days of the month selected by BYMONTHDAY and
+// BYDAY, or defaultDay if neither is set. Days past the end of the month
+// are returned as is and skipped by the caller.
+func (r Rule) daysInMonth(year int, month time.Month, defaultDay int) []int {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	var days []int
+	if len(r.ByMonthDay) > 0 {
+		for _, d := range r.ByMonthDay {
+			if d < 0 {
+				d = last + d + 1
+			}
+			if d < 1 {
+				continue
+			}
+			weekday := time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Weekday()
+			if d <= last && !r.matchesWeekday(weekday) {
+				continue
+			}
+			days = append(days, d)
+		}
+		return days
+	}
+
+	if len(r.ByDay) > 0 {
+		return r.weekdays(time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Weekday(), last)
+	}
+
+	return []int{defaultDay}
+}
+
+// daysInYear returns the days of the year, counted from January 1st,
+// selected by BYDAY on its own in a YEARLY rule. Ordinals such as 1MO count
+// within the whole year.
+func (r Rule) daysInYear(year int) []int {
+	last := time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+	return r.weekdays(time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC).Weekday(), last)
+}
+
+// weekdays returns the days from 1 to last selected by BYDAY, where day 1
+// falls on firstWeekday.
+func (r Rule) weekdays(firstWeekday time.Weekday, last int) []int {
+	var days []int
+	for _, byDay := range r.ByDay {
+		// Every day falling on byDay.Day
+		var matching []int
+		for d := 1 + (int(byDay.Day)-int(firstWeekday)+7)%7; d <= last; d += 7 {
+			matching = append(matching, d)
+		}
+		switch {
+		case byDay.N == 0:
+			days = append(days, matching...)
+		case byDay.N > 0 && byDay.N <= len(matching):
+			days = append(days, matching[byDay.N-1])
+		case byDay.N < 0 && -byDay.N <= len(matching):
+			days = append(days, matching[len(matching)+byDay.N])
+		}
+	}
+	return days
+}
+
+func (r Rule) matchesMonth(month time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, m := range r.ByMonth {
+		if m == month {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matchesMonthDay(t time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, d := range r.ByMonthDay {
+		if d == t.Day() || (d < 0 && last+d+1 == t.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matchesWeekday(weekday time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, day := range r.ByDay {
+		if day.Day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOccurrence returns the action to create when a recurring action is
+// completed at now, or false if its recurrence has ended. The next
+// occurrence is the first one after both now and the occurrence being
+// completed, so finishing a chore early doesn't bring it straight back. The
+// new action is deferred until its date. Occurrences keep the wall clock
+// time of the start in loc.
+func nextOccurrence(action NextAction, now time.Time, loc *time.Location) (NextAction, bool, error) {
+	if action.Recurrence == "" {
+		return NextAction{}, false, nil
+	}
+	rule, err := ParseRule(action.Recurrence, loc)
+	if err != nil {
+		return NextAction{}, false, err
+	}
+	start, err := time.Parse(time.RFC3339, action.RecurrenceStart)
+	if err != nil {
+		return NextAction{}, false, fmt.Errorf("invalid recurrence start: %w", err)
+	}
+
+	after := now
+	if occursAt, err := time.Parse(time.RFC3339, action.OccursAt); err == nil && occursAt.After(after) {
+		after = occursAt
+	}
+	next, ok := rule.Next(start.In(loc), after)
+	if !ok {
+		return NextAction{}, false, nil
+	}
+
+	occursAt := next.UTC().Format(time.RFC3339)
+	return NextAction{
+		Action:          action.Action,
+		ProjectID:       action.ProjectID,
+		URL:             action.URL,
+		Size:            action.Size,
+		Energy:          action.Energy,
+		Contexts:        action.Contexts,
+		Recurrence:      action.Recurrence,
+		RecurrenceStart: action.RecurrenceStart,
+		OccursAt:        occursAt,
+		DeferUntil:      occursAt,
+	}, true, nil
+}
+
+// parseRecurrenceStart parses the start of a recurrence given by a client,
+// either a YYYY-MM-DD date (midnight in loc) or an RFC 3339 timestamp. An
+// empty string means the start of today.
+func parseRecurrenceStart(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		year, month, day := time.Now().In(loc).Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("recurrence_start must be a YYYY-MM-DD date or an RFC 3339 timestamp")
+	}
+	return t.In(loc), nil
+}
+
+// scheduleRecurrence validates a recurrence rule and start given by a client
+// and returns the values to store: the canonical rule, the start and the
+// first occurrence, all empty if rule is empty.
+func scheduleRecurrence(rule string, start string, loc *time.Location) (recurrence, recurrenceStart, occursAt string, err error) {
+	if strings.TrimSpace(rule) == "" {
+		return "", "", "", nil
+	}
+	parsed, err := ParseRule(rule, loc)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid recurrence: %w", err)
+	}
+	startTime, err := parseRecurrenceStart(start, loc)
+	if err != nil {
+		return "", "", "", err
+	}
+	first, ok := parsed.Next(startTime, startTime.Add(-time.Nanosecond))
+	if !ok {
+		return "", "", "", errors.New("invalid recurrence: the rule has no occurrences")
+	}
+	return parsed.String(), startTime.UTC().Format(time.RFC3339), first.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+	_ "time/tzdata" // the time zones below, on machines without them
+)
+
+// TestNextOccurrence completes the first occurrence of a recurring action
+// right away and checks when the next one is due.
+func TestNextOccurrence(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		loc   *time.Location
+		rule  string
+		start string
+		want  string // UTC
+	}{
+		{"daily into daylight saving time", newYork, "FREQ=DAILY", "2024-03-09T09:00:00-05:00", "2024-03-10T13:00:00Z"},
+		{"daily out of daylight saving time", newYork, "FREQ=DAILY", "2024-11-02T09:00:00-04:00", "2024-11-03T14:00:00Z"},
+		{"daily at a time skipped by the clocks", newYork, "FREQ=DAILY", "2024-03-09T02:30:00-05:00", "2024-03-10T07:30:00Z"},
+		{"weekly across daylight saving time", warsaw, "FREQ=WEEKLY", "2024-03-25T08:00:00+01:00", "2024-04-01T06:00:00Z"},
+		{"same rule in another time zone", warsaw, "FREQ=DAILY", "2024-03-09", "2024-03-09T23:00:00Z"},
+		{"daily from a plain date", newYork, "FREQ=DAILY", "2024-03-09", "2024-03-10T05:00:00Z"},
+		{"monthly on the 31st skips February", newYork, "FREQ=MONTHLY", "2024-01-31", "2024-03-31T04:00:00Z"},
+		{"monthly on the last day", newYork, "FREQ=MONTHLY;BYMONTHDAY=-1", "2024-01-31", "2024-02-29T05:00:00Z"},
+		{"monthly on the 30th in a short year", newYork, "FREQ=MONTHLY;BYMONTHDAY=30", "2023-01-30", "2023-03-30T04:00:00Z"},
+		{"yearly on February 29th", newYork, "FREQ=YEARLY", "2024-02-29", "2028-02-29T05:00:00Z"},
+		{"until a date in the time zone", warsaw, "FREQ=DAILY;UNTIL=20240310", "2024-03-09T00:30:00+01:00", "2024-03-09T23:30:00Z"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recurrence, start, occursAt, err := scheduleRecurrence(test.rule, test.start, test.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			completedAt, err := time.Parse(time.RFC3339, occursAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			action := NextAction{Action: "Chore", Recurrence: recurrence, RecurrenceStart: start, OccursAt: occursAt}
+			next, ok, err := nextOccurrence(action, completedAt, test.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("no occurrence after %s, want %s", occursAt, test.want)
+			}
+			if next.OccursAt != test.want || next.DeferUntil != test.want {
+				t.Errorf("next occurrence after %s: got %s deferred until %s, want %s", occursAt, next.OccursAt, next.DeferUntil, test.want)
+			}
+		})
+	}
+}
+
+// TestRecurrenceEnds stops at UNTIL, which for a date includes the whole
+// day in the time zone of the rule but not the first hours of the next one,
+// though they are still on that day in UTC.
+func TestRecurrenceEnds(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recurrence, start, occursAt, err := scheduleRecurrence("FREQ=DAILY;UNTIL=20240310", "2024-03-10T00:30:00+01:00", warsaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completedAt, _ := time.Parse(time.RFC3339, occursAt)
+	action := NextAction{Action: "Chore", Recurrence: recurrence, RecurrenceStart: start, OccursAt: occursAt}
+	if next, ok, err := nextOccurrence(action, completedAt, warsaw); err != nil || ok {
+		t.Errorf("got next occurrence %s (%v), want none after the last day", next.OccursAt, err)
+	}
+}
+
+// TestOccurrences lists the first occurrences of rules across daylight
+// saving time changes and the ends of months.
+func TestOccurrences(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []string // UTC
+	}{
+		{"daily into daylight saving time", "FREQ=DAILY", time.Date(2024, 3, 9, 9, 0, 0, 0, newYork),
+			[]string{"2024-03-09T14:00:00Z", "2024-03-10T13:00:00Z", "2024-03-11T13:00:00Z"}},
+		{"daily out of daylight saving time", "FREQ=DAILY", time.Date(2024, 11, 2, 9, 0, 0, 0, newYork),
+			[]string{"2024-11-02T13:00:00Z", "2024-11-03T14:00:00Z", "2024-11-04T14:00:00Z"}},
+		{"weekly across daylight saving time", "FREQ=WEEKLY", time.Date(2024, 3, 25, 8, 0, 0, 0, warsaw),
+			[]string{"2024-03-25T07:00:00Z", "2024-04-01T06:00:00Z", "2024-04-08T06:00:00Z"}},
+		{"monthly on the 31st skips short months", "FREQ=MONTHLY", time.Date(2024, 1, 31, 0, 0, 0, 0, newYork),
+			[]string{"2024-01-31T05:00:00Z", "2024-03-31T04:00:00Z", "2024-05-31T04:00:00Z"}},
+		{"monthly on the last day", "FREQ=MONTHLY;BYMONTHDAY=-1", time.Date(2024, 1, 31, 0, 0, 0, 0, newYork),
+			[]string{"2024-01-31T05:00:00Z", "2024-02-29T05:00:00Z", "2024-03-31T04:00:00Z"}},
+		{"monthly on the 30th in a short year", "FREQ=MONTHLY;BYMONTHDAY=30", time.Date(2023, 1, 30, 0, 0, 0, 0, newYork),
+			[]string{"2023-01-30T05:00:00Z", "2023-03-30T04:00:00Z", "2023-04-30T04:00:00Z"}},
+		{"yearly on February 29th", "FREQ=YEARLY", time.Date(2024, 2, 29, 0, 0, 0, 0, newYork),
+			[]string{"2024-02-29T05:00:00Z", "2028-02-29T05:00:00Z", "2032-02-29T05:00:00Z"}},
+		{"yearly on a month day is every month", "FREQ=YEARLY;BYMONTHDAY=1", time.Date(2024, 1, 1, 0, 0, 0, 0, newYork),
+			[]string{"2024-01-01T05:00:00Z", "2024-02-01T05:00:00Z", "2024-03-01T05:00:00Z"}},
+		{"yearly on a weekday is every week", "FREQ=YEARLY;BYDAY=MO", time.Date(2024, 1, 1, 0, 0, 0, 0, newYork),
+			[]string{"2024-01-01T05:00:00Z", "2024-01-08T05:00:00Z", "2024-01-15T05:00:00Z"}},
+		{"yearly on the first weekday of the year", "FREQ=YEARLY;BYDAY=1MO", time.Date(2024, 1, 1, 0, 0, 0, 0, newYork),
+			[]string{"2024-01-01T05:00:00Z", "2025-01-06T05:00:00Z", "2026-01-05T05:00:00Z"}},
+		{"yearly on the last weekday of the year", "FREQ=YEARLY;BYDAY=-1FR", time.Date(2024, 12, 27, 0, 0, 0, 0, newYork),
+			[]string{"2024-12-27T05:00:00Z", "2025-12-26T05:00:00Z", "2026-12-25T05:00:00Z"}},
+		{"yearly on a weekday of a month", "FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", time.Date(2024, 11, 28, 0, 0, 0, 0, newYork),
+			[]string{"2024-11-28T05:00:00Z", "2025-11-27T05:00:00Z", "2026-11-26T05:00:00Z"}},
+		{"weekly on weekdays with a count", "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3", time.Date(2024, 3, 29, 18, 0, 0, 0, warsaw),
+			[]string{"2024-03-29T17:00:00Z", "2024-04-01T16:00:00Z", "2024-04-05T16:00:00Z"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := ParseRule(test.rule, test.start.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, occurrence := range rule.Occurrences(test.start, test.start.Add(-time.Second), len(test.want)+1) {
+				got = append(got, occurrence.UTC().Format(time.RFC3339))
+			}
+			if rule.Count == 0 {
+				got = got[:len(test.want)]
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestParseRuleErrors rejects rules outside the supported subset.
+func TestParseRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=DAILY;COUNT=2;UNTIL=20240101",
+	} {
+		if _, err := ParseRule(rule, time.UTC); err == nil {
+			t.Errorf("%q: got no error", rule)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server holds the dependencies shared by the HTTP handlers.
+type Server struct {
+	store           Store
+	manager         *ClientManager
+	insecureCookies bool           // send session cookies over plain HTTP too
+	location        *time.Location // time zone of plain dates and recurrence rules
+}
+
+func NewServer(store Store, manager *ClientManager) *Server {
+	return &Server{store: store, manager: manager, location: time.Local}
+}
+
+// RegisterAuthRoutes adds the routes for logging in and out, which don't
+// need a login, to the given router group.
+func (s *Server) RegisterAuthRoutes(api *gin.RouterGroup) {
+	api.POST("/login", s.Login)
+	api.POST("/logout", s.Logout)
+}
+
+// RegisterRoutes adds the API routes to the given router group.
+func (s *Server) RegisterRoutes(api *gin.RouterGroup) {
+	api.GET("/me", s.CurrentUser)
+	api.GET("/projects", s.GetProjects)
+	api.POST("/projects", s.CreateProject)
+	api.PATCH("/projects/:id", s.UpdateProject)
+	api.DELETE("/projects/:id", s.DeleteProject)
+	api.POST("/projects/:id/move", s.MoveProject)
+	api.GET("/projects/:id/next-actions", s.GetProjectNextActions)
+	api.POST("/projects/:id/next-actions/:action_id/move", s.MoveProjectNextAction)
+	api.GET("/projects/:id/history", s.GetProjectHistory)
+	// Next Actions
+	api.GET("/next-actions", s.GetNextActions)
+	api.POST("/next-actions", s.CreateNextAction)
+	api.PATCH("next-actions/:id", s.UpdateNextAction)
+	api.DELETE("next-actions/:id", s.DeleteNextAction)
+	api.POST("/next-actions/:id/move", s.MoveNextAction)
+	api.GET("/next-actions/:id/history", s.GetNextActionHistory)
+	api.GET("/recurrence/preview", s.PreviewRecurrence)
+	// Contexts
+	api.GET("/contexts", s.GetContexts)
+	api.POST("/contexts", s.CreateContext)
+	api.PATCH("/contexts/:id", s.UpdateContext)
+	api.DELETE("/contexts/:id", s.DeleteContext)
+	// Waiting For
+	api.GET("/waiting-for", s.GetWaitingFor)
+	api.POST("/waiting-for", s.CreateWaitingFor)
+	api.PATCH("/waiting-for/:id", s.UpdateWaitingFor)
+	api.DELETE("/waiting-for/:id", s.DeleteWaitingFor)
+	// Someday/Maybe
+	api.GET("/someday", s.GetSomeday)
+	api.POST("/someday", s.CreateSomeday)
+	api.PATCH("/someday/:id", s.UpdateSomeday)
+	api.DELETE("/someday/:id", s.DeleteSomeday)
+	api.POST("/someday/:id/promote", s.PromoteSomeday)
+	// Reference
+	api.GET("/reference", s.GetReference)
+	api.POST("/reference", s.CreateReference)
+	api.DELETE("/reference/:id", s.DeleteReference)
+	// Inbox
+	api.GET("/inbox", s.GetInboxItems)
+	api.POST("/inbox", s.CreateInboxItem)
+	api.PATCH("/inbox/:id", s.UpdateInboxItem)
+	api.DELETE("/inbox/:id", s.DeleteInboxItem)
+	api.POST("/inbox/:id/defer", s.DeferInboxItem)
+	api.POST("/inbox/:id/waiting-for", s.ConvertInboxItemToWaitingFor)
+	api.POST("/inbox/:id/process", s.ProcessInboxItem)
+	// Trash
+	api.GET("/trash", s.GetTrash)
+	api.POST("/trash/:type/:id/restore", s.RestoreTrash)
+	// Changes to every record, latest first
+	api.GET("/activity", s.GetActivity)
+	// Undo history of the client's session
+	api.POST("/undo", s.Undo)
+	api.POST("/redo", s.Redo)
+
+	// WebSocket
+	api.GET("/ws", s.manager.HandleWebSocket)
+	api.GET("/ws/metrics", s.manager.HandleMetrics)
+	// Server-Sent Events, for clients that can't use the websocket
+	api.GET("/events", s.manager.HandleEvents)
+}
@@ -0,0 +1,2250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var _ Store = (*SQLStore)(nil)
+
+// sqlConn is implemented by both *sql.DB and *sql.Tx.
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlRunner runs queries written with ? placeholders against a database or
+// a transaction, rebinding them for the dialect. Inside a transaction it
+// also collects the events of the changes made.
+type sqlRunner struct {
+	conn    sqlConn
+	dialect Dialect
+	events  *[]Event
+}
+
+func (r sqlRunner) exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.conn.Exec(r.dialect.Rebind(query), args...)
+}
+
+func (r sqlRunner) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.conn.Query(r.dialect.Rebind(query), args...)
+}
+
+func (r sqlRunner) queryRow(query string, args ...interface{}) *sql.Row {
+	return r.conn.QueryRow(r.dialect.Rebind(query), args...)
+}
+
+// SQLStore is the Store backed by a database opened by InitDB. Changes are
+// published to events once committed.
+type SQLStore struct {
+	sqlRunner
+	db     *sql.DB
+	events *EventBus
+	tx     *sqlRunner // the transaction of a store passed to Atomically
+
+	// publishing is held from committing a transaction with events until
+	// they are published. Transactions number their events in the order
+	// they commit, so this publishes them in the order of their numbers.
+	publishing sync.Mutex
+}
+
+func NewSQLStore(db *sql.DB, dialect Dialect, events *EventBus) *SQLStore {
+	return &SQLStore{sqlRunner: sqlRunner{conn: db, dialect: dialect}, db: db, events: events}
+}
+
+// maxTxAttempts is how many times inTx runs a transaction that keeps
+// failing because of concurrent ones.
+const maxTxAttempts = 5
+
+// inTx runs fn inside a transaction, committing it if fn returns nil and
+// rolling it back otherwise. Transactions that fail because of a concurrent
+// one are retried from the start, so fn must not carry anything over from
+// one run to the next, such as results appended to a slice declared outside.
+func (s *SQLStore) inTx(fn func(tx sqlRunner) error) error {
+	// Inside Atomically, changes are part of its transaction
+	if s.tx != nil {
+		return fn(*s.tx)
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 10 * time.Millisecond)
+		}
+		if err = s.runTx(fn); !s.dialect.Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *SQLStore) Atomically(fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.inTx(func(tx sqlRunner) error {
+		return fn(&SQLStore{sqlRunner: tx, db: s.db, events: s.events, tx: &tx})
+	})
+}
+
+func (s *SQLStore) runTx(fn func(tx sqlRunner) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: s.dialect.isolation})
+	if err != nil {
+		return err
+	}
+	events := []Event{}
+	if err := fn(sqlRunner{conn: tx, dialect: s.dialect, events: &events}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(events) > 0 {
+		s.publishing.Lock()
+		defer s.publishing.Unlock()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.events.Publish(events)
+	return nil
+}
+
+// emit records the event of a change made in the transaction, bumping the
+// revision of the entity. Created and updated entities are read back as they
+// are now, so emit comes after the change.
+func (r sqlRunner) emit(entity string, change string, id string) error {
+	var data any
+	var err error
+	if change != EventDeleted {
+		if data, err = r.getEntity(entity, id); err != nil {
+			return err
+		}
+	}
+
+	// The revision keeps the scopes of the entity for its next event
+	var stored sql.NullString
+	err = r.queryRow("SELECT scopes FROM revisions WHERE entity = ? AND entity_id = ?", entity, id).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	before, err := decodeScopes(stored)
+	if err != nil {
+		return err
+	}
+	after := entityScopes(data)
+	encoded, err := encodeScopes(after)
+	if err != nil {
+		return err
+	}
+
+	var revision int64
+	err = r.queryRow(`
+		INSERT INTO revisions (entity, entity_id, revision, scopes) VALUES (?, ?, 1, ?)
+		ON CONFLICT (entity, entity_id) DO UPDATE SET revision = revisions.revision + 1, scopes = excluded.scopes
+		RETURNING revision`, entity, id, encoded).Scan(&revision)
+	if err != nil {
+		return err
+	}
+	event := newEvent(entity, change, id, revision, data)
+	event.Scopes = eventScopes(before, after)
+	if err := r.logEvent(&event); err != nil {
+		return err
+	}
+	*r.events = append(*r.events, event)
+	return nil
+}
+
+// logEvent adds an event to the event log, filling in its sequence number,
+// and drops the events beyond the latest maxEvents. Numbers come from the
+// event_counter row, which stays locked until the transaction ends, so a
+// transaction can't commit a number lower than one already visible and
+// clients catching up never skip an event.
+func (r sqlRunner) logEvent(event *Event) error {
+	var data interface{}
+	if event.Data != nil {
+		encoded, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+
+	scopes, err := encodeScopes(event.Scopes)
+	if err != nil {
+		return err
+	}
+
+	if err := r.queryRow("UPDATE event_counter SET seq = seq + 1 RETURNING seq").Scan(&event.Sequence); err != nil {
+		return err
+	}
+	_, err = r.exec(`
+		INSERT INTO events (seq, version, type, entity, entity_id, revision, created_at, data, scopes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Sequence, event.Version, event.Type, event.Entity, event.EntityID, event.Revision, event.Timestamp, data, scopes)
+	if err != nil {
+		return err
+	}
+	_, err = r.exec("DELETE FROM events WHERE seq <= ?", event.Sequence-maxEvents)
+	return err
+}
+
+// encodeScopes stores event scopes as a JSON array, or NULL if there are
+// none.
+func encodeScopes(scopes []string) (any, error) {
+	if len(scopes) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(scopes)
+	return string(data), err
+}
+
+func decodeScopes(value sql.NullString) ([]string, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	var scopes []string
+	err := json.Unmarshal([]byte(value.String), &scopes)
+	return scopes, err
+}
+
+// emitAll records the same change to several entities of a kind.
+func (r sqlRunner) emitAll(entity string, change string, ids []string) error {
+	for _, id := range ids {
+		if err := r.emit(entity, change, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r sqlRunner) getEntity(entity string, id string) (any, error) {
+	switch entity {
+	case EntityProject:
+		return r.getProject(id)
+	case EntityNextAction:
+		return r.getNextAction(id)
+	case EntityContext:
+		return r.getContext(id)
+	case EntityWaitingFor:
+		return r.getWaitingFor(id)
+	case EntitySomeday:
+		return r.getSomeday(id)
+	case EntityReference:
+		return r.getReference(id)
+	case EntityInbox:
+		return r.getInboxItem(id)
+	}
+	return nil, fmt.Errorf("unknown entity %q", entity)
+}
+
+// selectIDs returns the IDs selected by a query.
+func (r sqlRunner) selectIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// nullString maps empty strings to NULL so optional columns stay NULL
+// instead of holding empty values.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// checkAffected turns an UPDATE or DELETE that matched no rows into ErrNotFound.
+func checkAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const projectColumns = "id, name, position, created_at, deadline, status, completed_at, inbox_item_id"
+
+func scanProject(row scanner) (Project, error) {
+	var project Project
+	var deadline, completedAt, inboxItemID sql.NullString
+	if err := row.Scan(&project.ID, &project.Name, &project.Position, &project.CreatedAt, &deadline,
+		&project.Status, &completedAt, &inboxItemID); err != nil {
+		return Project{}, err
+	}
+	project.Deadline = deadline.String
+	project.CompletedAt = completedAt.String
+	project.InboxItemID = inboxItemID.String
+	return project, nil
+}
+
+// placeholders returns n comma separated ? placeholders for an IN clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (s *SQLStore) ListProjects(filter ProjectFilter) ([]Project, error) {
+	query := "SELECT " + projectColumns + " FROM projects WHERE deleted_at IS NULL"
+	var params []interface{}
+	if len(filter.Statuses) > 0 {
+		query += " AND status IN (" + placeholders(len(filter.Statuses)) + ")"
+		for _, status := range filter.Statuses {
+			params = append(params, status)
+		}
+	}
+	query += " ORDER BY position"
+
+	rows, err := s.query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+func (r sqlRunner) getProject(id string) (Project, error) {
+	project, err := scanProject(r.queryRow("SELECT "+projectColumns+" FROM projects WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return Project{}, ErrNotFound
+	}
+	return project, err
+}
+
+func (s *SQLStore) GetProject(id string) (Project, error) {
+	return s.getProject(id)
+}
+
+func (r sqlRunner) insertProject(project *Project) error {
+	if project.ID == "" {
+		project.ID = uuid.New().String()
+	}
+	project.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if project.Status == "" {
+		project.Status = ProjectActive
+	}
+	project.CompletedAt = ""
+	if project.Status == ProjectCompleted {
+		project.CompletedAt = project.CreatedAt
+	}
+
+	var err error
+	if project.Position, err = r.nextPosition(allProjects); err != nil {
+		return err
+	}
+
+	_, err = r.exec("INSERT INTO projects (id, name, position, deadline, created_at, status, completed_at, inbox_item_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		project.ID, project.Name, project.Position, nullString(project.Deadline), project.CreatedAt,
+		project.Status, nullString(project.CompletedAt), nullString(project.InboxItemID))
+	if err != nil {
+		return err
+	}
+	return r.emit(EntityProject, EventCreated, project.ID)
+}
+
+func (s *SQLStore) CreateProject(project *Project) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.insertProject(project)
+	})
+}
+
+func (s *SQLStore) UpdateProject(id string, update ProjectUpdate) (Project, error) {
+	var project Project
+	err := s.inTx(func(tx sqlRunner) error {
+		current, err := tx.getProject(id)
+		if err != nil {
+			return err
+		}
+
+		query := "UPDATE projects SET"
+		var params []interface{}
+		var setFields []string
+
+		if update.Position != nil {
+			if err := tx.checkPosition(allProjects, *update.Position, id); err != nil {
+				return err
+			}
+			setFields = append(setFields, " position = ?")
+			params = append(params, *update.Position)
+		}
+		if update.Deadline != nil {
+			setFields = append(setFields, " deadline = ?")
+			params = append(params, nullString(*update.Deadline))
+		}
+		if update.Status != nil && *update.Status != current.Status {
+			if !canTransitionProject(current.Status, *update.Status) {
+				return ErrInvalidTransition
+			}
+			setFields = append(setFields, " status = ?", " completed_at = ?")
+			params = append(params, *update.Status, nil)
+			if *update.Status == ProjectCompleted {
+				params[len(params)-1] = time.Now().UTC().Format(time.RFC3339)
+			}
+		}
+
+		if len(setFields) > 0 {
+			// Combine all set fields and add WHERE clause
+			for i := 0; i < len(setFields)-1; i++ {
+				query += setFields[i] + ","
+			}
+			query += setFields[len(setFields)-1] + " WHERE id = ?"
+			params = append(params, id)
+
+			if _, err := tx.exec(query, params...); err != nil {
+				return err
+			}
+			if err := tx.emit(EntityProject, EventUpdated, id); err != nil {
+				return err
+			}
+		}
+
+		project, err = tx.getProject(id)
+		return err
+	})
+	return project, err
+}
+
+func (s *SQLStore) MoveProject(id string, move Move) (Project, error) {
+	var project Project
+	err := s.inTx(func(tx sqlRunner) error {
+		if err := tx.moveRecord(allProjects, id, move); err != nil {
+			return err
+		}
+		var err error
+		project, err = tx.getProject(id)
+		return err
+	})
+	return project, err
+}
+
+// sqlList is a list of records ordered by a position column: the projects,
+// all next actions, or the next actions of one project. Records in the
+// trash are part of the list, since they keep their position.
+type sqlList struct {
+	entity string
+	table  string
+	column string
+	where  string // condition selecting the records of the list, if any
+	args   []interface{}
+}
+
+var (
+	allProjects    = sqlList{entity: EntityProject, table: "projects", column: "position"}
+	allNextActions = sqlList{entity: EntityNextAction, table: "next_actions", column: "position"}
+)
+
+// projectActions is the list of the next actions of a project.
+func projectActions(projectID string) sqlList {
+	return sqlList{entity: EntityNextAction, table: "next_actions", column: "project_position",
+		where: "project_id = ?", args: []interface{}{projectID}}
+}
+
+// filter returns a WHERE clause selecting the records of the list that also
+// match cond, together with its parameters followed by args.
+func (l sqlList) filter(cond string, args ...interface{}) (string, []interface{}) {
+	conds := []string{}
+	if l.where != "" {
+		conds = append(conds, l.where)
+	}
+	if cond != "" {
+		conds = append(conds, cond)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), append(slices.Clone(l.args), args...)
+}
+
+// nextPosition returns the position after the last record of the list.
+func (r sqlRunner) nextPosition(list sqlList) (float64, error) {
+	where, params := list.filter("")
+	var maxPosition sql.NullFloat64
+	err := r.queryRow("SELECT MAX("+list.column+") FROM "+list.table+where, params...).Scan(&maxPosition)
+	return maxPosition.Float64 + 1.0, err
+}
+
+// checkPosition returns ErrConflict if a record of the list other than id
+// already has the given position.
+func (r sqlRunner) checkPosition(list sqlList, position float64, id string) error {
+	where, params := list.filter(list.column+" = ? AND id <> ?", position, id)
+	var count int
+	if err := r.queryRow("SELECT COUNT(*) FROM "+list.table+where, params...).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: position %v is taken", ErrConflict, position)
+	}
+	return nil
+}
+
+// moveRecord moves a record of the list to the place given by move,
+// renumbering the list if planMove says so.
+func (r sqlRunner) moveRecord(list sqlList, id string, move Move) error {
+	where, params := list.filter("")
+	rows, err := r.query("SELECT id, "+list.column+", deleted_at FROM "+list.table+where+" ORDER BY "+list.column, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	records := []positioned{}
+	for rows.Next() {
+		var record positioned
+		var deletedAt sql.NullString
+		if err := rows.Scan(&record.ID, &record.Position, &deletedAt); err != nil {
+			return err
+		}
+		record.Trashed = deletedAt.Valid
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	position, rebalanced, err := planMove(records, id, move)
+	if err != nil {
+		return err
+	}
+	update := "UPDATE " + list.table + " SET " + list.column + " = ? WHERE id = ?"
+	if rebalanced == nil {
+		if _, err := r.exec(update, position, id); err != nil {
+			return err
+		}
+		return r.emit(list.entity, EventUpdated, id)
+	}
+
+	// Positions are unique, so every record first goes past both its old
+	// and its new position
+	offset := max(records[len(records)-1].Position, float64(len(records)))
+	for i, record := range rebalanced {
+		if _, err := r.exec(update, offset+float64(i+1), record.ID); err != nil {
+			return err
+		}
+	}
+	for _, record := range rebalanced {
+		if _, err := r.exec(update, record.Position, record.ID); err != nil {
+			return err
+		}
+	}
+	for _, record := range rebalanced {
+		if record.Trashed {
+			continue
+		}
+		if err := r.emit(list.entity, EventUpdated, record.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkProjectRef returns ErrInvalidReference unless id names a project
+// that isn't in the trash.
+func (r sqlRunner) checkProjectRef(id string) error {
+	_, err := r.getProject(id)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w: project %s does not exist", ErrInvalidReference, id)
+	}
+	return err
+}
+
+func (s *SQLStore) DeleteProject(id string, deletion ProjectDeletion) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.inTx(func(tx sqlRunner) error {
+		result, err := tx.exec("UPDATE projects SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", now, id)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(result); err != nil {
+			return err
+		}
+
+		var set string
+		var params []interface{}
+		switch deletion.Actions {
+		case ProjectActionsOrphan:
+			set = "project_id = NULL"
+		case ProjectActionsDelete:
+			set, params = "deleted_at = ?", []interface{}{now}
+		case ProjectActionsMove:
+			// The deleted project is already in the trash, so it can't
+			// receive its own records
+			if err := tx.checkProjectRef(deletion.MoveTo); err != nil {
+				return err
+			}
+			set, params = "project_id = ?", []interface{}{deletion.MoveTo}
+		default:
+			return fmt.Errorf("unknown project deletion policy %q", deletion.Actions)
+		}
+		params = append(params, id)
+
+		// Next actions that leave the project leave its list too. Handed
+		// over actions are listed in their order within the project.
+		actionsSet := set
+		if deletion.Actions != ProjectActionsDelete {
+			actionsSet += ", project_position = NULL"
+		}
+		actionIDs, err := tx.selectIDs("SELECT id FROM next_actions WHERE project_id = ? AND deleted_at IS NULL ORDER BY project_position", id)
+		if err != nil {
+			return err
+		}
+		waitingForIDs, err := tx.selectIDs("SELECT id FROM waiting_for WHERE project_id = ? AND deleted_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+
+		for table, set := range map[string]string{"next_actions": actionsSet, "waiting_for": set} {
+			if _, err := tx.exec("UPDATE "+table+" SET "+set+" WHERE project_id = ? AND deleted_at IS NULL", params...); err != nil {
+				return err
+			}
+		}
+
+		// Handed over actions keep their order at the end of the list of
+		// the project receiving them
+		if deletion.Actions == ProjectActionsMove {
+			for _, actionID := range actionIDs {
+				position, err := tx.nextPosition(projectActions(deletion.MoveTo))
+				if err != nil {
+					return err
+				}
+				if _, err := tx.exec("UPDATE next_actions SET project_position = ? WHERE id = ?", position, actionID); err != nil {
+					return err
+				}
+			}
+		}
+
+		change := EventUpdated
+		if deletion.Actions == ProjectActionsDelete {
+			change = EventDeleted
+		}
+		if err := tx.emitAll(EntityNextAction, change, actionIDs); err != nil {
+			return err
+		}
+		if err := tx.emitAll(EntityWaitingFor, change, waitingForIDs); err != nil {
+			return err
+		}
+		return tx.emit(EntityProject, EventDeleted, id)
+	})
+}
+
+const nextActionColumns = "id, action, project_id, url, size, energy, created_at, completed_at, position, defer_until, recurrence, recurrence_start, occurs_at, inbox_item_id, project_position"
+
+func scanNextAction(row scanner) (NextAction, error) {
+	var action NextAction
+	var size, energy, projectID, url, completedAt, deferUntil sql.NullString
+	var recurrence, recurrenceStart, occursAt, inboxItemID sql.NullString
+	var projectPosition sql.NullFloat64
+	if err := row.Scan(&action.ID, &action.Action, &projectID, &url, &size,
+		&energy, &action.CreatedAt, &completedAt, &action.Position, &deferUntil,
+		&recurrence, &recurrenceStart, &occursAt, &inboxItemID, &projectPosition); err != nil {
+		return NextAction{}, err
+	}
+	if projectPosition.Valid {
+		action.ProjectPosition = &projectPosition.Float64
+	}
+
+	// NULL columns are reported as empty strings
+	action.Size = size.String
+	action.Energy = energy.String
+	action.ProjectID = projectID.String
+	action.URL = url.String
+	action.CompletedAt = completedAt.String
+	action.DeferUntil = deferUntil.String
+	action.Recurrence = recurrence.String
+	action.RecurrenceStart = recurrenceStart.String
+	action.OccursAt = occursAt.String
+	action.InboxItemID = inboxItemID.String
+	return action, nil
+}
+
+func (s *SQLStore) ListNextActions(filter NextActionFilter) ([]NextAction, error) {
+	query := "SELECT " + nextActionColumns + " FROM next_actions WHERE deleted_at IS NULL"
+	var params []interface{}
+	if filter.Context != "" {
+		query += ` AND id IN (
+			SELECT nac.next_action_id FROM next_action_contexts nac
+			JOIN contexts c ON c.id = nac.context_id
+			WHERE c.name = ?)`
+		params = append(params, filter.Context)
+	}
+	if !filter.IncludeDeferred {
+		query += " AND (defer_until IS NULL OR defer_until <= ?)"
+		params = append(params, time.Now().UTC().Format(time.RFC3339))
+	}
+	if filter.ProjectID != "" {
+		query += " AND project_id = ? ORDER BY project_position"
+		params = append(params, filter.ProjectID)
+	} else {
+		query += " ORDER BY position"
+	}
+
+	rows, err := s.query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []NextAction{}
+	for rows.Next() {
+		action, err := scanNextAction(rows)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadContexts(actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+// loadContexts fills in the context names of the given actions.
+func (r sqlRunner) loadContexts(actions []NextAction) error {
+	query := `
+		SELECT nac.next_action_id, c.name FROM next_action_contexts nac
+		JOIN contexts c ON c.id = nac.context_id`
+	var params []interface{}
+	if len(actions) == 1 {
+		query += " WHERE nac.next_action_id = ?"
+		params = append(params, actions[0].ID)
+	}
+	query += " ORDER BY c.name"
+
+	rows, err := r.query(query, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	names := make(map[string][]string)
+	for rows.Next() {
+		var actionID, name string
+		if err := rows.Scan(&actionID, &name); err != nil {
+			return err
+		}
+		names[actionID] = append(names[actionID], name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range actions {
+		actions[i].Contexts = names[actions[i].ID]
+		if actions[i].Contexts == nil {
+			actions[i].Contexts = []string{}
+		}
+	}
+	return nil
+}
+
+// setContexts replaces the contexts of an action, creating contexts that
+// don't exist yet.
+func (r sqlRunner) setContexts(actionID string, names []string) error {
+	if _, err := r.exec("DELETE FROM next_action_contexts WHERE next_action_id = ?", actionID); err != nil {
+		return err
+	}
+
+	for _, name := range normalizeContextNames(names) {
+		var contextID string
+		err := r.queryRow("SELECT id FROM contexts WHERE name = ?", name).Scan(&contextID)
+		created := err == sql.ErrNoRows
+		if created {
+			contextID = uuid.New().String()
+			_, err = r.exec("INSERT INTO contexts (id, name, created_at) VALUES (?, ?, ?)",
+				contextID, name, time.Now().UTC().Format(time.RFC3339))
+		}
+		if err != nil {
+			return err
+		}
+		if created {
+			if err := r.emit(EntityContext, EventCreated, contextID); err != nil {
+				return err
+			}
+		}
+
+		_, err = r.exec("INSERT INTO next_action_contexts (next_action_id, context_id) VALUES (?, ?)", actionID, contextID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r sqlRunner) getNextAction(id string) (NextAction, error) {
+	action, err := scanNextAction(r.queryRow("SELECT "+nextActionColumns+" FROM next_actions WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return NextAction{}, ErrNotFound
+	}
+	if err != nil {
+		return NextAction{}, err
+	}
+
+	actions := []NextAction{action}
+	if err := r.loadContexts(actions); err != nil {
+		return NextAction{}, err
+	}
+	return actions[0], nil
+}
+
+func (s *SQLStore) GetNextAction(id string) (NextAction, error) {
+	return s.getNextAction(id)
+}
+
+func (s *SQLStore) CreateNextAction(action *NextAction) error {
+	return s.inTx(func(tx sqlRunner) error {
+		if action.ProjectID != "" {
+			if err := tx.checkProjectRef(action.ProjectID); err != nil {
+				return err
+			}
+		}
+		return tx.insertNextAction(action)
+	})
+}
+
+// insertNextAction adds action at the end of the list.
+func (r sqlRunner) insertNextAction(action *NextAction) error {
+	if action.ID == "" {
+		action.ID = uuid.New().String()
+	}
+	action.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	action.CompletedAt = ""
+	action.Contexts = normalizeContextNames(action.Contexts)
+
+	var err error
+	if action.Position, err = r.nextPosition(allNextActions); err != nil {
+		return err
+	}
+	action.ProjectPosition = nil
+	if action.ProjectID != "" {
+		projectPosition, err := r.nextPosition(projectActions(action.ProjectID))
+		if err != nil {
+			return err
+		}
+		action.ProjectPosition = &projectPosition
+	}
+
+	_, err = r.exec(`
+		INSERT INTO next_actions (id, action, project_id, url, size, energy, created_at, completed_at, position, defer_until,
+			recurrence, recurrence_start, occurs_at, inbox_item_id, project_position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		action.ID, action.Action, nullString(action.ProjectID), nullString(action.URL), nullString(action.Size),
+		nullString(action.Energy), action.CreatedAt, nil, action.Position, nullString(action.DeferUntil),
+		nullString(action.Recurrence), nullString(action.RecurrenceStart), nullString(action.OccursAt),
+		nullString(action.InboxItemID), action.ProjectPosition)
+	if err != nil {
+		return err
+	}
+	if err := r.setContexts(action.ID, action.Contexts); err != nil {
+		return err
+	}
+	return r.emit(EntityNextAction, EventCreated, action.ID)
+}
+
+func (s *SQLStore) UpdateNextAction(id string, update NextActionUpdate) (NextAction, error) {
+	query := "UPDATE next_actions SET"
+	var params []interface{}
+	var setFields []string
+
+	if update.Action != nil {
+		setFields = append(setFields, " action = ?")
+		params = append(params, *update.Action)
+	}
+	if update.ProjectID != nil {
+		setFields = append(setFields, " project_id = ?")
+		params = append(params, nullString(*update.ProjectID))
+	}
+	if update.URL != nil {
+		setFields = append(setFields, " url = ?")
+		params = append(params, nullString(*update.URL))
+	}
+	if update.Size != nil {
+		setFields = append(setFields, " size = ?")
+		params = append(params, nullString(*update.Size))
+	}
+	if update.Energy != nil {
+		setFields = append(setFields, " energy = ?")
+		params = append(params, nullString(*update.Energy))
+	}
+	if update.CompletedAt != nil {
+		setFields = append(setFields, " completed_at = ?")
+		params = append(params, nullString(*update.CompletedAt))
+	}
+	if update.Position != nil {
+		setFields = append(setFields, " position = ?")
+		params = append(params, *update.Position)
+	}
+	if update.DeferUntil != nil {
+		setFields = append(setFields, " defer_until = ?")
+		params = append(params, nullString(*update.DeferUntil))
+	}
+	if update.Recurrence != nil {
+		setFields = append(setFields, " recurrence = ?")
+		params = append(params, nullString(*update.Recurrence))
+	}
+	if update.RecurrenceStart != nil {
+		setFields = append(setFields, " recurrence_start = ?")
+		params = append(params, nullString(*update.RecurrenceStart))
+	}
+	if update.OccursAt != nil {
+		setFields = append(setFields, " occurs_at = ?")
+		params = append(params, nullString(*update.OccursAt))
+	}
+
+	if len(setFields) > 0 {
+		// Combine all set fields and add WHERE clause
+		for i := 0; i < len(setFields)-1; i++ {
+			query += setFields[i] + ","
+		}
+		query += setFields[len(setFields)-1] + " WHERE id = ?"
+		params = append(params, id)
+	}
+
+	var action NextAction
+	err := s.inTx(func(tx sqlRunner) error {
+		before, err := tx.getNextAction(id)
+		if err != nil {
+			return err
+		}
+		if update.ProjectID != nil && *update.ProjectID != "" {
+			if err := tx.checkProjectRef(*update.ProjectID); err != nil {
+				return err
+			}
+		}
+		if update.Position != nil {
+			if err := tx.checkPosition(allNextActions, *update.Position, id); err != nil {
+				return err
+			}
+		}
+
+		// An action changing projects leaves its place in the old project's
+		// list first, since the position may be taken in the new one
+		changesProject := update.ProjectID != nil && *update.ProjectID != before.ProjectID
+		if changesProject {
+			if _, err := tx.exec("UPDATE next_actions SET project_position = NULL WHERE id = ?", id); err != nil {
+				return err
+			}
+		}
+
+		if len(setFields) > 0 {
+			result, err := tx.exec(query, params...)
+			if err != nil {
+				return err
+			}
+			if err := checkAffected(result); err != nil {
+				return err
+			}
+		}
+
+		projectID := before.ProjectID
+		if update.ProjectID != nil {
+			projectID = *update.ProjectID
+		}
+		if projectID != "" && (changesProject || update.ProjectPosition != nil) {
+			var position float64
+			if update.ProjectPosition != nil {
+				if err := tx.checkPosition(projectActions(projectID), *update.ProjectPosition, id); err != nil {
+					return err
+				}
+				position = *update.ProjectPosition
+			} else if position, err = tx.nextPosition(projectActions(projectID)); err != nil {
+				return err
+			}
+			if _, err := tx.exec("UPDATE next_actions SET project_position = ? WHERE id = ?", position, id); err != nil {
+				return err
+			}
+		}
+
+		if update.Contexts != nil {
+			if err := tx.setContexts(id, *update.Contexts); err != nil {
+				return err
+			}
+		}
+		if err := tx.emit(EntityNextAction, EventUpdated, id); err != nil {
+			return err
+		}
+
+		action, err = tx.getNextAction(id)
+		return err
+	})
+	return action, err
+}
+
+func (s *SQLStore) MoveNextAction(id string, move Move) (NextAction, error) {
+	var action NextAction
+	err := s.inTx(func(tx sqlRunner) error {
+		if err := tx.moveRecord(allNextActions, id, move); err != nil {
+			return err
+		}
+		var err error
+		action, err = tx.getNextAction(id)
+		return err
+	})
+	return action, err
+}
+
+func (s *SQLStore) MoveProjectNextAction(projectID string, id string, move Move) (NextAction, error) {
+	var action NextAction
+	err := s.inTx(func(tx sqlRunner) error {
+		if err := tx.moveRecord(projectActions(projectID), id, move); err != nil {
+			return err
+		}
+		var err error
+		action, err = tx.getNextAction(id)
+		return err
+	})
+	return action, err
+}
+
+// DeleteNextAction moves an action to the trash. Its contexts are kept so
+// they come back if the action is restored.
+func (s *SQLStore) DeleteNextAction(id string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.trashRecord(EntityNextAction, "next_actions", id)
+	})
+}
+
+// trashRecord moves a record of a table with a deleted_at column to the
+// trash.
+func (r sqlRunner) trashRecord(entity string, table string, id string) error {
+	result, err := r.exec("UPDATE "+table+" SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+		time.Now().UTC().Format(time.RFC3339), id)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(result); err != nil {
+		return err
+	}
+	return r.emit(entity, EventDeleted, id)
+}
+
+func (s *SQLStore) ListContexts() ([]Context, error) {
+	rows, err := s.query("SELECT id, name, created_at FROM contexts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contexts := []Context{}
+	for rows.Next() {
+		var context Context
+		if err := rows.Scan(&context.ID, &context.Name, &context.CreatedAt); err != nil {
+			return nil, err
+		}
+		contexts = append(contexts, context)
+	}
+	return contexts, rows.Err()
+}
+
+// contextNameTaken reports whether a context other than exceptID already
+// uses name.
+func (r sqlRunner) contextNameTaken(name string, exceptID string) (bool, error) {
+	var count int
+	err := r.queryRow("SELECT COUNT(*) FROM contexts WHERE name = ? AND id <> ?", name, exceptID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLStore) CreateContext(context *Context) error {
+	if context.ID == "" {
+		context.ID = uuid.New().String()
+	}
+	context.Name = normalizeContextName(context.Name)
+	context.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	return s.inTx(func(tx sqlRunner) error {
+		taken, err := tx.contextNameTaken(context.Name, context.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+
+		_, err = tx.exec("INSERT INTO contexts (id, name, created_at) VALUES (?, ?, ?)",
+			context.ID, context.Name, context.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return tx.emit(EntityContext, EventCreated, context.ID)
+	})
+}
+
+func (r sqlRunner) getContext(id string) (Context, error) {
+	var context Context
+	err := r.queryRow("SELECT id, name, created_at FROM contexts WHERE id = ?", id).
+		Scan(&context.ID, &context.Name, &context.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Context{}, ErrNotFound
+	}
+	return context, err
+}
+
+// contextActionIDs lists the next actions with a context, leaving out the
+// ones in the trash.
+func (r sqlRunner) contextActionIDs(contextID string) ([]string, error) {
+	return r.selectIDs(`
+		SELECT na.id FROM next_actions na
+		JOIN next_action_contexts nac ON nac.next_action_id = na.id
+		WHERE nac.context_id = ? AND na.deleted_at IS NULL
+		ORDER BY na.position`, contextID)
+}
+
+func (s *SQLStore) RenameContext(id string, name string) (Context, error) {
+	name = normalizeContextName(name)
+
+	var context Context
+	err := s.inTx(func(tx sqlRunner) error {
+		taken, err := tx.contextNameTaken(name, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+
+		result, err := tx.exec("UPDATE contexts SET name = ? WHERE id = ?", name, id)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(result); err != nil {
+			return err
+		}
+
+		// The actions with the context show its new name
+		if err := tx.emit(EntityContext, EventUpdated, id); err != nil {
+			return err
+		}
+		actionIDs, err := tx.contextActionIDs(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.emitAll(EntityNextAction, EventUpdated, actionIDs); err != nil {
+			return err
+		}
+
+		context, err = tx.getContext(id)
+		return err
+	})
+	return context, err
+}
+
+func (s *SQLStore) DeleteContext(id string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		actionIDs, err := tx.contextActionIDs(id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM next_action_contexts WHERE context_id = ?", id); err != nil {
+			return err
+		}
+		result, err := tx.exec("DELETE FROM contexts WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(result); err != nil {
+			return err
+		}
+		if err := tx.emit(EntityContext, EventDeleted, id); err != nil {
+			return err
+		}
+		return tx.emitAll(EntityNextAction, EventUpdated, actionIDs)
+	})
+}
+
+const waitingForColumns = "id, what, delegated_to, delegated_at, follow_up_at, project_id, inbox_item_id, created_at, resolved_at"
+
+func scanWaitingFor(row scanner) (WaitingFor, error) {
+	var item WaitingFor
+	var followUpAt, projectID, inboxItemID, resolvedAt sql.NullString
+	if err := row.Scan(&item.ID, &item.What, &item.DelegatedTo, &item.DelegatedAt, &followUpAt,
+		&projectID, &inboxItemID, &item.CreatedAt, &resolvedAt); err != nil {
+		return WaitingFor{}, err
+	}
+
+	// NULL columns are reported as empty strings
+	item.FollowUpAt = followUpAt.String
+	item.ProjectID = projectID.String
+	item.InboxItemID = inboxItemID.String
+	item.ResolvedAt = resolvedAt.String
+	return item, nil
+}
+
+func (s *SQLStore) ListWaitingFor(filter WaitingForFilter) ([]WaitingFor, error) {
+	query := "SELECT " + waitingForColumns + " FROM waiting_for WHERE deleted_at IS NULL"
+	var params []interface{}
+	if !filter.IncludeResolved {
+		query += " AND resolved_at IS NULL"
+	}
+	if filter.FollowUpDue != "" {
+		query += " AND follow_up_at <= ?"
+		params = append(params, filter.FollowUpDue)
+	}
+	query += " ORDER BY follow_up_at IS NULL, follow_up_at, created_at"
+
+	rows, err := s.query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []WaitingFor{}
+	for rows.Next() {
+		item, err := scanWaitingFor(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r sqlRunner) getWaitingFor(id string) (WaitingFor, error) {
+	item, err := scanWaitingFor(r.queryRow("SELECT "+waitingForColumns+" FROM waiting_for WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return WaitingFor{}, ErrNotFound
+	}
+	return item, err
+}
+
+func (s *SQLStore) GetWaitingFor(id string) (WaitingFor, error) {
+	return s.getWaitingFor(id)
+}
+
+func (r sqlRunner) insertWaitingFor(item *WaitingFor) error {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	now := time.Now().UTC()
+	item.CreatedAt = now.Format(time.RFC3339)
+	if item.DelegatedAt == "" {
+		item.DelegatedAt = now.Format(time.DateOnly)
+	}
+	item.ResolvedAt = ""
+
+	_, err := r.exec(`
+		INSERT INTO waiting_for (id, what, delegated_to, delegated_at, follow_up_at, project_id, inbox_item_id, created_at, resolved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.ID, item.What, item.DelegatedTo, item.DelegatedAt, nullString(item.FollowUpAt),
+		nullString(item.ProjectID), nullString(item.InboxItemID), item.CreatedAt, nil)
+	if err != nil {
+		return err
+	}
+	return r.emit(EntityWaitingFor, EventCreated, item.ID)
+}
+
+func (s *SQLStore) CreateWaitingFor(item *WaitingFor) error {
+	return s.inTx(func(tx sqlRunner) error {
+		if item.ProjectID != "" {
+			if err := tx.checkProjectRef(item.ProjectID); err != nil {
+				return err
+			}
+		}
+		return tx.insertWaitingFor(item)
+	})
+}
+
+func (s *SQLStore) UpdateWaitingFor(id string, update WaitingForUpdate) (WaitingFor, error) {
+	query := "UPDATE waiting_for SET"
+	var params []interface{}
+	var setFields []string
+
+	if update.What != nil {
+		setFields = append(setFields, " what = ?")
+		params = append(params, *update.What)
+	}
+	if update.DelegatedTo != nil {
+		setFields = append(setFields, " delegated_to = ?")
+		params = append(params, *update.DelegatedTo)
+	}
+	if update.DelegatedAt != nil {
+		setFields = append(setFields, " delegated_at = ?")
+		params = append(params, *update.DelegatedAt)
+	}
+	if update.FollowUpAt != nil {
+		setFields = append(setFields, " follow_up_at = ?")
+		params = append(params, nullString(*update.FollowUpAt))
+	}
+	if update.ProjectID != nil {
+		setFields = append(setFields, " project_id = ?")
+		params = append(params, nullString(*update.ProjectID))
+	}
+	if update.ResolvedAt != nil {
+		setFields = append(setFields, " resolved_at = ?")
+		params = append(params, nullString(*update.ResolvedAt))
+	}
+
+	if len(setFields) > 0 {
+		// Combine all set fields and add WHERE clause
+		for i := 0; i < len(setFields)-1; i++ {
+			query += setFields[i] + ","
+		}
+		query += setFields[len(setFields)-1] + " WHERE id = ? AND deleted_at IS NULL"
+		params = append(params, id)
+	}
+
+	var item WaitingFor
+	err := s.inTx(func(tx sqlRunner) error {
+		if update.ProjectID != nil && *update.ProjectID != "" {
+			if err := tx.checkProjectRef(*update.ProjectID); err != nil {
+				return err
+			}
+		}
+		if len(setFields) > 0 {
+			result, err := tx.exec(query, params...)
+			if err != nil {
+				return err
+			}
+			if err := checkAffected(result); err != nil {
+				return err
+			}
+			if err := tx.emit(EntityWaitingFor, EventUpdated, id); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		item, err = tx.getWaitingFor(id)
+		return err
+	})
+	return item, err
+}
+
+func (s *SQLStore) DeleteWaitingFor(id string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.trashRecord(EntityWaitingFor, "waiting_for", id)
+	})
+}
+
+const somedayColumns = "id, title, notes, url, inbox_item_id, created_at"
+
+func scanSomeday(row scanner) (SomedayItem, error) {
+	var item SomedayItem
+	var notes, url, inboxItemID sql.NullString
+	if err := row.Scan(&item.ID, &item.Title, &notes, &url, &inboxItemID, &item.CreatedAt); err != nil {
+		return SomedayItem{}, err
+	}
+
+	// NULL columns are reported as empty strings
+	item.Notes = notes.String
+	item.URL = url.String
+	item.InboxItemID = inboxItemID.String
+	return item, nil
+}
+
+func (s *SQLStore) ListSomeday() ([]SomedayItem, error) {
+	rows, err := s.query("SELECT " + somedayColumns + " FROM someday WHERE deleted_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []SomedayItem{}
+	for rows.Next() {
+		item, err := scanSomeday(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r sqlRunner) getSomeday(id string) (SomedayItem, error) {
+	item, err := scanSomeday(r.queryRow("SELECT "+somedayColumns+" FROM someday WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return SomedayItem{}, ErrNotFound
+	}
+	return item, err
+}
+
+func (s *SQLStore) GetSomeday(id string) (SomedayItem, error) {
+	return s.getSomeday(id)
+}
+
+func (r sqlRunner) insertSomeday(item *SomedayItem) error {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err := r.exec("INSERT INTO someday (id, title, notes, url, inbox_item_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		item.ID, item.Title, nullString(item.Notes), nullString(item.URL), nullString(item.InboxItemID), item.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return r.emit(EntitySomeday, EventCreated, item.ID)
+}
+
+func (s *SQLStore) CreateSomeday(item *SomedayItem) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.insertSomeday(item)
+	})
+}
+
+func (s *SQLStore) UpdateSomeday(id string, update SomedayUpdate) (SomedayItem, error) {
+	query := "UPDATE someday SET"
+	var params []interface{}
+	var setFields []string
+
+	if update.Title != nil {
+		setFields = append(setFields, " title = ?")
+		params = append(params, *update.Title)
+	}
+	if update.Notes != nil {
+		setFields = append(setFields, " notes = ?")
+		params = append(params, nullString(*update.Notes))
+	}
+	if update.URL != nil {
+		setFields = append(setFields, " url = ?")
+		params = append(params, nullString(*update.URL))
+	}
+
+	if len(setFields) > 0 {
+		// Combine all set fields and add WHERE clause
+		for i := 0; i < len(setFields)-1; i++ {
+			query += setFields[i] + ","
+		}
+		query += setFields[len(setFields)-1] + " WHERE id = ? AND deleted_at IS NULL"
+		params = append(params, id)
+	}
+
+	var item SomedayItem
+	err := s.inTx(func(tx sqlRunner) error {
+		if len(setFields) > 0 {
+			result, err := tx.exec(query, params...)
+			if err != nil {
+				return err
+			}
+			if err := checkAffected(result); err != nil {
+				return err
+			}
+			if err := tx.emit(EntitySomeday, EventUpdated, id); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		item, err = tx.getSomeday(id)
+		return err
+	})
+	return item, err
+}
+
+func (s *SQLStore) DeleteSomeday(id string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.trashRecord(EntitySomeday, "someday", id)
+	})
+}
+
+func (s *SQLStore) PromoteSomeday(id string) (Project, error) {
+	var project Project
+	err := s.inTx(func(tx sqlRunner) error {
+		item, err := tx.getSomeday(id)
+		if err != nil {
+			return err
+		}
+
+		project = Project{Name: item.Title, InboxItemID: item.InboxItemID}
+		if err := tx.insertProject(&project); err != nil {
+			return err
+		}
+
+		return tx.trashRecord(EntitySomeday, "someday", id)
+	})
+	return project, err
+}
+
+const referenceColumns = "id, title, notes, url, inbox_item_id, created_at"
+
+func scanReference(row scanner) (ReferenceItem, error) {
+	var item ReferenceItem
+	var notes, url, inboxItemID sql.NullString
+	if err := row.Scan(&item.ID, &item.Title, &notes, &url, &inboxItemID, &item.CreatedAt); err != nil {
+		return ReferenceItem{}, err
+	}
+
+	// NULL columns are reported as empty strings
+	item.Notes = notes.String
+	item.URL = url.String
+	item.InboxItemID = inboxItemID.String
+	return item, nil
+}
+
+func (s *SQLStore) ListReference() ([]ReferenceItem, error) {
+	rows, err := s.query("SELECT " + referenceColumns + " FROM reference_items WHERE deleted_at IS NULL ORDER BY title")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ReferenceItem{}
+	for rows.Next() {
+		item, err := scanReference(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r sqlRunner) getReference(id string) (ReferenceItem, error) {
+	item, err := scanReference(r.queryRow("SELECT "+referenceColumns+" FROM reference_items WHERE id = ? AND deleted_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return ReferenceItem{}, ErrNotFound
+	}
+	return item, err
+}
+
+func (s *SQLStore) GetReference(id string) (ReferenceItem, error) {
+	return s.getReference(id)
+}
+
+func (r sqlRunner) insertReference(item *ReferenceItem) error {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err := r.exec("INSERT INTO reference_items (id, title, notes, url, inbox_item_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		item.ID, item.Title, nullString(item.Notes), nullString(item.URL), nullString(item.InboxItemID), item.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return r.emit(EntityReference, EventCreated, item.ID)
+}
+
+func (s *SQLStore) CreateReference(item *ReferenceItem) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.insertReference(item)
+	})
+}
+
+func (s *SQLStore) DeleteReference(id string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		return tx.trashRecord(EntityReference, "reference_items", id)
+	})
+}
+
+const inboxColumns = "id, description, url, created_at, state, defer_until, deferred_at, processed_at, deleted_at"
+
+func scanInboxItem(row scanner) (InboxItem, error) {
+	var item InboxItem
+	var url, deferUntil, deferredAt, processedAt, deletedAt sql.NullString
+	if err := row.Scan(&item.ID, &item.Description, &url, &item.CreatedAt, &item.State,
+		&deferUntil, &deferredAt, &processedAt, &deletedAt); err != nil {
+		return InboxItem{}, err
+	}
+
+	// NULL columns are reported as empty strings
+	item.URL = url.String
+	item.DeferUntil = deferUntil.String
+	item.DeferredAt = deferredAt.String
+	item.ProcessedAt = processedAt.String
+	item.DeletedAt = deletedAt.String
+	return item, nil
+}
+
+func (s *SQLStore) ListInboxItems(filter InboxFilter) ([]InboxItem, error) {
+	query := "SELECT " + inboxColumns + " FROM inbox"
+	var params []interface{}
+	switch {
+	case len(filter.States) > 0:
+		query += " WHERE state IN (" + placeholders(len(filter.States)) + ")"
+		for _, state := range filter.States {
+			params = append(params, state)
+		}
+	case filter.IncludeDeferred:
+		query += " WHERE state IN ('inbox', 'deferred')"
+	default:
+		query += " WHERE (state = 'inbox' OR (state = 'deferred' AND defer_until <= ?))"
+		params = append(params, time.Now().UTC().Format(time.RFC3339))
+	}
+	query += " ORDER BY created_at"
+
+	rows, err := s.query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []InboxItem{}
+	for rows.Next() {
+		item, err := scanInboxItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (r sqlRunner) getInboxItem(id string) (InboxItem, error) {
+	item, err := scanInboxItem(r.queryRow("SELECT "+inboxColumns+" FROM inbox WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return InboxItem{}, ErrNotFound
+	}
+	return item, err
+}
+
+func (s *SQLStore) GetInboxItem(id string) (InboxItem, error) {
+	return s.getInboxItem(id)
+}
+
+// saveInboxItem writes back every field of item that can change.
+func (r sqlRunner) saveInboxItem(item InboxItem) error {
+	_, err := r.exec(`
+		UPDATE inbox SET description = ?, url = ?, state = ?, defer_until = ?,
+			deferred_at = ?, processed_at = ?, deleted_at = ?
+		WHERE id = ?`,
+		item.Description, nullString(item.URL), item.State, nullString(item.DeferUntil),
+		nullString(item.DeferredAt), nullString(item.ProcessedAt), nullString(item.DeletedAt), item.ID)
+	return err
+}
+
+func (s *SQLStore) CreateInboxItem(item *InboxItem) error {
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+	item.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	item.State = InboxOpen
+	item.DeferredAt, item.ProcessedAt, item.DeletedAt = "", "", ""
+	if item.DeferUntil != "" {
+		item.State = InboxDeferred
+		item.DeferredAt = item.CreatedAt
+	}
+
+	return s.inTx(func(tx sqlRunner) error {
+		_, err := tx.exec("INSERT INTO inbox (id, description, url, created_at, state, defer_until, deferred_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			item.ID, item.Description, nullString(item.URL), item.CreatedAt, item.State,
+			nullString(item.DeferUntil), nullString(item.DeferredAt))
+		if err != nil {
+			return err
+		}
+		return tx.emit(EntityInbox, EventCreated, item.ID)
+	})
+}
+
+func (s *SQLStore) UpdateInboxItem(id string, update InboxItemUpdate) (InboxItem, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var item InboxItem
+	err := s.inTx(func(tx sqlRunner) error {
+		current, err := tx.getInboxItem(id)
+		if err != nil {
+			return err
+		}
+		if item, err = applyInboxUpdate(current, update, now); err != nil {
+			return err
+		}
+		if err := tx.saveInboxItem(item); err != nil {
+			return err
+		}
+		return tx.emit(EntityInbox, inboxChange(current.State, item.State), id)
+	})
+	return item, err
+}
+
+func (s *SQLStore) DeleteInboxItem(id string) error {
+	deleted := InboxDeleted
+	_, err := s.UpdateInboxItem(id, InboxItemUpdate{State: &deleted})
+	return err
+}
+
+func (s *SQLStore) ProcessInboxItem(id string, processing InboxProcessing) error {
+	processed := InboxProcessed
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.inTx(func(tx sqlRunner) error {
+		current, err := tx.getInboxItem(id)
+		if err != nil {
+			return err
+		}
+		if current.State == InboxProcessed {
+			return fmt.Errorf("%w: inbox item was already processed", ErrInvalidTransition)
+		}
+		item, err := applyInboxUpdate(current, InboxItemUpdate{State: &processed}, now)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case processing.NextAction != nil:
+			action := processing.NextAction
+			action.Action = defaultString(action.Action, item.Description)
+			action.URL = defaultString(action.URL, item.URL)
+			action.InboxItemID = id
+			if action.ProjectID != "" {
+				if err := tx.checkProjectRef(action.ProjectID); err != nil {
+					return err
+				}
+			}
+			err = tx.insertNextAction(action)
+		case processing.Project != nil:
+			project := processing.Project
+			project.Name = defaultString(project.Name, item.Description)
+			project.InboxItemID = id
+			err = tx.insertProject(project)
+		case processing.WaitingFor != nil:
+			waitingFor := processing.WaitingFor
+			waitingFor.What = defaultString(waitingFor.What, item.Description)
+			waitingFor.InboxItemID = id
+			if waitingFor.ProjectID != "" {
+				if err := tx.checkProjectRef(waitingFor.ProjectID); err != nil {
+					return err
+				}
+			}
+			err = tx.insertWaitingFor(waitingFor)
+		case processing.Someday != nil:
+			someday := processing.Someday
+			someday.Title = defaultString(someday.Title, item.Description)
+			someday.URL = defaultString(someday.URL, item.URL)
+			someday.InboxItemID = id
+			err = tx.insertSomeday(someday)
+		case processing.Reference != nil:
+			reference := processing.Reference
+			reference.Title = defaultString(reference.Title, item.Description)
+			reference.URL = defaultString(reference.URL, item.URL)
+			reference.InboxItemID = id
+			err = tx.insertReference(reference)
+		default:
+			err = errors.New("nothing to process the inbox item into")
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.saveInboxItem(item); err != nil {
+			return err
+		}
+		return tx.emit(EntityInbox, EventUpdated, id)
+	})
+}
+
+// trashTables lists the tables that keep deleted records in the trash, with
+// the column used as the title of their trash items. Deleted inbox items
+// are in the trash too, but are tracked by their state.
+var trashTables = []struct {
+	Type, Table, Title string
+}{
+	{TrashProject, "projects", "name"},
+	{TrashNextAction, "next_actions", "action"},
+	{TrashWaitingFor, "waiting_for", "what"},
+	{TrashSomeday, "someday", "title"},
+	{TrashReference, "reference_items", "title"},
+}
+
+func (s *SQLStore) ListTrash() ([]TrashItem, error) {
+	var queries []string
+	for _, t := range trashTables {
+		queries = append(queries, "SELECT '"+t.Type+"', id, "+t.Title+", deleted_at FROM "+t.Table+" WHERE deleted_at IS NOT NULL")
+	}
+	queries = append(queries, "SELECT '"+TrashInboxItem+"', id, description, deleted_at FROM inbox WHERE state = 'deleted'")
+
+	rows, err := s.query(strings.Join(queries, " UNION ALL ") + " ORDER BY 4 DESC, 3")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []TrashItem{}
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(&item.Type, &item.ID, &item.Title, &item.DeletedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *SQLStore) RestoreTrash(recordType string, id string) error {
+	if recordType == TrashInboxItem {
+		return s.inTx(func(tx sqlRunner) error {
+			item, err := tx.getInboxItem(id)
+			if err != nil {
+				return err
+			}
+			if item.State != InboxDeleted {
+				return ErrNotFound
+			}
+			open := InboxOpen
+			if item, err = applyInboxUpdate(item, InboxItemUpdate{State: &open}, time.Now().UTC().Format(time.RFC3339)); err != nil {
+				return err
+			}
+			if err := tx.saveInboxItem(item); err != nil {
+				return err
+			}
+			return tx.emit(EntityInbox, EventCreated, id)
+		})
+	}
+
+	for _, t := range trashTables {
+		if t.Type != recordType {
+			continue
+		}
+		return s.inTx(func(tx sqlRunner) error {
+			result, err := tx.exec("UPDATE "+t.Table+" SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+			if err != nil {
+				return err
+			}
+			if err := checkAffected(result); err != nil {
+				return err
+			}
+			return tx.emit(entityOfTrashType(t.Type), EventCreated, id)
+		})
+	}
+	return ErrNotFound
+}
+
+func (s *SQLStore) PurgeTrash(before time.Time) (int, error) {
+	cutoff := before.UTC().Format(time.RFC3339)
+	var purged int
+	err := s.inTx(func(tx sqlRunner) error {
+		purged = 0
+
+		// Records that outlive a purged project or inbox item lose their
+		// link to it. The ones that aren't in the trash are reported as
+		// updated.
+		type unlink struct{ Entity, Table, Set, Where string }
+		unlinks := []unlink{}
+		for _, t := range []struct{ Entity, Table, Set string }{
+			{EntityNextAction, "next_actions", "project_id = NULL, project_position = NULL"},
+			{EntityWaitingFor, "waiting_for", "project_id = NULL"},
+		} {
+			unlinks = append(unlinks, unlink{t.Entity, t.Table, t.Set, "project_id IN (SELECT id FROM projects WHERE deleted_at < ?)"})
+		}
+		for _, t := range trashTables {
+			unlinks = append(unlinks, unlink{entityOfTrashType(t.Type), t.Table, "inbox_item_id = NULL",
+				"inbox_item_id IN (SELECT id FROM inbox WHERE state = 'deleted' AND deleted_at < ?)"})
+		}
+		updated := map[string][]string{}
+		for _, u := range unlinks {
+			ids, err := tx.selectIDs("SELECT id FROM "+u.Table+" WHERE "+u.Where+" AND deleted_at IS NULL", cutoff)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if !slices.Contains(updated[u.Entity], id) {
+					updated[u.Entity] = append(updated[u.Entity], id)
+				}
+			}
+			if _, err := tx.exec("UPDATE "+u.Table+" SET "+u.Set+" WHERE "+u.Where, cutoff); err != nil {
+				return err
+			}
+		}
+		_, err := tx.exec("DELETE FROM next_action_contexts WHERE next_action_id IN (SELECT id FROM next_actions WHERE deleted_at < ?)", cutoff)
+		if err != nil {
+			return err
+		}
+
+		queries := []string{"DELETE FROM inbox WHERE state = 'deleted' AND deleted_at < ?"}
+		for _, t := range trashTables {
+			queries = append(queries, "DELETE FROM "+t.Table+" WHERE deleted_at < ?")
+		}
+		for _, query := range queries {
+			result, err := tx.exec(query, cutoff)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			purged += int(n)
+		}
+
+		for _, t := range trashTables {
+			entity := entityOfTrashType(t.Type)
+			if err := tx.emitAll(entity, EventUpdated, updated[entity]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+const operationColumns = "id, session_id, user_id, name, changes, created_at, undone_at"
+
+func scanOperation(row scanner) (Operation, error) {
+	var op Operation
+	var changes string
+	var userID, undoneAt sql.NullString
+	if err := row.Scan(&op.ID, &op.SessionID, &userID, &op.Name, &changes, &op.CreatedAt, &undoneAt); err != nil {
+		return Operation{}, err
+	}
+	op.UserID = userID.String
+	op.UndoneAt = undoneAt.String
+	if err := json.Unmarshal([]byte(changes), &op.Changes); err != nil {
+		return Operation{}, fmt.Errorf("operation %d: %w", op.ID, err)
+	}
+	return op, nil
+}
+
+func (s *SQLStore) RecordOperation(op *Operation) error {
+	changes, err := json.Marshal(op.Changes)
+	if err != nil {
+		return err
+	}
+	op.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	op.UndoneAt = ""
+
+	return s.inTx(func(tx sqlRunner) error {
+		// A new operation can't be followed by the ones that were undone
+		if _, err := tx.exec("DELETE FROM operations WHERE "+operationOwner+" AND undone_at IS NOT NULL", op.SessionID, op.UserID); err != nil {
+			return err
+		}
+		err := tx.queryRow("INSERT INTO operations (session_id, user_id, name, changes, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+			op.SessionID, nullString(op.UserID), op.Name, string(changes), op.CreatedAt).Scan(&op.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec("DELETE FROM operations WHERE "+operationOwner+" AND id NOT IN (SELECT id FROM operations WHERE "+operationOwner+" ORDER BY id DESC LIMIT ?)",
+			op.SessionID, op.UserID, op.SessionID, op.UserID, maxOperations)
+		return err
+	})
+}
+
+// operationOwner selects the operations of a session ID and user ID, where
+// the user ID is empty for operations made without logging in.
+const operationOwner = "session_id = ? AND COALESCE(user_id, '') = ?"
+
+func (s *SQLStore) OperationToUndo(sessionID string, userID string) (Operation, error) {
+	op, err := scanOperation(s.queryRow("SELECT "+operationColumns+" FROM operations WHERE "+operationOwner+" AND undone_at IS NULL ORDER BY id DESC LIMIT 1", sessionID, userID))
+	if err == sql.ErrNoRows {
+		return Operation{}, ErrNotFound
+	}
+	return op, err
+}
+
+func (s *SQLStore) OperationToRedo(sessionID string, userID string) (Operation, error) {
+	op, err := scanOperation(s.queryRow("SELECT "+operationColumns+" FROM operations WHERE "+operationOwner+" AND undone_at IS NOT NULL ORDER BY id LIMIT 1", sessionID, userID))
+	if err == sql.ErrNoRows {
+		return Operation{}, ErrNotFound
+	}
+	return op, err
+}
+
+func (s *SQLStore) SetOperationUndone(id int64, undone bool) error {
+	var undoneAt string
+	if undone {
+		undoneAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	result, err := s.exec("UPDATE operations SET undone_at = ? WHERE id = ?", nullString(undoneAt), id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(result)
+}
+
+const historyColumns = "id, record_type, record_id, operation, session_id, user_id, changes, created_at"
+
+func scanHistoryEntry(row scanner) (HistoryEntry, error) {
+	var entry HistoryEntry
+	var sessionID, userID sql.NullString
+	var changes string
+	if err := row.Scan(&entry.ID, &entry.RecordType, &entry.RecordID, &entry.Operation, &sessionID, &userID, &changes, &entry.CreatedAt); err != nil {
+		return HistoryEntry{}, err
+	}
+	entry.SessionID = sessionID.String
+	entry.UserID = userID.String
+	if err := json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+		return HistoryEntry{}, fmt.Errorf("history entry %d: %w", entry.ID, err)
+	}
+	return entry, nil
+}
+
+func (s *SQLStore) AppendHistory(entries []HistoryEntry) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.inTx(func(tx sqlRunner) error {
+		for i := range entries {
+			entry := &entries[i]
+			changes, err := json.Marshal(entry.Changes)
+			if err != nil {
+				return err
+			}
+			entry.CreatedAt = now
+			err = tx.queryRow("INSERT INTO history (record_type, record_id, operation, session_id, user_id, changes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id",
+				entry.RecordType, entry.RecordID, entry.Operation, nullString(entry.SessionID), nullString(entry.UserID), string(changes), entry.CreatedAt).Scan(&entry.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) ListHistory(filter HistoryFilter) ([]HistoryEntry, error) {
+	query := "SELECT " + historyColumns + " FROM history WHERE 1 = 1"
+	var params []interface{}
+	if filter.RecordType != "" {
+		query += " AND record_type = ? AND record_id = ?"
+		params = append(params, filter.RecordType, filter.RecordID)
+	}
+	if filter.Before > 0 {
+		query += " AND id < ?"
+		params = append(params, filter.Before)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	params = append(params, filter.Limit)
+
+	rows, err := s.query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLStore) ReleaseDeferred(now time.Time) ([]InboxItem, []NextAction, error) {
+	cutoff := now.UTC().Format(time.RFC3339)
+	var items []InboxItem
+	var actions []NextAction
+
+	err := s.inTx(func(tx sqlRunner) error {
+		items, actions = []InboxItem{}, []NextAction{}
+
+		rows, err := tx.query("SELECT "+inboxColumns+" FROM inbox WHERE state = 'deferred' AND defer_until <= ?", cutoff)
+		if err != nil {
+			return err
+		}
+		open := InboxOpen
+		for rows.Next() {
+			item, err := scanInboxItem(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if item, err = applyInboxUpdate(item, InboxItemUpdate{State: &open}, cutoff); err != nil {
+				rows.Close()
+				return err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.query("SELECT id FROM next_actions WHERE defer_until <= ? AND deleted_at IS NULL", cutoff)
+		if err != nil {
+			return err
+		}
+		var actionIDs []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			actionIDs = append(actionIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if err := tx.saveInboxItem(item); err != nil {
+				return err
+			}
+			if err := tx.emit(EntityInbox, EventUpdated, item.ID); err != nil {
+				return err
+			}
+		}
+		for _, id := range actionIDs {
+			if _, err := tx.exec("UPDATE next_actions SET defer_until = NULL WHERE id = ?", id); err != nil {
+				return err
+			}
+			if err := tx.emit(EntityNextAction, EventUpdated, id); err != nil {
+				return err
+			}
+			action, err := tx.getNextAction(id)
+			if err != nil {
+				return err
+			}
+			actions = append(actions, action)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, actions, nil
+}
+
+const eventColumns = "seq, version, type, entity, entity_id, revision, created_at, data, scopes"
+
+func scanEvent(row scanner) (Event, error) {
+	var event Event
+	var data, scopes sql.NullString
+	if err := row.Scan(&event.Sequence, &event.Version, &event.Type, &event.Entity, &event.EntityID,
+		&event.Revision, &event.Timestamp, &data, &scopes); err != nil {
+		return Event{}, err
+	}
+	if data.Valid {
+		event.Data = json.RawMessage(data.String)
+	}
+	var err error
+	if event.Scopes, err = decodeScopes(scopes); err != nil {
+		return Event{}, fmt.Errorf("event %d: %w", event.Sequence, err)
+	}
+	return event, nil
+}
+
+func (s *SQLStore) EventsSince(since int64) ([]Event, int64, error) {
+	rows, err := s.query("SELECT "+eventColumns+" FROM events WHERE seq > ? ORDER BY seq", since)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// The bounds of the log are read after the events, so events dropped
+	// in between make the client resync rather than go missing
+	var oldest, latest sql.NullInt64
+	if err := s.queryRow("SELECT MIN(seq), MAX(seq) FROM events").Scan(&oldest, &latest); err != nil {
+		return nil, 0, err
+	}
+	if since > latest.Int64 || since < oldest.Int64-1 {
+		return nil, latest.Int64, ErrEventsCompacted
+	}
+	if len(events) > 0 {
+		latest.Int64 = max(latest.Int64, events[len(events)-1].Sequence)
+	}
+	return events, latest.Int64, nil
+}
+
+const userColumns = "id, username, password_hash, created_at"
+
+func scanUser(row scanner) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return User{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *SQLStore) CreateUser(user *User) error {
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	user.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	return s.inTx(func(tx sqlRunner) error {
+		var count int
+		if err := tx.queryRow("SELECT COUNT(*) FROM users WHERE username = ?", user.Username).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrConflict
+		}
+		_, err := tx.exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?)",
+			user.ID, user.Username, user.PasswordHash, user.CreatedAt)
+		return err
+	})
+}
+
+func (s *SQLStore) GetUser(id string) (User, error) {
+	return scanUser(s.queryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *SQLStore) GetUserByUsername(username string) (User, error) {
+	return scanUser(s.queryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+}
+
+func (s *SQLStore) CountUsers() (int, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (s *SQLStore) CreateLoginSession(session *LoginSession) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	session.CreatedAt = now
+
+	return s.inTx(func(tx sqlRunner) error {
+		if _, err := tx.exec("DELETE FROM login_sessions WHERE expires_at <= ?", now); err != nil {
+			return err
+		}
+		_, err := tx.exec("INSERT INTO login_sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+			session.TokenHash, session.UserID, session.CreatedAt, session.ExpiresAt)
+		return err
+	})
+}
+
+func (s *SQLStore) GetLoginSession(tokenHash string) (LoginSession, error) {
+	var session LoginSession
+	err := s.queryRow("SELECT token_hash, user_id, created_at, expires_at FROM login_sessions WHERE token_hash = ? AND expires_at > ?",
+		tokenHash, time.Now().UTC().Format(time.RFC3339)).
+		Scan(&session.TokenHash, &session.UserID, &session.CreatedAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return LoginSession{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *SQLStore) DeleteLoginSession(tokenHash string) error {
+	return s.inTx(func(tx sqlRunner) error {
+		_, err := tx.exec("DELETE FROM login_sessions WHERE token_hash = ?", tokenHash)
+		return err
+	})
+}
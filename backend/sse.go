@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleEvents streams the events clients get over the websocket as
+// Server-Sent Events, for clients behind proxies that break websockets and
+// ones that only have curl. Each event is sent with its sequence number as
+// the ID, so a client that reconnects with the Last-Event-ID header, or the
+// since query parameter, first gets the events it missed, like on the
+// websocket. Clients only get the events of the topics given as topic query
+// parameters, or all of them if there are none.
+func (manager *ClientManager) HandleEvents(c *gin.Context) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("since")
+	}
+	since, err := parseSince(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	topics, err := parseTopics(c.QueryArray("topic"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client := &streamClient{addr: c.Request.RemoteAddr, topics: topics}
+	if err := manager.join(client, since); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // stop nginx from holding events back
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	controller := http.NewResponseController(c.Writer)
+
+	// Comments keep proxies from closing an idle stream, and find clients
+	// that are gone
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		var frame string
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				return
+			}
+			if message.seq > 0 {
+				frame = fmt.Sprintf("id: %d\n", message.seq)
+			}
+			frame += fmt.Sprintf("data: %s\n\n", message.data)
+		case <-ticker.C:
+			frame = ": ping\n\n"
+		case <-c.Request.Context().Done():
+			manager.remove(client, "")
+			return
+		}
+		controller.SetWriteDeadline(time.Now().Add(writeWait))
+		_, err := io.WriteString(c.Writer, frame)
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			manager.remove(client, dropWriteFailure)
+			return
+		}
+	}
+}
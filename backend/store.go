@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Store methods when the requested record
+// doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a write would violate a uniqueness rule,
+// such as two contexts with the same name.
+var ErrConflict = errors.New("conflict")
+
+// ErrInvalidTransition is returned when a record can't move from its current
+// status to the requested one.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// ErrInvalidReference is returned when a record is linked to a project that
+// doesn't exist or is in the trash.
+var ErrInvalidReference = errors.New("invalid reference")
+
+// ErrEventsCompacted is returned when events a client asks for are no longer
+// in the event log, so it has to load everything again.
+var ErrEventsCompacted = errors.New("events were compacted")
+
+// Project statuses
+const (
+	ProjectActive    = "active"
+	ProjectOnHold    = "on_hold"
+	ProjectSomeday   = "someday"
+	ProjectCompleted = "completed"
+	ProjectDropped   = "dropped"
+)
+
+// projectTransitions lists the statuses a project can move to from each
+// status. Finished projects have to be reactivated before they can be put
+// on hold or deferred again.
+var projectTransitions = map[string][]string{
+	ProjectActive:    {ProjectOnHold, ProjectSomeday, ProjectCompleted, ProjectDropped},
+	ProjectOnHold:    {ProjectActive, ProjectSomeday, ProjectCompleted, ProjectDropped},
+	ProjectSomeday:   {ProjectActive, ProjectOnHold, ProjectDropped},
+	ProjectCompleted: {ProjectActive},
+	ProjectDropped:   {ProjectActive, ProjectSomeday},
+}
+
+func validProjectStatus(status string) bool {
+	_, ok := projectTransitions[status]
+	return ok
+}
+
+// canTransitionProject reports whether a project may move from one status to
+// another. Staying in the same status is always allowed.
+func canTransitionProject(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, status := range projectTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Inbox item states
+const (
+	InboxOpen      = "inbox"
+	InboxDeferred  = "deferred"
+	InboxProcessed = "processed"
+	InboxDeleted   = "deleted"
+)
+
+// inboxTransitions lists the states an inbox item can move to from each
+// state. Processed items stay processed since other records were made from
+// them; deleted items can be restored to the inbox.
+var inboxTransitions = map[string][]string{
+	InboxOpen:      {InboxDeferred, InboxProcessed, InboxDeleted},
+	InboxDeferred:  {InboxOpen, InboxProcessed, InboxDeleted},
+	InboxProcessed: {},
+	InboxDeleted:   {InboxOpen},
+}
+
+func validInboxState(state string) bool {
+	_, ok := inboxTransitions[state]
+	return ok
+}
+
+// canTransitionInbox reports whether an inbox item may move from one state
+// to another. Staying in the same state is always allowed.
+func canTransitionInbox(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, state := range inboxTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+type Project struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Position    float64 `json:"position"`
+	CreatedAt   string  `json:"created_at"`
+	Deadline    string  `json:"deadline,omitempty"`
+	Status      string  `json:"status"`
+	CompletedAt string  `json:"completed_at,omitempty"`
+	InboxItemID string  `json:"inbox_item_id,omitempty"` // inbox item it was created from
+}
+
+// ProjectFilter narrows down ListProjects.
+type ProjectFilter struct {
+	Statuses []string // empty matches every status
+}
+
+// ProjectUpdate lists the project fields to change. Nil fields are left
+// untouched. Changing the status to completed sets CompletedAt, moving away
+// from completed clears it.
+type ProjectUpdate struct {
+	Position *float64
+	Deadline *string
+	Status   *string
+}
+
+// What DeleteProject does with the next actions and waiting-for items of
+// the deleted project
+const (
+	ProjectActionsOrphan = "orphan" // keep them without a project
+	ProjectActionsDelete = "delete" // move them to the trash with the project
+	ProjectActionsMove   = "move"   // hand them over to another project
+)
+
+// ProjectDeletion says what happens to the records of a deleted project.
+type ProjectDeletion struct {
+	Actions string // one of the ProjectActions policies
+	MoveTo  string // project receiving the records with ProjectActionsMove
+}
+
+type NextAction struct {
+	ID          string   `json:"id"`
+	Action      string   `json:"action"`
+	ProjectID   string   `json:"project_id,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Size        string   `json:"size,omitempty"`
+	Energy      string   `json:"energy,omitempty"`
+	CreatedAt   string   `json:"created_at"`
+	CompletedAt string   `json:"completed_at,omitempty"`
+	Position    float64  `json:"position"`
+	Contexts    []string `json:"contexts"`
+	// ProjectPosition orders the actions of a project independently of
+	// Position. It is set whenever ProjectID is.
+	ProjectPosition *float64 `json:"project_position,omitempty"`
+	DeferUntil      string   `json:"defer_until,omitempty"`
+	InboxItemID     string   `json:"inbox_item_id,omitempty"` // inbox item it was created from
+
+	// Recurrence is a recurrence rule (see Rule) counted from
+	// RecurrenceStart. OccursAt is the occurrence this action stands for.
+	Recurrence      string `json:"recurrence,omitempty"`
+	RecurrenceStart string `json:"recurrence_start,omitempty"`
+	OccursAt        string `json:"occurs_at,omitempty"`
+}
+
+// NextActionFilter narrows down ListNextActions. Actions deferred to a
+// future date are left out unless IncludeDeferred is set.
+type NextActionFilter struct {
+	Context         string // context name, e.g. "@phone"
+	ProjectID       string // the actions of a project, ordered by ProjectPosition
+	IncludeDeferred bool
+}
+
+// NextActionUpdate lists the next action fields to change. Nil fields are
+// left untouched; for nullable fields an empty string clears the value. An
+// action moved to another project goes to the end of that project's list,
+// unless ProjectPosition is given too.
+type NextActionUpdate struct {
+	Action      *string
+	ProjectID   *string
+	URL         *string
+	Size        *string
+	Energy      *string
+	CompletedAt *string
+	Position    *float64
+	Contexts    *[]string // replaces the action's contexts
+	DeferUntil  *string
+
+	ProjectPosition *float64 // ignored for actions without a project
+
+	Recurrence      *string
+	RecurrenceStart *string
+	OccursAt        *string
+}
+
+// Context is a GTD context such as @home or @phone. Next actions reference
+// contexts by name.
+type Context struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+}
+
+// WaitingFor is something delegated to someone else that we are waiting on.
+// Dates are YYYY-MM-DD.
+type WaitingFor struct {
+	ID          string `json:"id"`
+	What        string `json:"what"`
+	DelegatedTo string `json:"delegated_to"`
+	DelegatedAt string `json:"delegated_at"`
+	FollowUpAt  string `json:"follow_up_at,omitempty"`
+	ProjectID   string `json:"project_id,omitempty"`
+	InboxItemID string `json:"inbox_item_id,omitempty"` // inbox item it was created from
+	CreatedAt   string `json:"created_at"`
+	ResolvedAt  string `json:"resolved_at,omitempty"`
+}
+
+// WaitingForFilter narrows down ListWaitingFor. By default only unresolved
+// items are returned.
+type WaitingForFilter struct {
+	IncludeResolved bool
+	FollowUpDue     string // only items whose follow-up date is on or before this date
+}
+
+// WaitingForUpdate lists the waiting-for fields to change. Nil fields are
+// left untouched; for nullable fields an empty string clears the value.
+type WaitingForUpdate struct {
+	What        *string
+	DelegatedTo *string
+	DelegatedAt *string
+	FollowUpAt  *string
+	ProjectID   *string
+	ResolvedAt  *string
+}
+
+// SomedayItem is an idea that might become a project one day.
+type SomedayItem struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Notes       string `json:"notes,omitempty"`
+	URL         string `json:"url,omitempty"`
+	InboxItemID string `json:"inbox_item_id,omitempty"` // inbox item it was created from
+	CreatedAt   string `json:"created_at"`
+}
+
+// SomedayUpdate lists the someday item fields to change. Nil fields are left
+// untouched.
+type SomedayUpdate struct {
+	Title *string
+	Notes *string
+	URL   *string
+}
+
+// ReferenceItem is non-actionable material worth keeping.
+type ReferenceItem struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Notes       string `json:"notes,omitempty"`
+	URL         string `json:"url,omitempty"`
+	InboxItemID string `json:"inbox_item_id,omitempty"` // inbox item it was created from
+	CreatedAt   string `json:"created_at"`
+}
+
+// InboxItem is something captured that hasn't been processed yet. The
+// *At fields record when the item last entered each state.
+type InboxItem struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	URL         string `json:"url,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	State       string `json:"state"`
+	DeferUntil  string `json:"defer_until,omitempty"`
+	DeferredAt  string `json:"deferred_at,omitempty"`
+	ProcessedAt string `json:"processed_at,omitempty"`
+	DeletedAt   string `json:"deleted_at,omitempty"`
+}
+
+// InboxFilter narrows down ListInboxItems. Without States, items in the
+// inbox are returned, along with deferred items whose date has passed but
+// that the tickler hasn't released yet; IncludeDeferred adds the rest of the
+// deferred items.
+type InboxFilter struct {
+	States          []string
+	IncludeDeferred bool
+}
+
+// InboxItemUpdate lists the inbox item fields to change. Nil fields are left
+// untouched. Setting DeferUntil without State defers the item, or brings a
+// deferred item back to the inbox if it is empty. Unprocess lets a processed
+// item move back to another state, which only undoing its processing does.
+type InboxItemUpdate struct {
+	Description *string
+	URL         *string
+	State       *string
+	DeferUntil  *string
+	Unprocess   bool
+}
+
+// applyInboxUpdate returns item with update applied at the given RFC 3339
+// time, or ErrInvalidTransition if the state change isn't allowed.
+func applyInboxUpdate(item InboxItem, update InboxItemUpdate, now string) (InboxItem, error) {
+	state := item.State
+	if update.State != nil {
+		state = *update.State
+	} else if update.DeferUntil != nil && *update.DeferUntil != "" {
+		state = InboxDeferred
+	} else if update.DeferUntil != nil && item.State == InboxDeferred {
+		state = InboxOpen
+	}
+	unprocessing := update.Unprocess && item.State == InboxProcessed
+	if !canTransitionInbox(item.State, state) && !unprocessing {
+		return InboxItem{}, fmt.Errorf("%w: inbox item can't move from %s to %s", ErrInvalidTransition, item.State, state)
+	}
+	if unprocessing && state != InboxProcessed {
+		item.ProcessedAt = ""
+	}
+
+	if update.Description != nil {
+		item.Description = *update.Description
+	}
+	if update.URL != nil {
+		item.URL = *update.URL
+	}
+	if update.DeferUntil != nil {
+		item.DeferUntil = *update.DeferUntil
+	}
+
+	if state != item.State {
+		switch state {
+		case InboxDeferred:
+			item.DeferredAt = now
+		case InboxProcessed:
+			item.ProcessedAt = now
+		case InboxDeleted:
+			item.DeletedAt = now
+		}
+	}
+	item.State = state
+
+	// Only deferred items have a defer date
+	if state != InboxDeferred {
+		item.DeferUntil = ""
+	} else if item.DeferUntil == "" {
+		return InboxItem{}, fmt.Errorf("%w: deferring an inbox item needs a defer_until date", ErrInvalidTransition)
+	}
+	return item, nil
+}
+
+// Record types that can be in the trash
+const (
+	TrashProject    = "project"
+	TrashNextAction = "next_action"
+	TrashWaitingFor = "waiting_for"
+	TrashSomeday    = "someday"
+	TrashReference  = "reference"
+	TrashInboxItem  = "inbox_item"
+)
+
+func validTrashType(recordType string) bool {
+	switch recordType {
+	case TrashProject, TrashNextAction, TrashWaitingFor, TrashSomeday, TrashReference, TrashInboxItem:
+		return true
+	}
+	return false
+}
+
+// TrashItem is a deleted record that can still be restored.
+type TrashItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+// maxOperations is how many operations of each session and user are kept
+// for undo.
+const maxOperations = 100
+
+// maxEvents is how many of the latest events the event log keeps for clients
+// catching up after a reconnect.
+const maxEvents = 1000
+
+// Operation is a change made through the API, journaled so the client
+// session and user that made it can undo and redo it.
+type Operation struct {
+	ID        int64
+	SessionID string
+	UserID    string // empty if nobody was logged in
+	Name      string // what was done, e.g. "update next_action"
+	Changes   []RecordChange
+	CreatedAt string
+	UndoneAt  string // set while the operation is undone
+}
+
+// RecordChange is the state of one record before and after an operation,
+// as JSON. A nil Before means the operation brought the record into
+// existence, a nil After that it deleted the record.
+type RecordChange struct {
+	Type   string          `json:"type"` // one of the trash record types
+	ID     string          `json:"id"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// User is an account that can log in.
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"` // bcrypt
+	CreatedAt    string `json:"created_at"`
+}
+
+// LoginSession is a user being logged in with a session cookie. Only a hash
+// of the cookie's token is kept.
+type LoginSession struct {
+	TokenHash string
+	UserID    string
+	CreatedAt string
+	ExpiresAt string
+}
+
+// HistoryEntry is one change to a record in its audit history.
+type HistoryEntry struct {
+	ID         int64         `json:"id"`
+	RecordType string        `json:"record_type"` // one of the trash record types or HistoryContext
+	RecordID   string        `json:"record_id"`
+	Operation  string        `json:"operation"` // what was done, e.g. "update next action"
+	SessionID  string        `json:"session_id,omitempty"`
+	UserID     string        `json:"user_id,omitempty"` // who made the change, if logged in
+	Changes    []FieldChange `json:"changes"`
+	CreatedAt  string        `json:"created_at"`
+}
+
+// FieldChange is the value of a record field before and after a change.
+// From is nil for records that were created and To for deleted ones.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// HistoryFilter narrows down ListHistory.
+type HistoryFilter struct {
+	RecordType string // empty matches every record
+	RecordID   string
+	Before     int64 // only entries older than this ID, 0 to start at the latest
+	Limit      int
+}
+
+// InboxProcessing says what an inbox item becomes when it is processed.
+// Exactly one field is set; the record is created like by the matching
+// Create method, with its title taken from the inbox item if empty.
+type InboxProcessing struct {
+	NextAction *NextAction
+	Project    *Project
+	WaitingFor *WaitingFor
+	Someday    *SomedayItem
+	Reference  *ReferenceItem
+}
+
+// Store persists projects, next actions, contexts, waiting-for items,
+// someday items, reference items and inbox items. Create methods fill in the
+// ID (if empty), creation time and position of the record they are given.
+// Context names given to next actions that don't exist yet are created on
+// the fly. Delete methods, except for contexts, move records to the trash
+// and other methods treat trashed records as missing. Times
+// are stored as RFC 3339 strings in UTC so they compare correctly as text.
+type Store interface {
+	// Atomically runs fn with a Store that makes the changes fn makes
+	// through it all at once if fn returns nil, and none of them
+	// otherwise. Reads through it see the changes made so far. fn may be run
+	// again when its changes conflict with concurrent ones, so it must not
+	// carry anything over from one run to the next.
+	Atomically(fn func(tx Store) error) error
+
+	ListProjects(filter ProjectFilter) ([]Project, error)
+	GetProject(id string) (Project, error)
+	CreateProject(project *Project) error
+	// UpdateProject applies update to a project. Setting the position of
+	// another project returns ErrConflict.
+	UpdateProject(id string, update ProjectUpdate) (Project, error)
+	// MoveProject places a project between new neighbours, renumbering the
+	// positions of every project when there is no room left between them.
+	MoveProject(id string, move Move) (Project, error)
+	// DeleteProject moves a project to the trash and deals with its next
+	// actions and waiting-for items as deletion says. Next actions handed
+	// over to another project go to the end of its list.
+	DeleteProject(id string, deletion ProjectDeletion) error
+
+	ListNextActions(filter NextActionFilter) ([]NextAction, error)
+	GetNextAction(id string) (NextAction, error)
+	CreateNextAction(action *NextAction) error
+	// UpdateNextAction applies update to an action like UpdateProject.
+	UpdateNextAction(id string, update NextActionUpdate) (NextAction, error)
+	// MoveNextAction places an action between new neighbours like
+	// MoveProject.
+	MoveNextAction(id string, move Move) (NextAction, error)
+	// MoveProjectNextAction does the same within the list of a project's
+	// actions, leaving their order among all actions alone.
+	MoveProjectNextAction(projectID string, id string, move Move) (NextAction, error)
+	DeleteNextAction(id string) error
+
+	ListContexts() ([]Context, error)
+	CreateContext(context *Context) error
+	RenameContext(id string, name string) (Context, error)
+	DeleteContext(id string) error
+
+	ListWaitingFor(filter WaitingForFilter) ([]WaitingFor, error)
+	GetWaitingFor(id string) (WaitingFor, error)
+	CreateWaitingFor(item *WaitingFor) error
+	UpdateWaitingFor(id string, update WaitingForUpdate) (WaitingFor, error)
+	DeleteWaitingFor(id string) error
+
+	ListSomeday() ([]SomedayItem, error)
+	GetSomeday(id string) (SomedayItem, error)
+	CreateSomeday(item *SomedayItem) error
+	UpdateSomeday(id string, update SomedayUpdate) (SomedayItem, error)
+	DeleteSomeday(id string) error
+	// PromoteSomeday turns a someday item into an active project, moving
+	// the someday item to the trash so the promotion can be undone.
+	PromoteSomeday(id string) (Project, error)
+
+	ListReference() ([]ReferenceItem, error)
+	GetReference(id string) (ReferenceItem, error)
+	CreateReference(item *ReferenceItem) error
+	DeleteReference(id string) error
+
+	ListInboxItems(filter InboxFilter) ([]InboxItem, error)
+	// GetInboxItem returns an inbox item in any state.
+	GetInboxItem(id string) (InboxItem, error)
+	// CreateInboxItem adds an item to the inbox, or defers it if it has a
+	// defer date.
+	CreateInboxItem(item *InboxItem) error
+	UpdateInboxItem(id string, update InboxItemUpdate) (InboxItem, error)
+	// DeleteInboxItem moves an inbox item to the deleted state.
+	DeleteInboxItem(id string) error
+	// ProcessInboxItem creates the record described by processing from an
+	// inbox or deferred item and marks the item processed in one step. The
+	// new record links back to the inbox item.
+	ProcessInboxItem(id string, processing InboxProcessing) error
+
+	// ListTrash returns the records in the trash, most recently deleted
+	// first.
+	ListTrash() ([]TrashItem, error)
+	// RestoreTrash takes a record of the given type out of the trash.
+	RestoreTrash(recordType string, id string) error
+	// PurgeTrash permanently removes records deleted before the given time
+	// and returns how many were removed. References to purged projects are
+	// cleared.
+	PurgeTrash(before time.Time) (int, error)
+
+	// RecordOperation journals an operation as the latest one of its
+	// session and user, dropping the operations they had undone and the
+	// oldest ones beyond maxOperations. It fills in the ID and CreatedAt.
+	RecordOperation(op *Operation) error
+	// OperationToUndo returns the latest operation of a session and user
+	// that isn't undone, OperationToRedo the earliest one that is.
+	OperationToUndo(sessionID string, userID string) (Operation, error)
+	OperationToRedo(sessionID string, userID string) (Operation, error)
+	SetOperationUndone(id int64, undone bool) error
+
+	// AppendHistory adds entries to the audit history, filling in their ID
+	// and CreatedAt. History is never changed afterwards.
+	AppendHistory(entries []HistoryEntry) error
+	// ListHistory returns history entries, latest first.
+	ListHistory(filter HistoryFilter) ([]HistoryEntry, error)
+
+	// ReleaseDeferred clears the deferral of every inbox item and next
+	// action deferred until now or earlier, returning the released records.
+	ReleaseDeferred(now time.Time) ([]InboxItem, []NextAction, error)
+
+	// EventsSince returns the logged events with a sequence number above
+	// since, oldest first, along with the sequence number of the latest
+	// event. It returns ErrEventsCompacted if some of those events were
+	// dropped from the log, or if since is ahead of it. Every change logs its
+	// events, keeping the latest maxEvents.
+	EventsSince(since int64) ([]Event, int64, error)
+
+	// CreateUser adds an account, filling in its ID and CreatedAt. It
+	// returns ErrConflict if the username is taken.
+	CreateUser(user *User) error
+	GetUser(id string) (User, error)
+	GetUserByUsername(username string) (User, error)
+	CountUsers() (int, error)
+	// CreateLoginSession adds a login session, dropping the ones that have
+	// expired.
+	CreateLoginSession(session *LoginSession) error
+	// GetLoginSession returns the login session with the given token hash,
+	// or ErrNotFound if there is none or it has expired.
+	GetLoginSession(tokenHash string) (LoginSession, error)
+	DeleteLoginSession(tokenHash string) error
+}
+
+// normalizeContextName trims name and adds the leading @ if it is missing,
+// so "phone" and "@phone" refer to the same context.
+func normalizeContextName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.HasPrefix(name, "@") {
+		return name
+	}
+	return "@" + name
+}
+
+// normalizeContextNames normalizes, de-duplicates and sorts a list of
+// context names, dropping empty ones.
+func normalizeContextNames(names []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, name := range names {
+		name = normalizeContextName(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		normalized = append(normalized, name)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// defaultString returns s, or fallback if s is empty.
+func defaultString(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storeCases are the behaviours every Store has to share, whatever keeps
+// the records.
+var storeCases = []struct {
+	name string
+	run  func(t *testing.T, store Store)
+}{
+	{"missing records", testMissingRecords},
+	{"project lifecycle", testProjectLifecycle},
+	{"project order", testProjectOrder},
+	{"project deletion", testProjectDeletion},
+	{"next actions", testNextActions},
+	{"next action filters", testNextActionFilters},
+	{"project references", testProjectReferences},
+	{"contexts", testContexts},
+	{"waiting for", testWaitingFor},
+	{"someday promotion", testSomedayPromotion},
+	{"inbox", testInbox},
+	{"inbox processing", testInboxProcessing},
+	{"trash", testTrash},
+	{"trash by type", testTrashByType},
+	{"deferred release", testDeferredRelease},
+	{"operations", testOperations},
+	{"history", testHistory},
+	{"events", testEvents},
+	{"atomic rollback", testAtomicRollback},
+	{"users", testUsers},
+}
+
+// TestStoreConformance runs the store cases against every kind of store.
+func TestStoreConformance(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			for _, c := range storeCases {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, kind.new(t, nil))
+				})
+			}
+		})
+	}
+}
+
+// must fails the test if err isn't nil.
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ids returns the IDs of records in order.
+func ids[T any](records []T, id func(T) string) []string {
+	result := []string{}
+	for _, record := range records {
+		result = append(result, id(record))
+	}
+	return result
+}
+
+func projectIDs(projects []Project) []string {
+	return ids(projects, func(p Project) string { return p.ID })
+}
+
+func actionIDs(actions []NextAction) []string {
+	return ids(actions, func(a NextAction) string { return a.ID })
+}
+
+func testMissingRecords(t *testing.T, store Store) {
+	if _, err := store.GetProject("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetProject: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetNextAction("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNextAction: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.UpdateNextAction("missing", NextActionUpdate{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateNextAction: got %v, want ErrNotFound", err)
+	}
+	if err := store.DeleteWaitingFor("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteWaitingFor: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetInboxItem("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetInboxItem: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetUser("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser: got %v, want ErrNotFound", err)
+	}
+}
+
+func testProjectLifecycle(t *testing.T, store Store) {
+	project := Project{Name: "Paint the fence"}
+	must(t, store.CreateProject(&project))
+	if project.ID == "" || project.CreatedAt == "" || project.Status != ProjectActive {
+		t.Fatalf("created project is missing defaults: %+v", project)
+	}
+
+	deadline, completed := "2030-01-31", ProjectCompleted
+	updated, err := store.UpdateProject(project.ID, ProjectUpdate{Deadline: &deadline, Status: &completed})
+	must(t, err)
+	if updated.Deadline != deadline || updated.CompletedAt == "" {
+		t.Errorf("completing the project: got %+v", updated)
+	}
+
+	onHold := ProjectOnHold
+	if _, err := store.UpdateProject(project.ID, ProjectUpdate{Status: &onHold}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("putting a completed project on hold: got %v, want ErrInvalidTransition", err)
+	}
+	active := ProjectActive
+	updated, err = store.UpdateProject(project.ID, ProjectUpdate{Status: &active})
+	must(t, err)
+	if updated.CompletedAt != "" {
+		t.Errorf("reactivated project still has completed_at %q", updated.CompletedAt)
+	}
+
+	got, err := store.GetProject(project.ID)
+	must(t, err)
+	if got != updated {
+		t.Errorf("GetProject returned %+v, want %+v", got, updated)
+	}
+	projects, err := store.ListProjects(ProjectFilter{Statuses: []string{ProjectCompleted}})
+	must(t, err)
+	if len(projects) != 0 {
+		t.Errorf("listing completed projects got %v", projectIDs(projects))
+	}
+}
+
+func testProjectOrder(t *testing.T, store Store) {
+	for _, id := range []string{"a", "b", "c"} {
+		must(t, store.CreateProject(&Project{ID: id, Name: id}))
+	}
+	_, err := store.MoveProject("c", Move{Before: "a"})
+	must(t, err)
+	_, err = store.MoveProject("a", Move{After: "b"})
+	must(t, err)
+
+	projects, err := store.ListProjects(ProjectFilter{})
+	must(t, err)
+	if got, want := projectIDs(projects), []string{"c", "b", "a"}; !slices.Equal(got, want) {
+		t.Errorf("got projects %v, want %v", got, want)
+	}
+}
+
+func testProjectDeletion(t *testing.T, store Store) {
+	for _, id := range []string{"old", "new", "gone"} {
+		must(t, store.CreateProject(&Project{ID: id, Name: id}))
+	}
+	must(t, store.CreateNextAction(&NextAction{ID: "moved", Action: "Moved", ProjectID: "old"}))
+	must(t, store.CreateNextAction(&NextAction{ID: "deleted", Action: "Deleted", ProjectID: "gone"}))
+	must(t, store.CreateWaitingFor(&WaitingFor{ID: "quote", What: "Quote", DelegatedTo: "Bob", ProjectID: "gone"}))
+
+	must(t, store.DeleteProject("old", ProjectDeletion{Actions: ProjectActionsMove, MoveTo: "new"}))
+	action, err := store.GetNextAction("moved")
+	must(t, err)
+	if action.ProjectID != "new" {
+		t.Errorf("handed over action has project %q, want new", action.ProjectID)
+	}
+
+	must(t, store.DeleteProject("gone", ProjectDeletion{Actions: ProjectActionsDelete}))
+	if _, err := store.GetNextAction("deleted"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("action of a deleted project: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetWaitingFor("quote"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("waiting-for of a deleted project: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetProject("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted project: got %v, want ErrNotFound", err)
+	}
+}
+
+func testNextActions(t *testing.T, store Store) {
+	must(t, store.CreateProject(&Project{ID: "p", Name: "Garden"}))
+	first := NextAction{ID: "a", Action: "Buy seeds", ProjectID: "p", Size: "small"}
+	must(t, store.CreateNextAction(&first))
+	second := NextAction{ID: "b", Action: "Dig"}
+	must(t, store.CreateNextAction(&second))
+	if second.Position <= first.Position {
+		t.Errorf("positions: got %v then %v, want them increasing", first.Position, second.Position)
+	}
+
+	none, done := "", "2030-01-01T00:00:00Z"
+	updated, err := store.UpdateNextAction("a", NextActionUpdate{ProjectID: &none, CompletedAt: &done})
+	must(t, err)
+	if updated.ProjectID != "" || updated.CompletedAt != done || updated.Size != "small" {
+		t.Errorf("updated action: got %+v", updated)
+	}
+	must(t, store.DeleteNextAction("b"))
+
+	actions, err := store.ListNextActions(NextActionFilter{})
+	must(t, err)
+	if got, want := actionIDs(actions), []string{"a"}; !slices.Equal(got, want) {
+		t.Errorf("next actions: got %v, want %v", got, want)
+	}
+}
+
+func testNextActionFilters(t *testing.T, store Store) {
+	must(t, store.CreateProject(&Project{ID: "p", Name: "P"}))
+	must(t, store.CreateNextAction(&NextAction{ID: "call", Action: "Call", Contexts: []string{"phone"}}))
+	must(t, store.CreateNextAction(&NextAction{ID: "write", Action: "Write", ProjectID: "p"}))
+	must(t, store.CreateNextAction(&NextAction{ID: "later", Action: "Later", ProjectID: "p", DeferUntil: "2999-01-01"}))
+
+	tests := []struct {
+		filter NextActionFilter
+		want   []string
+	}{
+		{NextActionFilter{}, []string{"call", "write"}},
+		{NextActionFilter{IncludeDeferred: true}, []string{"call", "write", "later"}},
+		{NextActionFilter{Context: "@phone"}, []string{"call"}},
+		{NextActionFilter{ProjectID: "p", IncludeDeferred: true}, []string{"write", "later"}},
+	}
+	for _, tt := range tests {
+		actions, err := store.ListNextActions(tt.filter)
+		must(t, err)
+		if got := actionIDs(actions); !slices.Equal(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	action, err := store.GetNextAction("call")
+	must(t, err)
+	if !slices.Equal(action.Contexts, []string{"@phone"}) {
+		t.Errorf("got contexts %v, want [@phone]", action.Contexts)
+	}
+}
+
+func testProjectReferences(t *testing.T, store Store) {
+	if err := store.CreateNextAction(&NextAction{Action: "Stray", ProjectID: "missing"}); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("action of a missing project: got %v, want ErrInvalidReference", err)
+	}
+	must(t, store.CreateProject(&Project{ID: "trashed", Name: "Trashed"}))
+	must(t, store.DeleteProject("trashed", ProjectDeletion{Actions: ProjectActionsOrphan}))
+	if err := store.CreateWaitingFor(&WaitingFor{What: "Stray", ProjectID: "trashed"}); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("waiting-for of a trashed project: got %v, want ErrInvalidReference", err)
+	}
+}
+
+func testContexts(t *testing.T, store Store) {
+	phone := Context{Name: "@phone"}
+	must(t, store.CreateContext(&phone))
+	if err := store.CreateContext(&Context{Name: "@phone"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate context: got %v, want ErrConflict", err)
+	}
+	must(t, store.CreateNextAction(&NextAction{ID: "call", Action: "Call", Contexts: []string{"@phone"}}))
+
+	_, err := store.RenameContext(phone.ID, "@call")
+	must(t, err)
+	action, err := store.GetNextAction("call")
+	must(t, err)
+	if !slices.Equal(action.Contexts, []string{"@call"}) {
+		t.Errorf("after renaming the context the action has %v, want [@call]", action.Contexts)
+	}
+
+	must(t, store.DeleteContext(phone.ID))
+	if action, err = store.GetNextAction("call"); err != nil {
+		t.Fatal(err)
+	}
+	if len(action.Contexts) != 0 {
+		t.Errorf("after deleting the context the action has %v", action.Contexts)
+	}
+	contexts, err := store.ListContexts()
+	must(t, err)
+	if len(contexts) != 0 {
+		t.Errorf("got %d contexts after deleting the only one", len(contexts))
+	}
+}
+
+func testWaitingFor(t *testing.T, store Store) {
+	must(t, store.CreateWaitingFor(&WaitingFor{ID: "due", What: "Quote", DelegatedTo: "Bob", FollowUpAt: "2020-01-01"}))
+	must(t, store.CreateWaitingFor(&WaitingFor{ID: "later", What: "Invoice", DelegatedTo: "Ann", FollowUpAt: "2999-01-01"}))
+
+	items, err := store.ListWaitingFor(WaitingForFilter{FollowUpDue: "2025-01-01"})
+	must(t, err)
+	if got := ids(items, func(w WaitingFor) string { return w.ID }); !slices.Equal(got, []string{"due"}) {
+		t.Errorf("due follow-ups: got %v, want [due]", got)
+	}
+
+	resolved := "2025-01-02"
+	_, err = store.UpdateWaitingFor("due", WaitingForUpdate{ResolvedAt: &resolved})
+	must(t, err)
+	if items, err = store.ListWaitingFor(WaitingForFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "later" {
+		t.Errorf("unresolved items: got %v, want [later]", ids(items, func(w WaitingFor) string { return w.ID }))
+	}
+	if items, err = store.ListWaitingFor(WaitingForFilter{IncludeResolved: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d items including resolved ones, want 2", len(items))
+	}
+}
+
+func testSomedayPromotion(t *testing.T, store Store) {
+	item := SomedayItem{Title: "Learn the cello"}
+	must(t, store.CreateSomeday(&item))
+	project, err := store.PromoteSomeday(item.ID)
+	must(t, err)
+	if project.Name != item.Title || project.Status != ProjectActive {
+		t.Errorf("promoted project: got %+v", project)
+	}
+	if _, err := store.GetSomeday(item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("promoted someday item: got %v, want ErrNotFound", err)
+	}
+	// The someday item goes to the trash, so promoting it can be undone
+	must(t, store.RestoreTrash(TrashSomeday, item.ID))
+}
+
+func testInbox(t *testing.T, store Store) {
+	item := InboxItem{Description: "Renew passport", URL: "https://example.com"}
+	must(t, store.CreateInboxItem(&item))
+	if item.ID == "" || item.CreatedAt == "" {
+		t.Errorf("created item: got %+v, want an ID and creation time", item)
+	}
+	must(t, store.CreateInboxItem(&InboxItem{ID: "other", Description: "Call mum"}))
+	must(t, store.DeleteInboxItem(item.ID))
+
+	items, err := store.ListInboxItems(InboxFilter{})
+	must(t, err)
+	if len(items) != 1 || items[0].ID != "other" {
+		t.Errorf("inbox: got %+v, want only the item left", items)
+	}
+}
+
+func testInboxProcessing(t *testing.T, store Store) {
+	item := InboxItem{Description: "Call the plumber"}
+	must(t, store.CreateInboxItem(&item))
+	if item.State != InboxOpen {
+		t.Fatalf("new item is %s, want %s", item.State, InboxOpen)
+	}
+	action := NextAction{ID: "call"}
+	must(t, store.ProcessInboxItem(item.ID, InboxProcessing{NextAction: &action}))
+
+	created, err := store.GetNextAction("call")
+	must(t, err)
+	if created.Action != item.Description || created.InboxItemID != item.ID {
+		t.Errorf("action made from the item: got %+v", created)
+	}
+	processed, err := store.GetInboxItem(item.ID)
+	must(t, err)
+	if processed.State != InboxProcessed || processed.ProcessedAt == "" {
+		t.Errorf("processed item: got %+v", processed)
+	}
+
+	open := InboxOpen
+	if _, err := store.UpdateInboxItem(item.ID, InboxItemUpdate{State: &open}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("reopening a processed item: got %v, want ErrInvalidTransition", err)
+	}
+	if err := store.ProcessInboxItem(item.ID, InboxProcessing{Reference: &ReferenceItem{}}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("processing an item twice: got %v, want ErrInvalidTransition", err)
+	}
+}
+
+func testTrash(t *testing.T, store Store) {
+	item := ReferenceItem{Title: "Manual"}
+	must(t, store.CreateReference(&item))
+	must(t, store.DeleteReference(item.ID))
+	if _, err := store.GetReference(item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("trashed reference: got %v, want ErrNotFound", err)
+	}
+	trash, err := store.ListTrash()
+	must(t, err)
+	if len(trash) != 1 || trash[0].Type != TrashReference || trash[0].Title != "Manual" {
+		t.Fatalf("got trash %+v", trash)
+	}
+
+	must(t, store.RestoreTrash(TrashReference, item.ID))
+	if _, err := store.GetReference(item.ID); err != nil {
+		t.Errorf("restored reference: %v", err)
+	}
+
+	must(t, store.DeleteReference(item.ID))
+	purged, err := store.PurgeTrash(time.Now().Add(time.Minute))
+	must(t, err)
+	if purged != 1 {
+		t.Errorf("purged %d records, want 1", purged)
+	}
+	if err := store.RestoreTrash(TrashReference, item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring a purged record: got %v, want ErrNotFound", err)
+	}
+}
+
+// testTrashByType trashes a record whose ID records of other types share,
+// which only puts that one record in the trash.
+func testTrashByType(t *testing.T, store Store) {
+	must(t, store.CreateProject(&Project{ID: "x", Name: "Project"}))
+	must(t, store.CreateNextAction(&NextAction{ID: "x", Action: "Action"}))
+	must(t, store.CreateWaitingFor(&WaitingFor{ID: "x", What: "Reply"}))
+	must(t, store.CreateSomeday(&SomedayItem{ID: "x", Title: "Someday"}))
+	must(t, store.CreateReference(&ReferenceItem{ID: "x", Title: "Manual"}))
+	must(t, store.DeleteNextAction("x"))
+
+	if _, err := store.GetProject("x"); err != nil {
+		t.Errorf("project: %v", err)
+	}
+	if _, err := store.GetWaitingFor("x"); err != nil {
+		t.Errorf("waiting for: %v", err)
+	}
+	if _, err := store.GetSomeday("x"); err != nil {
+		t.Errorf("someday: %v", err)
+	}
+	if _, err := store.GetReference("x"); err != nil {
+		t.Errorf("reference: %v", err)
+	}
+	projects, err := store.ListProjects(ProjectFilter{})
+	must(t, err)
+	if got := projectIDs(projects); !slices.Equal(got, []string{"x"}) {
+		t.Errorf("projects: got %v, want [x]", got)
+	}
+	trash, err := store.ListTrash()
+	must(t, err)
+	if len(trash) != 1 || trash[0].Type != TrashNextAction || trash[0].Title != "Action" {
+		t.Fatalf("got trash %+v, want only the next action", trash)
+	}
+	if err := store.RestoreTrash(TrashProject, "x"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring the project: got %v, want ErrNotFound", err)
+	}
+
+	must(t, store.DeleteReference("x"))
+	must(t, store.RestoreTrash(TrashNextAction, "x"))
+	if _, err := store.GetNextAction("x"); err != nil {
+		t.Errorf("restored next action: %v", err)
+	}
+	if _, err := store.GetReference("x"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("trashed reference: got %v, want ErrNotFound", err)
+	}
+}
+
+func testDeferredRelease(t *testing.T, store Store) {
+	item := InboxItem{Description: "Renew passport", DeferUntil: "2020-01-01"}
+	must(t, store.CreateInboxItem(&item))
+	if item.State != InboxDeferred {
+		t.Fatalf("item with a defer date is %s, want %s", item.State, InboxDeferred)
+	}
+	must(t, store.CreateNextAction(&NextAction{ID: "later", Action: "Later", DeferUntil: "2999-01-01"}))
+
+	items, actions, err := store.ReleaseDeferred(time.Now())
+	must(t, err)
+	if len(items) != 1 || items[0].ID != item.ID || len(actions) != 0 {
+		t.Fatalf("released %d items and %d actions, want the item only", len(items), len(actions))
+	}
+	released, err := store.GetInboxItem(item.ID)
+	must(t, err)
+	if released.State != InboxOpen || released.DeferUntil != "" {
+		t.Errorf("released item: got %+v", released)
+	}
+}
+
+func testOperations(t *testing.T, store Store) {
+	first := Operation{SessionID: "s", UserID: "u", Name: "first"}
+	second := Operation{SessionID: "s", UserID: "u", Name: "second"}
+	must(t, store.RecordOperation(&first))
+	must(t, store.RecordOperation(&second))
+	must(t, store.RecordOperation(&Operation{SessionID: "s", UserID: "other", Name: "other"}))
+
+	op, err := store.OperationToUndo("s", "u")
+	must(t, err)
+	if op.ID != second.ID {
+		t.Fatalf("undo: got %q, want second", op.Name)
+	}
+	must(t, store.SetOperationUndone(second.ID, true))
+	if op, err = store.OperationToUndo("s", "u"); err != nil || op.ID != first.ID {
+		t.Fatalf("undo after undoing second: got %q, %v, want first", op.Name, err)
+	}
+	if op, err = store.OperationToRedo("s", "u"); err != nil || op.ID != second.ID {
+		t.Fatalf("redo: got %q, %v, want second", op.Name, err)
+	}
+
+	// A new operation drops the undone one
+	must(t, store.RecordOperation(&Operation{SessionID: "s", UserID: "u", Name: "third"}))
+	if _, err := store.OperationToRedo("s", "u"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("redo after a new operation: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.OperationToUndo("s", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("undo without the user: got %v, want ErrNotFound", err)
+	}
+}
+
+func testHistory(t *testing.T, store Store) {
+	must(t, store.AppendHistory([]HistoryEntry{
+		{RecordType: TrashProject, RecordID: "p", Operation: "create project", Changes: []FieldChange{{Field: "name", To: "P"}}},
+		{RecordType: TrashNextAction, RecordID: "a", Operation: "create next action", UserID: "u"},
+		{RecordType: TrashProject, RecordID: "p", Operation: "update project"},
+	}))
+
+	entries, err := store.ListHistory(HistoryFilter{RecordType: TrashProject, RecordID: "p", Limit: 10})
+	must(t, err)
+	if got := ids(entries, func(e HistoryEntry) string { return e.Operation }); !slices.Equal(got, []string{"update project", "create project"}) {
+		t.Fatalf("got history %v", got)
+	}
+	if entries[1].Changes[0].To != "P" {
+		t.Errorf("got changes %+v", entries[1].Changes)
+	}
+
+	older, err := store.ListHistory(HistoryFilter{Before: entries[0].ID, Limit: 1})
+	must(t, err)
+	if len(older) != 1 || older[0].UserID != "u" {
+		t.Errorf("entry before the latest: got %+v", older)
+	}
+}
+
+func testEvents(t *testing.T, store Store) {
+	must(t, store.CreateProject(&Project{ID: "p", Name: "P"}))
+	must(t, store.CreateNextAction(&NextAction{ID: "a", Action: "A", ProjectID: "p"}))
+	must(t, store.DeleteNextAction("a"))
+
+	events, latest, err := store.EventsSince(0)
+	must(t, err)
+	type summary struct{ eventType, id string }
+	got := []summary{}
+	for i, event := range events {
+		got = append(got, summary{event.Type, event.EntityID})
+		if event.Sequence != int64(i+1) {
+			t.Errorf("event %d has seq %d", i, event.Sequence)
+		}
+	}
+	want := []summary{
+		{"project.created", "p"},
+		{"next_action.created", "a"},
+		{"next_action.deleted", "a"},
+	}
+	if !slices.Equal(got, want) || latest != 3 {
+		t.Fatalf("got events %v up to %d, want %v up to 3", got, latest, want)
+	}
+	if !slices.Equal(events[2].Scopes, []string{projectScope("p")}) {
+		t.Errorf("deletion has scopes %v, want the project's", events[2].Scopes)
+	}
+
+	if events, _, err = store.EventsSince(2); err != nil || len(events) != 1 {
+		t.Errorf("events since 2: got %d, %v, want 1", len(events), err)
+	}
+	if _, _, err := store.EventsSince(10); !errors.Is(err, ErrEventsCompacted) {
+		t.Errorf("events since a future seq: got %v, want ErrEventsCompacted", err)
+	}
+}
+
+func testAtomicRollback(t *testing.T, store Store) {
+	failure := errors.New("failure")
+	err := store.Atomically(func(tx Store) error {
+		must(t, tx.CreateProject(&Project{ID: "p", Name: "P"}))
+		if _, err := tx.GetProject("p"); err != nil {
+			t.Errorf("the transaction doesn't see its own project: %v", err)
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the error of fn", err)
+	}
+	if _, err := store.GetProject("p"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("project of a failed transaction: got %v, want ErrNotFound", err)
+	}
+	if events, _, err := store.EventsSince(0); err != nil || len(events) != 0 {
+		t.Errorf("failed transaction logged %d events, %v", len(events), err)
+	}
+}
+
+func testUsers(t *testing.T, store Store) {
+	user := User{Username: "alice", PasswordHash: "hash"}
+	must(t, store.CreateUser(&user))
+	if err := store.CreateUser(&User{Username: "alice", PasswordHash: "hash"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate username: got %v, want ErrConflict", err)
+	}
+	got, err := store.GetUserByUsername("alice")
+	must(t, err)
+	if got.ID != user.ID || got.PasswordHash != "hash" {
+		t.Errorf("got user %+v", got)
+	}
+	if count, err := store.CountUsers(); err != nil || count != 1 {
+		t.Errorf("got %d users, %v, want 1", count, err)
+	}
+
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	must(t, store.CreateLoginSession(&LoginSession{TokenHash: "live", UserID: user.ID, ExpiresAt: expires}))
+	must(t, store.CreateLoginSession(&LoginSession{TokenHash: "expired", UserID: user.ID, ExpiresAt: "2020-01-01T00:00:00Z"}))
+	if session, err := store.GetLoginSession("live"); err != nil || session.UserID != user.ID {
+		t.Errorf("live session: got %+v, %v", session, err)
+	}
+	if _, err := store.GetLoginSession("expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired session: got %v, want ErrNotFound", err)
+	}
+	must(t, store.DeleteLoginSession("live"))
+	if _, err := store.GetLoginSession("live"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted session: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentCreates fires hundreds of creates at once at a SQLite
+// database. Each must get a position of its own, and its history and undo
+// entries, rather than fail on the UNIQUE positions or a busy database.
+func TestConcurrentCreates(t *testing.T) {
+	const n = 200
+	store := newSQLiteStore(t, nil)
+	srv := newTestServer(t, store, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		for path, body := range map[string]any{
+			"/api/projects":     map[string]any{"name": fmt.Sprintf("Project %d", i)},
+			"/api/next-actions": map[string]any{"action": fmt.Sprintf("Action %d", i)},
+		} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, data := request(t, srv, http.MethodPost, path, fmt.Sprintf("session-%d", i), body)
+				if status != http.StatusOK {
+					errs <- fmt.Errorf("POST %s: %d %s", path, status, data)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	projects, err := store.ListProjects(ProjectFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := store.ListNextActions(NextActionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != n || len(actions) != n {
+		t.Fatalf("got %d projects and %d next actions, want %d of each", len(projects), len(actions), n)
+	}
+	positions := map[float64]bool{}
+	for _, project := range projects {
+		positions[project.Position] = true
+	}
+	if len(positions) != n {
+		t.Errorf("projects share positions: %d distinct for %d projects", len(positions), n)
+	}
+
+	history, err := store.ListHistory(HistoryFilter{Limit: 4 * n})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2*n {
+		t.Errorf("got %d history entries, want %d", len(history), 2*n)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := store.OperationToUndo(fmt.Sprintf("session-%d", i), ""); err != nil {
+			t.Errorf("session-%d has nothing to undo: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// parseDeferUntil normalizes a defer date given by a client. Plain dates
+// (YYYY-MM-DD) mean midnight in loc on that day; full RFC 3339 timestamps
+// are also accepted. The result is an RFC 3339 UTC timestamp, or an empty
+// string if s is empty.
+func parseDeferUntil(s string, loc *time.Location) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, loc)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			return "", errors.New("defer_until must be a YYYY-MM-DD date or an RFC 3339 timestamp")
+		}
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// isDeferred reports whether a record deferred until the given RFC 3339 UTC
+// timestamp is still hidden at now.
+func isDeferred(deferUntil string, now time.Time) bool {
+	return deferUntil > now.UTC().Format(time.RFC3339)
+}
+
+// RunTickler releases deferred inbox items and next actions once their date
+// arrives, checking every interval. Clients hear about them through the
+// events of the store.
+func RunTickler(store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		releaseDeferred(store, time.Now())
+		<-ticker.C
+	}
+}
+
+func releaseDeferred(store Store, now time.Time) {
+	items, actions, err := store.ReleaseDeferred(now)
+	if err != nil {
+		log.Printf("Error releasing deferred records: %v", err)
+		return
+	}
+
+	for _, item := range items {
+		log.Printf("Tickler released inbox item %s", item.ID)
+	}
+	for _, action := range actions {
+		log.Printf("Tickler released next action %s", action.ID)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// RunTrashPurge permanently deletes records that have been in the trash for
+// longer than retention, checking every interval.
+func RunTrashPurge(store Store, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := store.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Error purging trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d records from the trash", purged)
+		}
+		<-ticker.C
+	}
+}
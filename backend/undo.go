@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionHeader names the request header identifying the client session a
+// request comes from. Each session has its own undo history; requests
+// without one aren't journaled.
+const sessionHeader = "X-Session-ID"
+
+// snapshot returns the current state of a record as JSON, or nil if it
+// doesn't exist or is in the trash. Record types are the ones used by the
+// trash and HistoryContext. Timestamps the store sets on status changes are left out, since
+// they can't be brought back and would make a record that was undone and
+// redone look changed.
+func snapshot(store Store, recordType string, id string) (json.RawMessage, error) {
+	var record any
+	var err error
+	switch recordType {
+	case TrashProject:
+		var project Project
+		project, err = store.GetProject(id)
+		project.CompletedAt = ""
+		record = project
+	case TrashNextAction:
+		record, err = store.GetNextAction(id)
+	case TrashWaitingFor:
+		record, err = store.GetWaitingFor(id)
+	case TrashSomeday:
+		record, err = store.GetSomeday(id)
+	case TrashReference:
+		record, err = store.GetReference(id)
+	case TrashInboxItem:
+		var item InboxItem
+		item, err = store.GetInboxItem(id)
+		if err == nil && item.State == InboxDeleted {
+			err = ErrNotFound
+		}
+		item.DeferredAt, item.ProcessedAt, item.DeletedAt = "", "", ""
+		record = item
+	case HistoryContext:
+		record, err = findContext(store, id)
+	default:
+		return nil, fmt.Errorf("unknown record type %q", recordType)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// beforeChange snapshots records that are about to change. The result is
+// passed to journal once the change is made.
+func beforeChange(store Store, recordType string, ids ...string) ([]RecordChange, error) {
+	changes := []RecordChange{}
+	for _, id := range ids {
+		before, err := snapshot(store, recordType, id)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s %s before changing it: %w", recordType, id, err)
+		}
+		changes = append(changes, RecordChange{Type: recordType, ID: id, Before: before})
+	}
+	return changes, nil
+}
+
+// beforeProjectChange snapshots a project that is about to change together
+// with its next actions and waiting-for items.
+func beforeProjectChange(store Store, projectID string) ([]RecordChange, error) {
+	actions, err := store.ListNextActions(NextActionFilter{IncludeDeferred: true})
+	if err != nil {
+		return nil, err
+	}
+	waitingFor, err := store.ListWaitingFor(WaitingForFilter{IncludeResolved: true})
+	if err != nil {
+		return nil, err
+	}
+
+	// The project comes last so that undoing restores it before the
+	// records that point at it
+	actionIDs, itemIDs := []string{}, []string{}
+	for _, action := range actions {
+		if action.ProjectID == projectID {
+			actionIDs = append(actionIDs, action.ID)
+		}
+	}
+	for _, item := range waitingFor {
+		if item.ProjectID == projectID {
+			itemIDs = append(itemIDs, item.ID)
+		}
+	}
+	changes := []RecordChange{}
+	for _, group := range []struct {
+		recordType string
+		ids        []string
+	}{{TrashNextAction, actionIDs}, {TrashWaitingFor, itemIDs}, {TrashProject, []string{projectID}}} {
+		before, err := beforeChange(store, group.recordType, group.ids...)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, before...)
+	}
+	return changes, nil
+}
+
+// findContext looks a context up by its ID.
+func findContext(store Store, id string) (Context, error) {
+	contexts, err := store.ListContexts()
+	if err != nil {
+		return Context{}, err
+	}
+	for _, context := range contexts {
+		if context.ID == id {
+			return context, nil
+		}
+	}
+	return Context{}, ErrNotFound
+}
+
+// beforeContextChange snapshots a context that is about to be renamed or
+// deleted together with the next actions that have it.
+func beforeContextChange(store Store, contextID string) ([]RecordChange, error) {
+	context, err := findContext(store, contextID)
+	if errors.Is(err, ErrNotFound) {
+		return beforeChange(store, HistoryContext, contextID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	actions, err := store.ListNextActions(NextActionFilter{Context: context.Name, IncludeDeferred: true})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, action := range actions {
+		ids = append(ids, action.ID)
+	}
+	changes, err := beforeChange(store, TrashNextAction, ids...)
+	if err != nil {
+		return nil, err
+	}
+	before, err := beforeChange(store, HistoryContext, contextID)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, before...), nil
+}
+
+// journal records the changes made by a request in the history of the
+// records, and as an operation its session and user can undo, through the
+// store that made the changes. Records created by the request are passed
+// with no Before state.
+func journal(store Store, c *gin.Context, name string, changes []RecordChange) error {
+	changed, err := recordHistory(store, c, name, changes)
+	sessionID := c.GetHeader(sessionHeader)
+	if err != nil || !changed || sessionID == "" {
+		return err
+	}
+
+	op := Operation{SessionID: sessionID, UserID: c.GetString(userIDKey), Name: name, Changes: changes}
+	if err := store.RecordOperation(&op); err != nil {
+		return fmt.Errorf("journaling %s: %w", name, err)
+	}
+	return nil
+}
+
+// journaled makes a change with fn and journals the changes it returns, in
+// one transaction, so the change is never made without its history and
+// undo entry. fn snapshots the records it changes with beforeChange through
+// the transaction's store, before changing them through it.
+func (s *Server) journaled(c *gin.Context, name string, fn func(tx Store) ([]RecordChange, error)) error {
+	return s.store.Atomically(func(tx Store) error {
+		changes, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		return journal(tx, c, name, changes)
+	})
+}
+
+// recorded is journaled for changes that can't be undone, which only go to
+// the history.
+func (s *Server) recorded(c *gin.Context, name string, fn func(tx Store) ([]RecordChange, error)) error {
+	return s.store.Atomically(func(tx Store) error {
+		changes, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		_, err = recordHistory(tx, c, name, changes)
+		return err
+	})
+}
+
+// deleteRecord moves a record to the trash.
+func deleteRecord(store Store, recordType string, id string) error {
+	switch recordType {
+	case TrashProject:
+		// The project's records are changes of their own in the operation
+		return store.DeleteProject(id, ProjectDeletion{Actions: ProjectActionsOrphan})
+	case TrashNextAction:
+		return store.DeleteNextAction(id)
+	case TrashWaitingFor:
+		return store.DeleteWaitingFor(id)
+	case TrashSomeday:
+		return store.DeleteSomeday(id)
+	case TrashReference:
+		return store.DeleteReference(id)
+	case TrashInboxItem:
+		return store.DeleteInboxItem(id)
+	}
+	return fmt.Errorf("unknown record type %q", recordType)
+}
+
+// setState brings a record from its current state to one taken by snapshot,
+// taking it out of or moving it to the trash as needed.
+func setState(store Store, recordType string, id string, current, state json.RawMessage) error {
+	if state == nil {
+		return deleteRecord(store, recordType, id)
+	}
+	if current == nil {
+		if err := store.RestoreTrash(recordType, id); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch recordType {
+	case TrashProject:
+		var project, live Project
+		if err := json.Unmarshal(state, &project); err != nil {
+			return err
+		}
+		if live, err = store.GetProject(id); err != nil {
+			return err
+		}
+		update := ProjectUpdate{Position: &project.Position, Deadline: &project.Deadline}
+		if project.Status != live.Status {
+			update.Status = &project.Status
+		}
+		_, err = store.UpdateProject(id, update)
+	case TrashNextAction:
+		var action NextAction
+		if err := json.Unmarshal(state, &action); err != nil {
+			return err
+		}
+		_, err = store.UpdateNextAction(id, NextActionUpdate{
+			Action:          &action.Action,
+			ProjectID:       &action.ProjectID,
+			URL:             &action.URL,
+			Size:            &action.Size,
+			Energy:          &action.Energy,
+			CompletedAt:     &action.CompletedAt,
+			Position:        &action.Position,
+			DeferUntil:      &action.DeferUntil,
+			Recurrence:      &action.Recurrence,
+			RecurrenceStart: &action.RecurrenceStart,
+			OccursAt:        &action.OccursAt,
+			Contexts:        &action.Contexts,
+			ProjectPosition: action.ProjectPosition,
+		})
+	case TrashWaitingFor:
+		var item WaitingFor
+		if err := json.Unmarshal(state, &item); err != nil {
+			return err
+		}
+		_, err = store.UpdateWaitingFor(id, WaitingForUpdate{
+			What:        &item.What,
+			DelegatedTo: &item.DelegatedTo,
+			DelegatedAt: &item.DelegatedAt,
+			FollowUpAt:  &item.FollowUpAt,
+			ProjectID:   &item.ProjectID,
+			ResolvedAt:  &item.ResolvedAt,
+		})
+	case TrashSomeday:
+		var item SomedayItem
+		if err := json.Unmarshal(state, &item); err != nil {
+			return err
+		}
+		_, err = store.UpdateSomeday(id, SomedayUpdate{Title: &item.Title, Notes: &item.Notes, URL: &item.URL})
+	case TrashInboxItem:
+		var item, live InboxItem
+		if err := json.Unmarshal(state, &item); err != nil {
+			return err
+		}
+		if live, err = store.GetInboxItem(id); err != nil {
+			return err
+		}
+		// Undoing the processing of an item brings it back from processed
+		update := InboxItemUpdate{Description: &item.Description, URL: &item.URL, DeferUntil: &item.DeferUntil, Unprocess: true}
+		if item.State != live.State {
+			update.State = &item.State
+		}
+		_, err = store.UpdateInboxItem(id, update)
+	}
+	return err
+}
+
+// Undo reverts the latest operation of the client's session and user that
+// isn't undone yet.
+func (s *Server) Undo(c *gin.Context) {
+	s.replayOperation(c, true)
+}
+
+// Redo makes the earliest undone operation of the client's session and user
+// again.
+func (s *Server) Redo(c *gin.Context) {
+	s.replayOperation(c, false)
+}
+
+// replayOperation undoes or redoes an operation of the client's session and
+// user. It refuses to if any record the operation touched has changed since,
+// so it never overwrites someone else's work.
+func (s *Server) replayOperation(c *gin.Context, undo bool) {
+	sessionID := c.GetHeader(sessionHeader)
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the " + sessionHeader + " header is required"})
+		return
+	}
+
+	verb := "redo"
+	if undo {
+		verb = "undo"
+	}
+
+	// The operation is looked up, checked and replayed in one transaction,
+	// so it is replayed once and either entirely or not at all
+	var op Operation
+	var changed *RecordChange
+	var applied []RecordChange
+	err := s.store.Atomically(func(tx Store) error {
+		op, changed, applied = Operation{}, nil, []RecordChange{}
+		find := tx.OperationToRedo
+		if undo {
+			find = tx.OperationToUndo
+		}
+		var err error
+		if op, err = find(sessionID, c.GetString(userIDKey)); err != nil {
+			return err
+		}
+
+		// Undoing walks the changes backwards, from their state after the
+		// operation to the one before; redoing walks them forwards.
+		changes := slices.Clone(op.Changes)
+		if undo {
+			slices.Reverse(changes)
+			for i, change := range changes {
+				changes[i].Before, changes[i].After = change.After, change.Before
+			}
+		}
+
+		for _, change := range changes {
+			current, err := snapshot(tx, change.Type, change.ID)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(current, change.Before) {
+				changed = &change
+				return ErrConflict
+			}
+		}
+		for _, change := range changes {
+			if err := setState(tx, change.Type, change.ID, change.Before, change.After); err != nil {
+				return err
+			}
+			applied = append(applied, RecordChange{Type: change.Type, ID: change.ID, Before: change.Before})
+		}
+		if _, err := recordHistory(tx, c, verb+" "+op.Name, applied); err != nil {
+			return err
+		}
+		return tx.SetOperationUndone(op.ID, undo)
+	})
+	if op.ID == 0 && errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nothing to " + verb})
+		return
+	}
+	if changed != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Can't %s %s: %s %s has changed since", verb, op.Name, changed.Type, changed.ID)})
+		return
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidTransition) || errors.Is(err, ErrInvalidReference) || errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Can't %s %s: %v", verb, op.Name, err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := []gin.H{}
+	for _, change := range applied {
+		// data is null for records that went to the trash
+		result = append(result, gin.H{"type": change.Type, "id": change.ID, "data": change.After})
+	}
+	c.JSON(http.StatusOK, gin.H{"name": op.Name, "changes": result})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestUndoRecurringCompletion undoes and redoes completing a recurring
+// action, which also creates its next occurrence.
+func TestUndoRecurringCompletion(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			store := kind.new(t, nil)
+			srv := newTestServer(t, store, nil)
+			const session = "session"
+
+			status, data := request(t, srv, http.MethodPost, "/api/next-actions", session,
+				map[string]any{"action": "Water the plants", "recurrence": "FREQ=DAILY"})
+			if status != http.StatusOK {
+				t.Fatalf("create: %d %s", status, data)
+			}
+			var action NextAction
+			if err := json.Unmarshal(data, &action); err != nil {
+				t.Fatal(err)
+			}
+			status, data = request(t, srv, http.MethodPatch, "/api/next-actions/"+action.ID, session,
+				map[string]any{"completed_at": "2024-01-01T10:00:00Z"})
+			if status != http.StatusOK {
+				t.Fatalf("complete: %d %s", status, data)
+			}
+
+			open := func() []NextAction {
+				t.Helper()
+				actions, err := store.ListNextActions(NextActionFilter{IncludeDeferred: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []NextAction
+				for _, action := range actions {
+					if action.CompletedAt == "" {
+						result = append(result, action)
+					}
+				}
+				return result
+			}
+			actions := open()
+			if len(actions) != 1 || actions[0].ID == action.ID {
+				t.Fatalf("got open actions %+v after completing, want the next occurrence", actions)
+			}
+			next := actions[0].ID
+
+			if status, data := request(t, srv, http.MethodPost, "/api/undo", session, nil); status != http.StatusOK {
+				t.Fatalf("undo: %d %s", status, data)
+			}
+			actions = open()
+			if len(actions) != 1 || actions[0].ID != action.ID {
+				t.Fatalf("got open actions %+v after undoing, want only the original", actions)
+			}
+
+			if status, data := request(t, srv, http.MethodPost, "/api/redo", session, nil); status != http.StatusOK {
+				t.Fatalf("redo: %d %s", status, data)
+			}
+			actions = open()
+			if len(actions) != 1 || actions[0].ID != next {
+				t.Fatalf("got open actions %+v after redoing, want only the next occurrence %s", actions, next)
+			}
+		})
+	}
+}
+
+// TestUndoConflict refuses to undo a change to a record that has been
+// changed since, and leaves everything as it was.
+func TestUndoConflict(t *testing.T) {
+	store := NewMemoryStore(nil)
+	srv := newTestServer(t, store, nil)
+
+	status, data := request(t, srv, http.MethodPost, "/api/next-actions", "mine", map[string]any{"action": "Dig"})
+	if status != http.StatusOK {
+		t.Fatalf("create: %d %s", status, data)
+	}
+	var action NextAction
+	if err := json.Unmarshal(data, &action); err != nil {
+		t.Fatal(err)
+	}
+	if status, data := request(t, srv, http.MethodPatch, "/api/next-actions/"+action.ID, "theirs", map[string]any{"action": "Dig deeper"}); status != http.StatusOK {
+		t.Fatalf("rename: %d %s", status, data)
+	}
+
+	if status, data := request(t, srv, http.MethodPost, "/api/undo", "mine", nil); status != http.StatusConflict {
+		t.Fatalf("undo: got %d %s, want %d", status, data, http.StatusConflict)
+	}
+	if _, err := store.GetNextAction(action.ID); err != nil {
+		t.Errorf("the action is gone after a refused undo: %v", err)
+	}
+	if _, err := store.OperationToUndo("mine", ""); err != nil {
+		t.Errorf("the refused undo is no longer available: %v", err)
+	}
+}
+
+// TestUndoOtherUser keeps users from undoing each other's operations, even
+// from sessions with the same ID.
+func TestUndoOtherUser(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			store := kind.new(t, nil)
+			manager := NewClientManager(store, &OriginPolicy{})
+			servers := map[string]*httptest.Server{}
+			for _, userID := range []string{"alice", "bob"} {
+				r := gin.New()
+				NewServer(store, manager).RegisterRoutes(r.Group("/api", func(c *gin.Context) { c.Set(userIDKey, userID) }))
+				servers[userID] = httptest.NewServer(r)
+				t.Cleanup(servers[userID].Close)
+			}
+			const session = "session"
+
+			status, data := request(t, servers["alice"], http.MethodPost, "/api/inbox", session, map[string]any{"description": "Milk"})
+			if status != http.StatusOK {
+				t.Fatalf("create: %d %s", status, data)
+			}
+			if status, data := request(t, servers["bob"], http.MethodPost, "/api/undo", session, nil); status != http.StatusNotFound {
+				t.Fatalf("undo by bob: got %d %s, want %d", status, data, http.StatusNotFound)
+			}
+			if status, data := request(t, servers["alice"], http.MethodPost, "/api/undo", session, nil); status != http.StatusOK {
+				t.Fatalf("undo by alice: %d %s", status, data)
+			}
+			if status, data := request(t, servers["bob"], http.MethodPost, "/api/redo", session, nil); status != http.StatusNotFound {
+				t.Fatalf("redo by bob: got %d %s, want %d", status, data, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+// undoRedo undoes and then redoes the latest operation of session, calling
+// check with whether it is undone after each step.
+func undoRedo(t *testing.T, srv *httptest.Server, session string, check func(undone bool)) {
+	t.Helper()
+	if status, data := request(t, srv, http.MethodPost, "/api/undo", session, nil); status != http.StatusOK {
+		t.Fatalf("undo: %d %s", status, data)
+	}
+	check(true)
+	if status, data := request(t, srv, http.MethodPost, "/api/redo", session, nil); status != http.StatusOK {
+		t.Fatalf("redo: %d %s", status, data)
+	}
+	check(false)
+}
+
+// exists reports whether a record of the given trash type exists outside
+// the trash.
+func exists(t *testing.T, store Store, recordType string, id string) bool {
+	t.Helper()
+	state, err := snapshot(store, recordType, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state != nil
+}
+
+// TestUndoPromoteSomeday brings a promoted someday item back in place of its
+// project.
+func TestUndoPromoteSomeday(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			store := kind.new(t, nil)
+			srv := newTestServer(t, store, nil)
+			const session = "session"
+
+			item := SomedayItem{Title: "Learn the cello"}
+			if err := store.CreateSomeday(&item); err != nil {
+				t.Fatal(err)
+			}
+			status, data := request(t, srv, http.MethodPost, "/api/someday/"+item.ID+"/promote", session, nil)
+			if status != http.StatusOK {
+				t.Fatalf("promote: %d %s", status, data)
+			}
+			var project Project
+			if err := json.Unmarshal(data, &project); err != nil {
+				t.Fatal(err)
+			}
+
+			undoRedo(t, srv, session, func(undone bool) {
+				t.Helper()
+				if exists(t, store, TrashSomeday, item.ID) != undone || exists(t, store, TrashProject, project.ID) == undone {
+					t.Errorf("undone %v: got someday item %v and project %v", undone,
+						exists(t, store, TrashSomeday, item.ID), exists(t, store, TrashProject, project.ID))
+				}
+			})
+		})
+	}
+}
+
+// TestUndoProcessInboxItem brings a processed inbox item back to the inbox
+// in place of the record made from it, for every kind of record.
+func TestUndoProcessInboxItem(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			for _, recordType := range []string{TrashNextAction, TrashProject, TrashWaitingFor, TrashSomeday, TrashReference} {
+				t.Run(recordType, func(t *testing.T) {
+					store := kind.new(t, nil)
+					srv := newTestServer(t, store, nil)
+					const session = "session"
+
+					item := InboxItem{Description: "Call the plumber"}
+					if err := store.CreateInboxItem(&item); err != nil {
+						t.Fatal(err)
+					}
+					data := map[string]any{}
+					if recordType == TrashWaitingFor {
+						data["delegated_to"] = "Bob"
+					}
+					status, body := request(t, srv, http.MethodPost, "/api/inbox/"+item.ID+"/process", session,
+						map[string]any{"type": recordType, "data": data})
+					if status != http.StatusOK {
+						t.Fatalf("process: %d %s", status, body)
+					}
+					var processed struct {
+						Data struct {
+							ID string `json:"id"`
+						} `json:"data"`
+					}
+					if err := json.Unmarshal(body, &processed); err != nil {
+						t.Fatal(err)
+					}
+
+					undoRedo(t, srv, session, func(undone bool) {
+						t.Helper()
+						checkProcessing(t, store, item.ID, recordType, processed.Data.ID, undone)
+					})
+				})
+			}
+		})
+	}
+}
+
+// TestUndoConvertInboxItemToWaitingFor brings an inbox item turned into a
+// waiting-for item back to the inbox.
+func TestUndoConvertInboxItemToWaitingFor(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			store := kind.new(t, nil)
+			srv := newTestServer(t, store, nil)
+			const session = "session"
+
+			item := InboxItem{Description: "Quote for the roof"}
+			if err := store.CreateInboxItem(&item); err != nil {
+				t.Fatal(err)
+			}
+			status, data := request(t, srv, http.MethodPost, "/api/inbox/"+item.ID+"/waiting-for", session,
+				map[string]any{"what": "Quote for the roof", "delegated_to": "Roofer"})
+			if status != http.StatusOK {
+				t.Fatalf("convert: %d %s", status, data)
+			}
+			var waitingFor WaitingFor
+			if err := json.Unmarshal(data, &waitingFor); err != nil {
+				t.Fatal(err)
+			}
+
+			undoRedo(t, srv, session, func(undone bool) {
+				t.Helper()
+				checkProcessing(t, store, item.ID, TrashWaitingFor, waitingFor.ID, undone)
+			})
+		})
+	}
+}
+
+// checkProcessing checks that an inbox item is back in the inbox without the
+// record made from it if undone is set, or processed into it otherwise.
+func checkProcessing(t *testing.T, store Store, itemID string, recordType string, recordID string, undone bool) {
+	t.Helper()
+	item, err := store.GetInboxItem(itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantState := InboxProcessed
+	if undone {
+		wantState = InboxOpen
+	}
+	if item.State != wantState {
+		t.Errorf("undone %v: inbox item is %s, want %s", undone, item.State, wantState)
+	}
+	if exists(t, store, recordType, recordID) == undone {
+		t.Errorf("undone %v: %s %s exists %v", undone, recordType, recordID, !undone)
+	}
+}
@@ -1,87 +1,561 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
+// Timing and buffering of websocket connections
+const (
+	writeWait     = 10 * time.Second  // time allowed to write a message
+	pongWait      = 60 * time.Second  // time allowed for the pong to a ping
+	pingPeriod    = pongWait * 9 / 10 // how often clients are pinged
+	sendQueueSize = 256               // messages queued for a client before it is dropped
+
+	// Events waiting to be queued for clients. Store writes only wait for
+	// the manager once this many are waiting.
+	broadcastQueueSize = 1024
+)
+
+// Reasons clients are dropped, besides disconnecting
+const (
+	dropSlowConsumer = "slow consumer" // its send queue is full
+	dropWriteFailure = "write failure" // a write failed or timed out
+	dropPingTimeout  = "ping timeout"  // it stopped answering pings
+)
+
+// maxClientMessageSize caps the size of messages clients send, which are
+// all small.
+const maxClientMessageSize = 4096
+
+// Types of the messages clients send. Clients can't send events: they only
+// choose what they get and keep the connection alive.
+const (
+	clientPing        = "ping"        // answered with a pong carrying the same ID
+	clientSubscribe   = "subscribe"   // from then on, get only the events of subscribed topics
+	clientUnsubscribe = "unsubscribe" // stop getting events of the given topics
+)
+
+// clientMessage is a message from a client.
+type clientMessage struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// eventTopics are the topics clients can subscribe to for all events of an
+// entity.
+var eventTopics = []string{EntityProject, EntityNextAction, EntityContext, EntityWaitingFor,
+	EntitySomeday, EntityReference, EntityInbox}
+
+// Topics narrower than an entity
+const (
+	projectTopicPrefix = "project:"     // project:<id>, a project with its next actions and waiting-for items
+	nextActionsTopic   = "next-actions" // next-actions?context=<name>, the next actions in a context
+)
+
+// topic selects the events a client gets. Project and context topics match
+// an event on the scopes of the entity before and after the change, so a
+// next action moved out of a project, or deleted, still reaches the topic it
+// leaves.
+type topic struct {
+	entity    string // all events of the entity, if projectID and context are empty
+	projectID string
+	context   string
+}
+
+// parseTopic parses the name of a topic.
+func parseTopic(name string) (topic, error) {
+	if slices.Contains(eventTopics, name) {
+		return topic{entity: name}, nil
+	}
+	if projectID, ok := strings.CutPrefix(name, projectTopicPrefix); ok {
+		if projectID == "" {
+			return topic{}, fmt.Errorf("topic %q needs a project ID", name)
+		}
+		return topic{entity: EntityProject, projectID: projectID}, nil
+	}
+	if path, rawQuery, _ := strings.Cut(name, "?"); path == nextActionsTopic {
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return topic{}, fmt.Errorf("invalid topic %q: %v", name, err)
+		}
+		t := topic{entity: EntityNextAction}
+		for key, values := range query {
+			if key != "context" || len(values) != 1 {
+				return topic{}, fmt.Errorf("topic %q can only filter by one context", name)
+			}
+			t.context = normalizeContextName(values[0])
+		}
+		return t, nil
+	}
+	return topic{}, fmt.Errorf("unknown topic %q", name)
+}
+
+// matches reports whether event belongs to the topic.
+func (t topic) matches(event Event) bool {
+	switch {
+	case t.projectID != "":
+		switch event.Entity {
+		case EntityProject, EntityNextAction, EntityWaitingFor:
+			return slices.Contains(event.Scopes, projectScope(t.projectID))
+		}
+		return false
+	case t.context != "":
+		return event.Entity == EntityNextAction && slices.Contains(event.Scopes, contextScope(t.context))
+	}
+	return event.Entity == t.entity
+}
+
+// parseClientMessage decodes and validates a message from a client.
+func parseClientMessage(data []byte) (clientMessage, error) {
+	var message clientMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&message); err != nil {
+		return clientMessage{}, fmt.Errorf("invalid message: %v", err)
+	}
+
+	switch message.Type {
+	case clientPing:
+	case clientSubscribe, clientUnsubscribe:
+		if len(message.Topics) == 0 {
+			return clientMessage{}, fmt.Errorf("%s needs topics", message.Type)
+		}
+		for _, name := range message.Topics {
+			if _, err := parseTopic(name); err != nil {
+				return clientMessage{}, err
+			}
+		}
+	default:
+		return clientMessage{}, fmt.Errorf("unknown message type %q", message.Type)
+	}
+	return message, nil
+}
+
+// outMessage is a message queued for a client.
+type outMessage struct {
+	seq  int64 // sequence number of the event it carries, 0 if it isn't one
+	data []byte
+}
+
+// streamClient is a websocket or SSE connection and what it subscribed to.
+// Messages to it are queued in send and written by its own goroutine, so a
+// stalled client doesn't hold up the others.
+type streamClient struct {
+	conn   *websocket.Conn // nil for SSE clients
+	addr   string
+	send   chan outMessage
+	topics map[string]topic // by name; nil until the client subscribes, to get every event
+	last   int64            // sequence number of the latest event queued for it
+
+	// While the events a reconnecting client missed are loaded, the ones
+	// broadcast meanwhile wait in backlog and send is nil
+	catchingUp bool
+	backlog    []outMessage
+}
+
+// wants reports whether the client subscribed to a topic of event.
+func (c *streamClient) wants(event Event) bool {
+	if c.topics == nil {
 		return true
-	},
+	}
+	for _, t := range c.topics {
+		if t.matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocketMetrics counts websocket and SSE clients, and the ones dropped by
+// the server by reason.
+type WebSocketMetrics struct {
+	Clients       int   `json:"clients"`   // connected now
+	Connected     int64 `json:"connected"` // since the server started
+	SlowConsumers int64 `json:"slow_consumers"`
+	WriteFailures int64 `json:"write_failures"`
+	PingTimeouts  int64 `json:"ping_timeouts"`
 }
 
 type ClientManager struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	mutex      sync.Mutex
+	store     Store // replays the events clients missed
+	upgrader  websocket.Upgrader
+	clients   map[*streamClient]bool
+	broadcast chan Event
+	metrics   WebSocketMetrics
+	mutex     sync.Mutex // guards clients, their send queues and metrics
 }
 
+// NewClientManager returns a manager accepting websocket connections from
+// the pages origins allows to be logged in, as the connection carries the
+// login cookie.
+func NewClientManager(store Store, origins *OriginPolicy) *ClientManager {
+	return &ClientManager{
+		store: store,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     origins.AllowsCredentials,
+		},
+		clients:   make(map[*streamClient]bool),
+		broadcast: make(chan Event, broadcastQueueSize),
+	}
+}
+
+// parseSince parses the sequence number of the last event a reconnecting
+// client got. It is -1 for clients that start afresh.
+func parseSince(value string) (int64, error) {
+	if value == "" {
+		return -1, nil
+	}
+	since, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || since < 0 {
+		return 0, errors.New("since must be an event sequence number")
+	}
+	return since, nil
+}
+
+// parseTopics parses the topics a client gives as topic query parameters
+// when it connects. They are nil if there are none, to get every event.
+func parseTopics(names []string) (map[string]topic, error) {
+	var topics map[string]topic
+	for _, name := range names {
+		t, err := parseTopic(name)
+		if err != nil {
+			return nil, err
+		}
+		if topics == nil {
+			topics = make(map[string]topic)
+		}
+		topics[name] = t
+	}
+	return topics, nil
+}
+
+// HandleWebSocket streams events to a client. A client that reconnects
+// passes the sequence number of the last event it got as the since query
+// parameter, and first gets the events it missed, or a resync_required
+// message if they are gone and it has to load everything again. Topics
+// given as topic query parameters apply from the start, replay included.
 func (manager *ClientManager) HandleWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	since, err := parseSince(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topics, err := parseTopics(c.QueryArray("topic"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conn, err := manager.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer func() {
-		manager.unregister <- conn
+	client := &streamClient{conn: conn, addr: conn.RemoteAddr().String(), topics: topics}
+	if err := manager.join(client, since); err != nil {
+		log.Printf("Error replaying events: %v", err)
 		conn.Close()
-	}()
-
-	manager.register <- conn
+		return
+	}
+	go manager.writePump(client)
 
+	// Pongs and messages from the client show it is still there
+	conn.SetReadLimit(maxClientMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		_, message, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			break
+			reason := ""
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				reason = dropPingTimeout
+			}
+			manager.remove(client, reason)
+			return
 		}
-
-		manager.broadcast <- message
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		manager.handleMessage(client, data)
 	}
 }
 
-func (manager *ClientManager) Run() {
+// writePump writes the messages queued for a client and pings it, until
+// the client is dropped or a write fails.
+func (manager *ClientManager) writePump(client *streamClient) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
 	for {
+		var err error
 		select {
-		case conn := <-manager.register:
-			manager.mutex.Lock()
-			manager.clients[conn] = true
-			manager.mutex.Unlock()
-		case conn := <-manager.unregister:
-			manager.mutex.Lock()
-			if _, ok := manager.clients[conn]; ok {
-				delete(manager.clients, conn)
-				conn.Close()
+		case message, ok := <-client.send:
+			if !ok {
+				return
 			}
-			manager.mutex.Unlock()
-		case message := <-manager.broadcast:
-			manager.mutex.Lock()
-			for conn := range manager.clients {
-				err := conn.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					conn.Close()
-					delete(manager.clients, conn)
-				}
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = client.conn.WriteMessage(websocket.TextMessage, message.data)
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = client.conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			manager.remove(client, dropWriteFailure)
+			return
+		}
+	}
+}
+
+// handleMessage acts on a message from a client. Invalid messages are
+// answered with an error message.
+func (manager *ClientManager) handleMessage(client *streamClient, data []byte) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	message, err := parseClientMessage(data)
+	if err != nil {
+		manager.enqueueJSON(client, map[string]any{"type": "error", "error": err.Error()})
+		return
+	}
+
+	switch message.Type {
+	case clientPing:
+		manager.enqueueJSON(client, map[string]any{"type": "pong", "id": message.ID})
+		return
+	case clientSubscribe:
+		if client.topics == nil {
+			client.topics = make(map[string]topic)
+		}
+		for _, name := range message.Topics {
+			client.topics[name], _ = parseTopic(name)
+		}
+	case clientUnsubscribe:
+		// A client getting every event unsubscribes from some of them
+		if client.topics == nil {
+			client.topics = make(map[string]topic)
+			for _, name := range eventTopics {
+				client.topics[name] = topic{entity: name}
 			}
-			manager.mutex.Unlock()
 		}
+		for _, name := range message.Topics {
+			delete(client.topics, name)
+		}
+	}
+
+	// Subscription changes are confirmed with the topics the client has now
+	topics := []string{}
+	for name := range client.topics {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics)
+	manager.enqueueJSON(client, map[string]any{"type": "subscribed", "topics": topics})
+}
+
+// join adds a client, first queueing the events after since unless since
+// is negative. The events are loaded without holding the mutex, so other
+// clients keep getting theirs meanwhile. The ones broadcast to this client
+// in the meantime are queued after them, leaving out the ones it already
+// got, so it gets every event once and in order.
+func (manager *ClientManager) join(client *streamClient, since int64) error {
+	manager.mutex.Lock()
+	manager.clients[client] = true
+	manager.metrics.Connected++
+	if since < 0 {
+		client.send = make(chan outMessage, sendQueueSize)
+		manager.mutex.Unlock()
+		return nil
+	}
+	client.catchingUp = true
+	manager.mutex.Unlock()
+
+	replay, latest, err := manager.replay(client, since)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if err != nil {
+		manager.drop(client, "")
+		return err
+	}
+	if !manager.clients[client] {
+		return errors.New("dropped while catching up")
+	}
+
+	// The backlog is at most sendQueueSize long, so the queue has room for
+	// all of it
+	client.send = make(chan outMessage, sendQueueSize+len(replay))
+	for _, message := range replay {
+		client.send <- message
+	}
+	client.last = latest
+	backlog := client.backlog
+	client.catchingUp, client.backlog = false, nil
+	for _, message := range backlog {
+		manager.enqueue(client, message)
+	}
+	return nil
+}
+
+// replay returns the messages carrying the events after since that client
+// wants, or a resync_required message if they are gone, and the sequence
+// number of the last event loaded. The client's topics can't change
+// meanwhile, as it doesn't read messages before it joined.
+func (manager *ClientManager) replay(client *streamClient, since int64) ([]outMessage, int64, error) {
+	events, latest, err := manager.store.EventsSince(since)
+	if errors.Is(err, ErrEventsCompacted) {
+		message, err := json.Marshal(map[string]any{
+			"version": EventVersion,
+			"type":    "resync_required",
+			"seq":     latest,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		return []outMessage{{seq: latest, data: message}}, latest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	replay := []outMessage{}
+	loaded := since
+	for _, event := range events {
+		loaded = event.Sequence
+		if !client.wants(event) {
+			continue
+		}
+		message, err := json.Marshal(event)
+		if err != nil {
+			return nil, 0, err
+		}
+		replay = append(replay, outMessage{seq: event.Sequence, data: message})
 	}
+	return replay, loaded, nil
 }
 
-func (manager *ClientManager) BroadcastUpdate(message map[string]any) {
-	jsonData, err := json.Marshal(message)
+// enqueueJSON queues a message for a client. The mutex must be held.
+func (manager *ClientManager) enqueueJSON(client *streamClient, message any) {
+	data, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Error marshalling message: %v", err)
 		return
 	}
-	manager.broadcast <- jsonData
+	manager.enqueue(client, outMessage{data: data})
+}
+
+// enqueue queues a message for a client, dropping the client if its queue is
+// full rather than waiting for it. Events the client already got are left
+// out: ones broadcast before it joined can still be on their way when the
+// replay has them too. The mutex must be held.
+func (manager *ClientManager) enqueue(client *streamClient, message outMessage) {
+	if !manager.clients[client] {
+		return
+	}
+	if client.catchingUp {
+		if len(client.backlog) == sendQueueSize {
+			manager.drop(client, dropSlowConsumer)
+			return
+		}
+		client.backlog = append(client.backlog, message)
+		return
+	}
+	if message.seq != 0 && message.seq <= client.last {
+		return
+	}
+	select {
+	case client.send <- message:
+		client.last = max(client.last, message.seq)
+	default:
+		manager.drop(client, dropSlowConsumer)
+	}
+}
+
+// remove drops a client for the given reason, or because it disconnected if
+// reason is empty. Clients that were already dropped are left alone.
+func (manager *ClientManager) remove(client *streamClient, reason string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.drop(client, reason)
+}
+
+// drop is remove with the mutex held.
+func (manager *ClientManager) drop(client *streamClient, reason string) {
+	if !manager.clients[client] {
+		return
+	}
+	delete(manager.clients, client)
+	if client.send != nil {
+		close(client.send)
+	}
+	if client.conn != nil {
+		client.conn.Close()
+	}
+
+	switch reason {
+	case dropSlowConsumer:
+		manager.metrics.SlowConsumers++
+	case dropWriteFailure:
+		manager.metrics.WriteFailures++
+	case dropPingTimeout:
+		manager.metrics.PingTimeouts++
+	}
+	if reason != "" {
+		log.Printf("Dropped client %s: %s", client.addr, reason)
+	}
+}
+
+func (manager *ClientManager) Run() {
+	for event := range manager.broadcast {
+		message, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error marshalling event: %v", err)
+			continue
+		}
+		manager.mutex.Lock()
+		for client := range manager.clients {
+			if client.wants(event) {
+				manager.enqueue(client, outMessage{seq: event.Sequence, data: message})
+			}
+		}
+		manager.mutex.Unlock()
+	}
+}
+
+// BroadcastEvent sends an event of the store to every client subscribed to
+// it. Only the server originates events.
+func (manager *ClientManager) BroadcastEvent(event Event) {
+	manager.broadcast <- event
+}
+
+// Metrics returns the current websocket metrics.
+func (manager *ClientManager) Metrics() WebSocketMetrics {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	metrics := manager.metrics
+	metrics.Clients = len(manager.clients)
+	return metrics
+}
+
+// HandleMetrics serves the websocket metrics.
+func (manager *ClientManager) HandleMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, manager.Metrics())
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newTestManager returns a running manager getting the events of a memory
+// store.
+func newTestManager(t *testing.T) (*ClientManager, *MemoryStore) {
+	t.Helper()
+	events := NewEventBus()
+	store := NewMemoryStore(events)
+	manager := NewClientManager(store, &OriginPolicy{})
+	go manager.Run()
+	t.Cleanup(func() { close(manager.broadcast) })
+	events.Subscribe(manager.BroadcastEvent)
+	return manager, store
+}
+
+// receive reads n messages queued for a client.
+func receive(t *testing.T, client *streamClient, n int) []outMessage {
+	t.Helper()
+	messages := []outMessage{}
+	timeout := time.After(5 * time.Second)
+	for len(messages) < n {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				t.Fatalf("client dropped after %d of %d messages", len(messages), n)
+			}
+			messages = append(messages, message)
+		case <-timeout:
+			t.Fatalf("got %d of %d messages", len(messages), n)
+		}
+	}
+	return messages
+}
+
+// checkSequence checks that messages carry the events from first on, each
+// once and in order.
+func checkSequence(t *testing.T, messages []outMessage, first int64) {
+	t.Helper()
+	for i, message := range messages {
+		if want := first + int64(i); message.seq != want {
+			t.Fatalf("message %d has seq %d, want %d", i, message.seq, want)
+		}
+	}
+}
+
+// TestNonReadingClient drops a client that stops reading once its queue is
+// full, without holding up the other clients.
+func TestNonReadingClient(t *testing.T) {
+	manager, store := newTestManager(t)
+	stalled := &streamClient{addr: "stalled"}
+	reader := &streamClient{addr: "reader"}
+	for _, client := range []*streamClient{stalled, reader} {
+		if err := manager.join(client, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reader handles each event before the next write, so only the
+	// stalled client falls behind
+	const n = 2 * sendQueueSize
+	for i := 0; i < n; i++ {
+		if err := store.CreateInboxItem(&InboxItem{Description: "Item"}); err != nil {
+			t.Fatal(err)
+		}
+		checkSequence(t, receive(t, reader, 1), int64(i+1))
+	}
+
+	if got := manager.Metrics().SlowConsumers; got != 1 {
+		t.Errorf("got %d slow consumers, want 1", got)
+	}
+	queued := 0
+	for range stalled.send {
+		queued++
+	}
+	if queued != sendQueueSize {
+		t.Errorf("the stalled client had %d messages queued when dropped, want %d", queued, sendQueueSize)
+	}
+}
+
+// slowReplayStore holds up loading the events clients missed until release
+// is closed.
+type slowReplayStore struct {
+	*MemoryStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s slowReplayStore) EventsSince(since int64) ([]Event, int64, error) {
+	close(s.loading)
+	<-s.release
+	return s.MemoryStore.EventsSince(since)
+}
+
+// returningClient reconnects to srv over the websocket or SSE after
+// event since, and returns the sequence numbers of the events it gets.
+func returningClient(t *testing.T, srv *httptest.Server, via string, since int64) <-chan int64 {
+	seqs := make(chan int64, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		switch via {
+		case "websocket":
+			url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws?since=" + strconv.FormatInt(since, 10)
+			conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			for {
+				var message struct {
+					Seq int64 `json:"seq"`
+				}
+				if err := conn.ReadJSON(&message); err != nil {
+					return
+				}
+				seqs <- message.Seq
+			}
+		case "sse":
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Last-Event-ID", strconv.FormatInt(since, 10))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if value, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+					seq, _ := strconv.ParseInt(value, 10, 64)
+					seqs <- seq
+				}
+			}
+		}
+	}()
+	return seqs
+}
+
+// TestCatchUpWhileBroadcasting keeps broadcasting to other clients while a
+// reconnecting client's missed events are loaded, and queues the events
+// broadcast meanwhile after them without repeating any. That includes an
+// event loaded with the missed ones that reaches the manager only after the
+// client has caught up. The client reconnects over the websocket with since,
+// and over SSE with the Last-Event-ID header.
+func TestCatchUpWhileBroadcasting(t *testing.T) {
+	for _, via := range []string{"websocket", "sse"} {
+		t.Run(via, func(t *testing.T) {
+			events := NewEventBus()
+			memory := NewMemoryStore(events)
+			store := slowReplayStore{memory, make(chan struct{}), make(chan struct{})}
+			manager := NewClientManager(store, &OriginPolicy{})
+			go manager.Run()
+			t.Cleanup(func() { close(manager.broadcast) })
+			// Holding delaying keeps committed events from the manager
+			var delaying sync.Mutex
+			events.Subscribe(func(event Event) {
+				delaying.Lock()
+				delaying.Unlock()
+				manager.BroadcastEvent(event)
+			})
+			r := gin.New()
+			r.GET("/api/ws", manager.HandleWebSocket)
+			r.GET("/api/events", manager.HandleEvents)
+			srv := httptest.NewServer(r)
+			t.Cleanup(srv.Close)
+
+			create := func(description string) {
+				if err := store.CreateInboxItem(&InboxItem{Description: description}); err != nil {
+					t.Error(err)
+				}
+			}
+			next := func(returned <-chan int64, n int) []int64 {
+				seqs := []int64{}
+				timeout := time.After(5 * time.Second)
+				for len(seqs) < n {
+					select {
+					case seq := <-returned:
+						seqs = append(seqs, seq)
+					case <-timeout:
+						t.Fatalf("got events %v, want %d", seqs, n)
+					}
+				}
+				return seqs
+			}
+
+			other := &streamClient{addr: "other"}
+			if err := manager.join(other, -1); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				create("Before")
+			}
+			checkSequence(t, receive(t, other, 3), 1)
+			returned := returningClient(t, srv, via, 1)
+			<-store.loading
+
+			for i := 0; i < 2; i++ {
+				create("During")
+			}
+			checkSequence(t, receive(t, other, 2), 4)
+
+			// Event 6 is committed, so the returning client loads it, but
+			// it reaches the manager only once the client has caught up
+			delaying.Lock()
+			go create("Delayed")
+			for latest := int64(0); latest < 6; {
+				if _, latest, _ = memory.EventsSince(0); latest < 6 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			close(store.release)
+			got := next(returned, 5)
+			delaying.Unlock()
+			create("After")
+
+			got = append(got, next(returned, 1)...)
+			if want := []int64{2, 3, 4, 5, 6, 7}; !slices.Equal(got, want) {
+				t.Errorf("got events %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestTopics follows a next action through two projects and a context, and
+// checks that each topic gets the events of the action entering it and
+// leaving it, live and on replay.
+func TestTopics(t *testing.T) {
+	for _, kind := range testStores {
+		t.Run(kind.name, func(t *testing.T) {
+			events := NewEventBus()
+			store := kind.new(t, events)
+			manager := NewClientManager(store, &OriginPolicy{})
+			go manager.Run()
+			t.Cleanup(func() { close(manager.broadcast) })
+			events.Subscribe(manager.BroadcastEvent)
+
+			want := map[string][]int64{
+				"project:a":                   {1, 4, 5},
+				"project:b":                   {2, 5, 6},
+				"next-actions?context=@phone": {4, 5},
+				"next_action":                 {4, 5, 6},
+			}
+			live := map[string]*streamClient{}
+			for name := range want {
+				topics, err := parseTopics([]string{name})
+				if err != nil {
+					t.Fatal(err)
+				}
+				live[name] = &streamClient{addr: name, topics: topics}
+				if err := manager.join(live[name], -1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, project := range []*Project{{ID: "a", Name: "A"}, {ID: "b", Name: "B"}} {
+				if err := store.CreateProject(project); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.CreateContext(&Context{ID: "phone", Name: "@phone"}); err != nil {
+				t.Fatal(err)
+			}
+			action := &NextAction{ID: "call", Action: "Call", ProjectID: "a", Contexts: []string{"@phone"}}
+			if err := store.CreateNextAction(action); err != nil {
+				t.Fatal(err)
+			}
+			projectID, contexts := "b", []string{}
+			if _, err := store.UpdateNextAction("call", NextActionUpdate{ProjectID: &projectID, Contexts: &contexts}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteNextAction("call"); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, seqs := range want {
+				topics, _ := parseTopics([]string{name})
+				replayed := &streamClient{addr: name, topics: topics}
+				if err := manager.join(replayed, 0); err != nil {
+					t.Fatal(err)
+				}
+				for _, client := range []*streamClient{live[name], replayed} {
+					got := []int64{}
+					for _, message := range receive(t, client, len(seqs)) {
+						got = append(got, message.seq)
+					}
+					if !slices.Equal(got, seqs) {
+						t.Errorf("%s got events %v, want %v", name, got, seqs)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestUnsubscribeFromAll checks that a client getting every event can
+// unsubscribe from all the topics and get nothing.
+func TestUnsubscribeFromAll(t *testing.T) {
+	manager, store := newTestManager(t)
+	client := &streamClient{addr: "client"}
+	if err := manager.join(client, -1); err != nil {
+		t.Fatal(err)
+	}
+	manager.handleMessage(client, []byte(`{"type":"unsubscribe","topics":["inbox"]}`))
+	receive(t, client, 1)
+	if client.wants(Event{Entity: EntityInbox}) || !client.wants(Event{Entity: EntityProject}) {
+		t.Fatal("unsubscribing from inbox didn't leave only the other topics")
+	}
+
+	manager.handleMessage(client, []byte(`{"type":"unsubscribe","topics":["project","next_action","context","waiting_for","someday","reference"]}`))
+	receive(t, client, 1)
+	if err := store.CreateProject(&Project{ID: "p", Name: "P"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateInboxItem(&InboxItem{Description: "Item"}); err != nil {
+		t.Fatal(err)
+	}
+	// The manager handles events in order, so one for another client
+	// shows they are through
+	other := &streamClient{addr: "other"}
+	if err := manager.join(other, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateInboxItem(&InboxItem{Description: "Marker"}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, other, 1)
+	if len(client.send) != 0 {
+		t.Errorf("client without topics got %d messages", len(client.send))
+	}
+}
@@ -5,10 +5,26 @@ import * as bootstrap from 'bootstrap'
 
 import { createApp } from 'vue'
 import { createPinia } from 'pinia'
+import axios from 'axios'
+import { v4 as uuidv4 } from 'uuid'
 
 import App from './App.vue'
 import router from './router'
 
+// Every tab is its own session with its own undo history on the server
+const sessionId = sessionStorage.getItem('gsd-session-id') ?? uuidv4()
+sessionStorage.setItem('gsd-session-id', sessionId)
+axios.defaults.headers.common['X-Session-ID'] = sessionId
+
+// Send to the login page whenever the login is missing or has expired
+axios.interceptors.response.use(undefined, (error) => {
+  const current = router.currentRoute.value
+  if (error.response?.status === 401 && current.name !== 'Login') {
+    router.push({ name: 'Login', query: { redirect: current.fullPath } })
+  }
+  return Promise.reject(error)
+})
+
 const app = createApp(App)
 
 app.use(createPinia())
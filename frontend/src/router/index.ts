@@ -30,6 +30,11 @@ const router = createRouter({
       path: '/process-inbox',
       name: 'ProcessIinbox',
       component: ProcessInboxView
+    },
+    {
+      path: '/login',
+      name: 'Login',
+      component: () => import('../views/LoginView.vue'),
     }
   ],
 })
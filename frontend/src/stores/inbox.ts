@@ -7,6 +7,7 @@ type InboxItem = {
   description: string;
   url?: string;
   created_at: string;
+  state?: string;
 };
 
 export const useInboxStore = defineStore('inbox', () => {
@@ -14,22 +15,68 @@ export const useInboxStore = defineStore('inbox', () => {
 
   const inboxItemCount = computed(() => inboxItems.value.length)
   let ws: WebSocket | null = null
+  // Sequence number of the latest event seen, to catch up after reconnecting
+  let lastSeq: number | null = null
 
+  // The websocket needs a login, so it is only opened once there is one
   function initWebSocket() {
-    ws = new WebSocket('ws://localhost:8081/api/ws')
-    ws.onmessage = (event) => {
+    if (ws) return
+    const since = lastSeq === null ? '' : `&since=${lastSeq}`
+    // Same origin as the page, which is the only one the server accepts by default
+    const protocol = location.protocol === 'https:' ? 'wss' : 'ws'
+    const socket = new WebSocket(`${protocol}://${location.host}/api/ws?topic=inbox${since}`)
+    ws = socket
+    socket.onmessage = (event) => {
       const data = JSON.parse(event.data)
-      if (data.type === 'inbox_item_created') {
-        inboxItems.value.push(data.data)
+      if (data.type === 'subscribed' || data.type === 'pong' || data.type === 'error') {
+        return
       }
+      if (data.type === 'resync_required') {
+        lastSeq = data.seq
+        fetchInboxItems()
+        return
+      }
+      // Events right after catching up may repeat ones already seen
+      if (lastSeq !== null && data.seq <= lastSeq) {
+        return
+      }
+      lastSeq = data.seq
+      if (data.entity !== 'inbox') {
+        return
+      }
+      // Events carry the item as it is now; only open items are listed
+      const others = inboxItems.value.filter(item => item.id !== data.entity_id)
+      inboxItems.value = data.data?.state === 'inbox'
+        ? [...others, data.data].sort((a, b) => a.created_at.localeCompare(b.created_at))
+        : others
+    }
+    socket.onclose = () => {
+      // Closed by closeWebSocket, or replaced
+      if (ws !== socket) return
+      ws = null
+      setTimeout(reconnect, 1000)
     }
-    ws.onclose = () => {
-      setTimeout(() => { initWebSocket() }, 1000)
+  }
+
+  // A websocket refused for a missing login only closes, so the login is
+  // checked before trying again. Without one, the 401 sends the user to the
+  // login page, which opens the websocket again after logging in.
+  async function reconnect() {
+    if (ws) return
+    try {
+      await axios.get('/api/me')
+    } catch (error) {
+      if (axios.isAxiosError(error) && error.response?.status === 401) return
+      setTimeout(reconnect, 1000)
+      return
     }
+    initWebSocket()
   }
 
   function closeWebSocket() {
-    ws?.close()
+    const socket = ws
+    ws = null
+    socket?.close()
   }
 
   async function fetchInboxItems() {
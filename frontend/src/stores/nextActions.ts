@@ -94,31 +94,19 @@ export const useNextActionsStore = defineStore('nextActions', () => {
     const prevAction = newIndex > 0 ? sortedActions.value[newIndex - 1] : null;
     const nextAction = newIndex < sortedActions.value.length - 1 ? sortedActions.value[newIndex + 1] : null;
 
-    let newPosition;
-    if (!prevAction) {
-      newPosition = nextAction ? nextAction.position / 2 : 1;
-    } else if (!nextAction) {
-      newPosition = prevAction.position + 1;
-    } else {
-      newPosition = (prevAction.position + nextAction.position) / 2;
-    }
-
-    if (sortDirection.value === 'desc') {
-      const maxPosition = Math.max(...nextActions.value.map(a => a.position || 0));
-      newPosition = maxPosition - newPosition + 1;
-    }
+    // The server works out the position; descending lists are shown upside down
+    const [after, before] = sortDirection.value === 'asc' ? [prevAction, nextAction] : [nextAction, prevAction];
 
     try {
-      await axios.patch(`/api/next-actions/${movedAction.id}`, {
-        position: newPosition
+      await axios.post(`/api/next-actions/${movedAction.id}/move`, {
+        before: before?.id ?? '',
+        after: after?.id ?? ''
       });
-      const index = nextActions.value.findIndex(a => a.id === movedAction.id);
-      if (index !== -1) {
-        nextActions.value[index].position = newPosition;
-      }
     } catch (error) {
       console.error('Failed to update action position:', error);
     }
+    // Other actions may have been renumbered to make room
+    await fetchData();
   }
 
   async function toggleComplete(action: NextAction) {
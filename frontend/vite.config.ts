@@ -20,8 +20,11 @@ export default defineConfig({
     proxy: {
       '/api': {
         target: 'http://localhost:8081', // Your backend server
-        changeOrigin: true,
-        secure: false
+        // Keep the Host header, so the backend sees requests from the dev
+        // server's pages as same-origin
+        changeOrigin: false,
+        secure: false,
+        ws: true
       }
     }
   }